@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"assecor.assessment.test/client"
+)
+
+func TestClient(t *testing.T) {
+	app := newTestApp(t)
+	app.config.idempotency.ttl = time.Hour
+
+	// failures is the number of requests to fail; the first is processed
+	// before its response is replaced by a 502 Bad Gateway. conflicts is
+	// the number of requests answered as if an earlier attempt was still
+	// being processed.
+	var failures, conflicts atomic.Int64
+	var requests atomic.Int64
+	routes := app.routes()
+	ts := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if conflicts.Add(-1) >= 0 {
+			app.idempotencyConflictResponse(w, r, "the request with this Idempotency-Key is being processed, retry later")
+			return
+		}
+		if failures.Add(-1) >= 0 {
+			routes.ServeHTTP(httptest.NewRecorder(), r)
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		routes.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	c := client.New(ts.URL+"/", "")
+	c.RetryBackoff = time.Millisecond
+	ctx := context.Background()
+
+	hans := &client.NewPerson{Name: "Hans", Lastname: "Müller", Zipcode: "67742", City: "Lauterecken", Color: client.Blue}
+	created, err := c.CreatePerson(ctx, hans)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.ID != 1 || created.Color != client.Blue || created.Country != "DE" {
+		t.Errorf("want person 1 with color blue in DE; got %+v", created)
+	}
+
+	t.Run("Get", func(t *testing.T) {
+		p, err := c.GetPerson(ctx, created.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Name != "Hans" || p.Color != client.Blue || p.Color.String() != "blau" || p.CreatedAt.IsZero() {
+			t.Errorf("want Hans with color blau; got %+v", p)
+		}
+	})
+
+	t.Run("Not found", func(t *testing.T) {
+		_, err := c.GetPerson(ctx, 99)
+		if !errors.Is(err, client.ErrNotFound) {
+			t.Errorf("want ErrNotFound; got %v", err)
+		}
+		var apiErr *client.Error
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+			t.Errorf("want *Error with status 404; got %v", err)
+		}
+	})
+
+	t.Run("Validation error", func(t *testing.T) {
+		_, err := c.CreatePerson(ctx, &client.NewPerson{
+			Name: "Hans", Lastname: strings.Repeat("x", 251), Zipcode: "67742", City: "Lauterecken", Color: 42,
+		})
+		var verr *client.ValidationError
+		if !errors.As(err, &verr) {
+			t.Fatalf("want *ValidationError; got %v", err)
+		}
+		if len(verr.Fields["lastname"]) != 1 || verr.Fields["lastname"][0].Code != "max_length" {
+			t.Errorf("want max_length error for lastname; got %+v", verr.Fields)
+		}
+		if len(verr.Fields["color"]) != 1 || verr.Fields["color"][0].Code != "out_of_range" {
+			t.Errorf("want out_of_range error for color; got %+v", verr.Fields)
+		}
+		if errors.Is(err, client.ErrNotFound) {
+			t.Error("want no ErrNotFound")
+		}
+	})
+
+	green := &client.NewPerson{Name: "Jonas", Lastname: "Becker", Zipcode: "10115", City: "Berlin", Color: client.Green}
+	if _, err := c.CreatePerson(ctx, green); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("List", func(t *testing.T) {
+		persons, err := c.ListPersons(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(persons) != 2 || persons[0].Name != "Hans" || persons[1].Color != client.Green {
+			t.Errorf("want Hans and Jonas; got %+v", persons)
+		}
+		persons, err = c.ListPersons(ctx, &client.ListOptions{UpdatedSince: time.Now().Add(time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(persons) != 0 {
+			t.Errorf("want no persons updated in the future; got %+v", persons)
+		}
+	})
+
+	t.Run("List by color", func(t *testing.T) {
+		persons, err := c.ListPersonsByColor(ctx, client.Green)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(persons) != 1 || persons[0].Name != "Jonas" {
+			t.Errorf("want Jonas; got %+v", persons)
+		}
+		persons, err = c.ListPersonsByColor(ctx, client.White)
+		if err != nil || len(persons) != 0 {
+			t.Errorf("want no persons; got %+v, %v", persons, err)
+		}
+	})
+
+	t.Run("Retry", func(t *testing.T) {
+		requests.Store(0)
+		failures.Store(2)
+		p, err := c.CreatePerson(ctx, &client.NewPerson{
+			Name: "Anna", Lastname: "Schmidt", Zipcode: "10115", City: "Berlin", Color: client.Red,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if requests.Load() != 3 {
+			t.Errorf("want 3 requests; got %d", requests.Load())
+		}
+		// The retries are replayed from the first, processed request.
+		persons, err := c.ListPersonsByColor(ctx, client.Red)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(persons) != 1 || persons[0].ID != p.ID {
+			t.Errorf("want only person %d; got %+v", p.ID, persons)
+		}
+	})
+
+	t.Run("Retry while processed", func(t *testing.T) {
+		requests.Store(0)
+		conflicts.Store(1)
+		defer conflicts.Store(0)
+		_, err := c.CreatePerson(ctx, &client.NewPerson{
+			Name: "Jonas", Lastname: "Schmidt", Zipcode: "10115", City: "Berlin", Color: client.Yellow,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if requests.Load() != 2 {
+			t.Errorf("want 2 requests; got %d", requests.Load())
+		}
+	})
+
+	t.Run("Too many failures", func(t *testing.T) {
+		requests.Store(0)
+		failures.Store(10)
+		_, err := c.GetPerson(ctx, created.ID)
+		var apiErr *client.Error
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadGateway {
+			t.Errorf("want *Error with status 502; got %v", err)
+		}
+		if requests.Load() != int64(c.MaxRetries)+1 {
+			t.Errorf("want %d requests; got %d", c.MaxRetries+1, requests.Load())
+		}
+	})
+
+	t.Run("Context", func(t *testing.T) {
+		failures.Store(10)
+		defer failures.Store(0)
+		c := client.New(ts.URL, "")
+		c.RetryBackoff = time.Hour
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		_, err := c.GetPerson(ctx, created.ID)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("want context.DeadlineExceeded; got %v", err)
+		}
+	})
+}
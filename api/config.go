@@ -0,0 +1,404 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"assecor.assessment.test/internal/data"
+	"assecor.assessment.test/internal/validator"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is prepended to the upper-cased flag name, with dashes replaced
+// by underscores, to get the environment variable for a setting, e.g.
+// ASSECOR_LIMITER_RPS for -limiter-rps.
+const envPrefix = "ASSECOR_"
+
+// secretSettings are never shown by "config print".
+var secretSettings = map[string]bool{
+	"auth-admin-key": true,
+}
+
+type config struct {
+	port   int
+	env    string
+	dsn    string
+	server struct {
+		idleTimeout     time.Duration
+		readTimeout     time.Duration
+		writeTimeout    time.Duration
+		shutdownTimeout time.Duration
+		drainTimeout    time.Duration
+	}
+	listen struct {
+		socket     string
+		socketMode fileMode
+	}
+	tls struct {
+		cert         string
+		key          string
+		clientCA     string
+		redirectPort int
+	}
+	db struct {
+		path         string
+		queryTimeout time.Duration
+	}
+	log struct {
+		level slog.Level
+	}
+	csv struct {
+		comma      string
+		comment    string
+		lazyQuotes bool
+		country    string
+		duplicates string
+		source     string
+	}
+	postal struct {
+		directory string
+		country   string
+		check     string
+	}
+	idempotency struct {
+		ttl time.Duration
+	}
+	persons struct {
+		retention     time.Duration
+		purgeInterval time.Duration
+	}
+	events struct {
+		replay int
+	}
+	webhooks struct {
+		interval    time.Duration
+		timeout     time.Duration
+		backoff     time.Duration
+		maxAttempts int
+	}
+	auth struct {
+		enabled           bool
+		adminKey          string
+		failuresPerMinute float64
+		failuresBurst     int
+	}
+	limiter struct {
+		enabled        bool
+		rps            float64
+		burst          int
+		trustedProxies prefixList
+	}
+	cors struct {
+		trustedOrigins stringList
+		maxAge         time.Duration
+	}
+	jwt struct {
+		jwks     string
+		pem      string
+		issuer   string
+		audience string
+	}
+}
+
+// loadConfig builds the effective configuration. Every setting is a flag;
+// its value is taken from, in increasing order of precedence, the flag
+// default, the config file (-config or ASSECOR_CONFIG), the ASSECOR_*
+// environment variable and finally the command line. The returned flag set
+// is used to print the configuration.
+func loadConfig(args []string, lookupEnv func(string) (string, bool)) (config, *flag.FlagSet, error) {
+	var cfg config
+	fs := flag.NewFlagSet("api", flag.ContinueOnError)
+
+	configFile := fs.String("config", "", "YAML or TOML config file")
+	fs.IntVar(&cfg.port, "port", 4000, "API server port")
+	fs.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+	fs.StringVar(&cfg.dsn, "dsn", "", "CSV file to import persons from")
+
+	fs.DurationVar(&cfg.server.idleTimeout, "server-idle-timeout", time.Minute, "Keep-alive connection idle timeout")
+	fs.DurationVar(&cfg.server.readTimeout, "server-read-timeout", 10*time.Second, "Request read timeout")
+	fs.DurationVar(&cfg.server.writeTimeout, "server-write-timeout", 30*time.Second, "Response write timeout")
+	fs.DurationVar(&cfg.server.shutdownTimeout, "server-shutdown-timeout", 5*time.Second, "Graceful shutdown timeout")
+	fs.DurationVar(&cfg.server.drainTimeout, "server-drain-timeout", 30*time.Second, "How long shutdown waits for background tasks")
+
+	cfg.listen.socketMode = 0o660
+	fs.StringVar(&cfg.listen.socket, "listen-socket", "", "Unix domain socket path to listen on instead of the TCP port")
+	fs.Var(&cfg.listen.socketMode, "listen-socket-mode", "Unix domain socket file permissions")
+
+	fs.StringVar(&cfg.tls.cert, "tls-cert", "", "TLS certificate file, enables HTTPS")
+	fs.StringVar(&cfg.tls.key, "tls-key", "", "TLS private key file")
+	fs.StringVar(&cfg.tls.clientCA, "tls-client-ca", "", "CA bundle to verify client certificates against (mutual TLS)")
+	fs.IntVar(&cfg.tls.redirectPort, "tls-redirect-port", 0, "Plain HTTP port redirecting to HTTPS (disabled if 0)")
+
+	fs.StringVar(&cfg.db.path, "db-path", "", "DuckDB database file (in-memory if empty)")
+	fs.DurationVar(&cfg.db.queryTimeout, "db-query-timeout", 3*time.Second, "Database query timeout")
+
+	fs.TextVar(&cfg.log.level, "log-level", slog.LevelInfo, "Log level (debug|info|warn|error)")
+
+	fs.StringVar(&cfg.csv.comma, "csv-comma", ",", "CSV field delimiter")
+	fs.StringVar(&cfg.csv.comment, "csv-comment", "", "CSV comment character (disabled if empty)")
+	fs.BoolVar(&cfg.csv.lazyQuotes, "csv-lazy-quotes", false, "Allow quotes in unquoted CSV fields")
+	fs.StringVar(&cfg.csv.country, "csv-country", "DE", "Country of CSV records without country column")
+	fs.StringVar(&cfg.csv.source, "csv-source", "", "Partner system of the CSV file, records with external ID column are upserted")
+	fs.StringVar(&cfg.csv.duplicates, "csv-duplicates", data.DuplicatesInsert, "What to do with CSV records matching an existing person (insert|skip|update)")
+
+	fs.StringVar(&cfg.postal.directory, "postal-directory", "", "Postal code directory file (zipcode to official city names)")
+	fs.StringVar(&cfg.postal.country, "postal-country", "DE", "Country of postal code directory entries without country column")
+	fs.StringVar(&cfg.postal.check, "postal-check", data.PostalCheckOff, "Check cities against the postal code directory (off|flag|reject)")
+
+	fs.DurationVar(&cfg.idempotency.ttl, "idempotency-ttl", 24*time.Hour, "How long responses are replayed for a repeated Idempotency-Key")
+
+	fs.DurationVar(&cfg.persons.retention, "persons-retention", 30*24*time.Hour, "How long deleted persons can be restored before they are purged")
+	fs.DurationVar(&cfg.persons.purgeInterval, "persons-purge-interval", time.Hour, "Interval of the purge of deleted persons")
+
+	fs.IntVar(&cfg.events.replay, "events-replay", 1000, "Number of events kept for clients resuming the event stream")
+
+	fs.DurationVar(&cfg.webhooks.interval, "webhooks-interval", 5*time.Second, "Interval of the delivery of queued webhook events")
+	fs.DurationVar(&cfg.webhooks.timeout, "webhooks-timeout", 10*time.Second, "Timeout of a webhook delivery")
+	fs.DurationVar(&cfg.webhooks.backoff, "webhooks-backoff", 30*time.Second, "Delay before the first retry of a failed webhook delivery, doubled for every further retry")
+	fs.IntVar(&cfg.webhooks.maxAttempts, "webhooks-max-attempts", 8, "Attempts of a webhook delivery before it is moved to the dead letters")
+
+	fs.BoolVar(&cfg.auth.enabled, "auth-enabled", true, "Require API keys or bearer tokens")
+	fs.StringVar(&cfg.auth.adminKey, "auth-admin-key", "", "Bootstrap API key with admin role")
+	fs.Float64Var(&cfg.auth.failuresPerMinute, "auth-failures-per-minute", 5, "Failed authentications allowed per client IP and minute, 0 disables the limit")
+	fs.IntVar(&cfg.auth.failuresBurst, "auth-failures-burst", 5, "Failed authentications allowed per client IP in a burst")
+
+	fs.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	fs.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
+	fs.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
+	fs.Var(&cfg.limiter.trustedProxies, "limiter-trusted-proxies", "Comma separated proxy addresses or CIDR ranges allowed to set X-Forwarded-For")
+
+	fs.Var(&cfg.cors.trustedOrigins, "cors-trusted-origins", "Trusted CORS origins (space separated)")
+	fs.DurationVar(&cfg.cors.maxAge, "cors-max-age", 10*time.Minute, "How long browsers may cache preflight responses")
+
+	fs.StringVar(&cfg.jwt.jwks, "jwt-jwks", "", "JWKS file with keys to verify bearer tokens")
+	fs.StringVar(&cfg.jwt.pem, "jwt-pem", "", "PEM file with keys to verify bearer tokens")
+	fs.StringVar(&cfg.jwt.issuer, "jwt-issuer", "", "Required bearer token issuer")
+	fs.StringVar(&cfg.jwt.audience, "jwt-audience", "", "Required bearer token audience")
+
+	// Parse the command line first to find the config file, then apply the
+	// lower layers to every flag which wasn't set explicitly.
+	err := fs.Parse(args)
+	if err != nil {
+		return cfg, nil, err
+	}
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	if *configFile == "" {
+		*configFile, _ = lookupEnv(envPrefix + "CONFIG")
+	}
+	if *configFile != "" {
+		values, err := readConfigFile(*configFile)
+		if err != nil {
+			return cfg, nil, err
+		}
+		for name, value := range values {
+			if fs.Lookup(name) == nil || name == "config" {
+				return cfg, nil, fmt.Errorf("config %s: unknown setting %q", *configFile, name)
+			}
+			if explicit[name] {
+				continue
+			}
+			if err := fs.Set(name, value); err != nil {
+				return cfg, nil, fmt.Errorf("config %s: %s: %w", *configFile, name, err)
+			}
+		}
+	}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] || f.Name == "config" {
+			return
+		}
+		key := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := lookupEnv(key); ok {
+			if e := fs.Set(f.Name, value); e != nil {
+				err = fmt.Errorf("%s: %w", key, e)
+			}
+		}
+	})
+	if err != nil {
+		return cfg, nil, err
+	}
+
+	return cfg, fs, cfg.validate()
+}
+
+func (cfg config) validate() error {
+	if (cfg.tls.cert == "") != (cfg.tls.key == "") {
+		return errors.New("tls-cert and tls-key must be set together")
+	}
+	if cfg.tls.cert == "" && (cfg.tls.clientCA != "" || cfg.tls.redirectPort != 0) {
+		return errors.New("tls-client-ca and tls-redirect-port require tls-cert and tls-key")
+	}
+	if len([]rune(cfg.csv.comma)) != 1 {
+		return errors.New("csv-comma must be a single character")
+	}
+	if len([]rune(cfg.csv.comment)) > 1 {
+		return errors.New("csv-comment must be a single character")
+	}
+	if cfg.csv.source != "" && !validator.Matches(cfg.csv.source, data.SourceRX) {
+		return errors.New("csv-source must be 1 to 50 lowercase letters, digits, '-' or '_'")
+	}
+	if !validator.PermittedValue(cfg.csv.duplicates, data.DuplicatesInsert, data.DuplicatesSkip, data.DuplicatesUpdate) {
+		return errors.New("csv-duplicates must be one of insert, skip, update")
+	}
+	if !validator.PermittedValue(cfg.postal.check, data.PostalCheckOff, data.PostalCheckFlag, data.PostalCheckReject) {
+		return errors.New("postal-check must be one of off, flag, reject")
+	}
+	if cfg.postal.check != data.PostalCheckOff && cfg.postal.directory == "" {
+		return errors.New("postal-check requires postal-directory")
+	}
+	if cfg.persons.retention < 0 || cfg.persons.purgeInterval <= 0 {
+		return errors.New("persons-retention must not be negative and persons-purge-interval must be positive")
+	}
+	if cfg.events.replay < 1 {
+		return errors.New("events-replay must be positive")
+	}
+	if cfg.webhooks.interval <= 0 || cfg.webhooks.timeout <= 0 || cfg.webhooks.backoff <= 0 {
+		return errors.New("webhooks-interval, webhooks-timeout and webhooks-backoff must be positive")
+	}
+	if cfg.webhooks.maxAttempts < 1 || cfg.webhooks.maxAttempts > 20 {
+		return errors.New("webhooks-max-attempts must be between 1 and 20")
+	}
+	if cfg.auth.failuresPerMinute < 0 || (cfg.auth.failuresPerMinute > 0 && cfg.auth.failuresBurst < 1) {
+		return errors.New("auth-failures-per-minute and auth-failures-burst must be positive")
+	}
+	if cfg.limiter.enabled && (cfg.limiter.rps <= 0 || cfg.limiter.burst < 1) {
+		return errors.New("limiter-rps and limiter-burst must be positive")
+	}
+	return nil
+}
+
+// readConfigFile reads a YAML or TOML file, depending on the file extension.
+// Nested tables are flattened into flag names by joining the keys with a
+// dash, so "limiter: {rps: 5}" sets -limiter-rps. Lists are joined the way
+// the corresponding flags expect them.
+func readConfigFile(fileName string) (map[string]string, error) {
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &tree)
+	case ".toml":
+		err = toml.Unmarshal(b, &tree)
+	default:
+		return nil, fmt.Errorf("config %s: unsupported file type, use .yaml or .toml", fileName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config %s: %w", fileName, err)
+	}
+
+	values := map[string]string{}
+	flattenConfig("", tree, values)
+	return values, nil
+}
+
+func flattenConfig(prefix string, tree map[string]interface{}, values map[string]string) {
+	for key, value := range tree {
+		name := key
+		if prefix != "" {
+			name = prefix + "-" + key
+		}
+		switch value := value.(type) {
+		case map[string]interface{}:
+			flattenConfig(name, value, values)
+		case []interface{}:
+			items := make([]string, len(value))
+			for i, item := range value {
+				items[i] = fmt.Sprint(item)
+			}
+			values[name] = strings.Join(items, ",")
+		default:
+			values[name] = fmt.Sprint(value)
+		}
+	}
+}
+
+// printConfig writes the effective configuration as YAML using flat keys,
+// which can be fed back as config file. Secrets are redacted.
+func printConfig(w io.Writer, fs *flag.FlagSet) {
+	var lines []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		value := f.Value.String()
+		if secretSettings[f.Name] && value != "" {
+			value = "[redacted]"
+		}
+		lines = append(lines, fmt.Sprintf("%s: %q", f.Name, value))
+	})
+	sort.Strings(lines)
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+}
+
+// stringList is a flag holding a list of strings separated by spaces or
+// commas.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+	return nil
+}
+
+// prefixList is a flag holding a comma separated list of IP addresses and
+// CIDR ranges.
+type prefixList []netip.Prefix
+
+func (l *prefixList) String() string {
+	items := make([]string, len(*l))
+	for i, p := range *l {
+		items[i] = p.String()
+	}
+	return strings.Join(items, ",")
+}
+
+func (l *prefixList) Set(s string) error {
+	prefixes, err := parsePrefixes(s)
+	if err != nil {
+		return err
+	}
+	*l = prefixes
+	return nil
+}
+
+// fileMode is a flag holding octal file permissions.
+type fileMode os.FileMode
+
+func (m *fileMode) String() string {
+	return fmt.Sprintf("%#o", uint32(*m))
+}
+
+func (m *fileMode) Set(s string) error {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0o777 {
+		return errors.New("must be octal file permissions, e.g. 0660")
+	}
+	*m = fileMode(mode)
+	return nil
+}
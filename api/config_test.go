@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	yamlFile := filepath.Join(dir, "config.yaml")
+	err := os.WriteFile(yamlFile, []byte(`
+port: 5000
+log:
+  level: debug
+server:
+  read-timeout: 20s
+limiter:
+  rps: 10
+  burst: 20
+  trusted-proxies: [10.0.0.0/8, 192.0.2.1]
+cors:
+  trusted-origins:
+    - https://a.example
+    - https://b.example
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tomlFile := filepath.Join(dir, "config.toml")
+	err = os.WriteFile(tomlFile, []byte(`
+port = 6000
+
+[db]
+query-timeout = "1s"
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badFile := filepath.Join(dir, "bad.yaml")
+	err = os.WriteFile(badFile, []byte("limiter:\n  foo: 1\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := func(vars map[string]string) func(string) (string, bool) {
+		return func(key string) (string, bool) {
+			v, ok := vars[key]
+			return v, ok
+		}
+	}
+
+	t.Run("Defaults", func(t *testing.T) {
+		cfg, _, err := loadConfig(nil, env(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.port != 4000 {
+			t.Errorf("want port %d; got %d", 4000, cfg.port)
+		}
+		if cfg.server.shutdownTimeout != 5*time.Second {
+			t.Errorf("want shutdown timeout %s; got %s", 5*time.Second, cfg.server.shutdownTimeout)
+		}
+		if cfg.db.queryTimeout != 3*time.Second {
+			t.Errorf("want query timeout %s; got %s", 3*time.Second, cfg.db.queryTimeout)
+		}
+	})
+
+	t.Run("YAML file", func(t *testing.T) {
+		cfg, _, err := loadConfig([]string{"-config", yamlFile}, env(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.port != 5000 {
+			t.Errorf("want port %d; got %d", 5000, cfg.port)
+		}
+		if cfg.log.level != slog.LevelDebug {
+			t.Errorf("want log level %s; got %s", slog.LevelDebug, cfg.log.level)
+		}
+		if cfg.server.readTimeout != 20*time.Second {
+			t.Errorf("want read timeout %s; got %s", 20*time.Second, cfg.server.readTimeout)
+		}
+		if cfg.limiter.rps != 10 || cfg.limiter.burst != 20 {
+			t.Errorf("want limiter 10/20; got %v/%d", cfg.limiter.rps, cfg.limiter.burst)
+		}
+		if len(cfg.limiter.trustedProxies) != 2 {
+			t.Errorf("want 2 trusted proxies; got %v", cfg.limiter.trustedProxies)
+		}
+		if len(cfg.cors.trustedOrigins) != 2 {
+			t.Errorf("want 2 trusted origins; got %v", cfg.cors.trustedOrigins)
+		}
+	})
+
+	t.Run("TOML file from environment", func(t *testing.T) {
+		cfg, _, err := loadConfig(nil, env(map[string]string{"ASSECOR_CONFIG": tomlFile}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.port != 6000 {
+			t.Errorf("want port %d; got %d", 6000, cfg.port)
+		}
+		if cfg.db.queryTimeout != time.Second {
+			t.Errorf("want query timeout %s; got %s", time.Second, cfg.db.queryTimeout)
+		}
+	})
+
+	t.Run("Precedence", func(t *testing.T) {
+		vars := map[string]string{
+			"ASSECOR_PORT":        "7000",
+			"ASSECOR_LIMITER_RPS": "3",
+		}
+		cfg, _, err := loadConfig([]string{"-config", yamlFile, "-port", "8000"}, env(vars))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// flags override the environment ...
+		if cfg.port != 8000 {
+			t.Errorf("want port %d; got %d", 8000, cfg.port)
+		}
+		// ... which overrides the file ...
+		if cfg.limiter.rps != 3 {
+			t.Errorf("want limiter rps %v; got %v", 3, cfg.limiter.rps)
+		}
+		// ... which overrides the defaults.
+		if cfg.limiter.burst != 20 {
+			t.Errorf("want limiter burst %d; got %d", 20, cfg.limiter.burst)
+		}
+	})
+
+	t.Run("Unknown setting", func(t *testing.T) {
+		_, _, err := loadConfig([]string{"-config", badFile}, env(nil))
+		if err == nil || !strings.Contains(err.Error(), "limiter-foo") {
+			t.Errorf("want unknown setting error; got %v", err)
+		}
+	})
+
+	t.Run("Postal check without directory", func(t *testing.T) {
+		_, _, err := loadConfig([]string{"-postal-check", "reject"}, env(nil))
+		if err == nil || !strings.Contains(err.Error(), "postal-directory") {
+			t.Errorf("want postal-directory error; got %v", err)
+		}
+	})
+
+	t.Run("Invalid environment value", func(t *testing.T) {
+		_, _, err := loadConfig(nil, env(map[string]string{"ASSECOR_PORT": "foo"}))
+		if err == nil || !strings.Contains(err.Error(), "ASSECOR_PORT") {
+			t.Errorf("want ASSECOR_PORT error; got %v", err)
+		}
+	})
+}
+
+func TestPrintConfig(t *testing.T) {
+	_, fs, err := loadConfig([]string{"-auth-admin-key", "secret", "-jwt-issuer", "gateway"}, func(string) (string, bool) {
+		return "", false
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	printConfig(&buf, fs)
+	out := buf.String()
+
+	if strings.Contains(out, "secret") {
+		t.Errorf("want admin key redacted; got\n%s", out)
+	}
+	for _, want := range []string{`auth-admin-key: "[redacted]"`, `jwt-issuer: "gateway"`, `port: "4000"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("want %s in\n%s", want, out)
+		}
+	}
+}
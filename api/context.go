@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"assecor.assessment.test/internal/data"
+)
+
+type contextKey string
+
+const (
+	userContextKey   = contextKey("user")
+	scopesContextKey = contextKey("scopes")
+)
+
+// contextSetUser returns a copy of the request with the authenticated user
+// and the scopes granted to it added to its context. For bearer tokens the
+// user only carries the token subject as name.
+func (app *application) contextSetUser(r *http.Request, user *data.User, scopes []string) *http.Request {
+	ctx := context.WithValue(r.Context(), userContextKey, user)
+	ctx = context.WithValue(ctx, scopesContextKey, scopes)
+	return r.WithContext(ctx)
+}
+
+// contextGetUser retrieves the user set by the authenticate middleware. It is
+// only called where we logically expect a user to be present, so a missing
+// value is an unexpected error and we panic.
+func (app *application) contextGetUser(r *http.Request) *data.User {
+	user, ok := r.Context().Value(userContextKey).(*data.User)
+	if !ok {
+		panic("missing user value in request context")
+	}
+	return user
+}
+
+// contextGetActor returns the name under which the changes made by the
+// request are recorded in the audit log.
+func (app *application) contextGetActor(r *http.Request) string {
+	if key := userKey(app.contextGetUser(r)); key != "" {
+		return key
+	}
+	return "anonymous"
+}
+
+// contextHasScope reports whether the authenticated user was granted the
+// scope.
+func (app *application) contextHasScope(r *http.Request, scope string) bool {
+	scopes, _ := r.Context().Value(scopesContextKey).([]string)
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -2,22 +2,108 @@ package main
 
 import (
 	"fmt"
+	"mime"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"assecor.assessment.test/internal/validator"
 )
 
-func (app *application) logError(_ *http.Request, err error) {
-	app.logger.Println(err)
+func (app *application) logError(r *http.Request, err error) {
+	app.logger.Error(err.Error(), "method", r.Method, "uri", r.URL.RequestURI())
+}
+
+// problemDetails is an RFC 9457 problem document.
+type problemDetails struct {
+	Type     string         `json:"type"`
+	Title    string         `json:"title"`
+	Status   int            `json:"status"`
+	Detail   string         `json:"detail,omitempty"`
+	Instance string         `json:"instance,omitempty"`
+	Errors   []problemError `json:"errors,omitempty"`
 }
 
+// problemError describes a single failed check of a request field.
+type problemError struct {
+	Field   string                 `json:"field"`
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Params  map[string]interface{} `json:"params,omitempty"`
+}
+
+// errorResponse sends the message as problem document if the client asked for
+// application/problem+json and in the legacy {"error": message} shape
+// otherwise. The message is either a string or the field errors of a failed
+// validation; the legacy shape only contains the first message per field.
 func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
-	v := map[string]interface{}{"error": message}
-	err := app.writeJSON(w, status, v, nil)
+	var err error
+	if acceptsProblemJSON(r) {
+		err = app.writeJSON(w, status, newProblemDetails(r, status, message),
+			http.Header{"Content-Type": {"application/problem+json"}})
+	} else {
+		if fields, ok := message.(map[string][]validator.Error); ok {
+			message = (&validator.Validator{Errors: fields}).Messages()
+		}
+		v := map[string]interface{}{"error": message}
+		err = app.writeJSON(w, status, v, nil)
+	}
 	if err != nil {
 		app.logError(r, err)
 		w.WriteHeader(500)
 	}
 }
 
+func newProblemDetails(r *http.Request, status int, message interface{}) problemDetails {
+	p := problemDetails{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Instance: r.URL.Path,
+	}
+	switch m := message.(type) {
+	case string:
+		p.Detail = m
+	case map[string][]validator.Error:
+		p.Detail = "the request contains invalid fields"
+		for field, errs := range m {
+			for _, e := range errs {
+				p.Errors = append(p.Errors, problemError{
+					Field:   field,
+					Code:    e.Code,
+					Message: e.Message,
+					Params:  e.Params,
+				})
+			}
+		}
+		sort.SliceStable(p.Errors, func(i, j int) bool {
+			return p.Errors[i].Field < p.Errors[j].Field
+		})
+	default:
+		p.Detail = fmt.Sprint(m)
+	}
+	return p
+}
+
+// acceptsProblemJSON reports whether the Accept header lists
+// application/problem+json.
+func acceptsProblemJSON(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+			if err != nil || mediaType != "application/problem+json" {
+				continue
+			}
+			if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+				continue
+			}
+			return true
+		}
+	}
+	return false
+}
+
 // 500 Method Internal Server Error
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
 	app.logError(r, err)
@@ -43,6 +129,51 @@ func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Reques
 }
 
 // 422 Method Unprocessable
-func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
+func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string][]validator.Error) {
 	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
 }
+
+// 401 Unauthorized, the API key is unknown
+func (app *application) invalidAPIKeyResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "ApiKey")
+	message := "invalid or unknown API key"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+// 401 Unauthorized, no credentials were sent
+func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "ApiKey")
+	w.Header().Add("WWW-Authenticate", "Bearer")
+	message := "you must be authenticated to access this resource"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+// 401 Unauthorized, the bearer token is missing, malformed or invalid
+func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	message := "invalid or missing authentication token"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+// 403 Forbidden
+func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your credentials don't have the necessary permissions to access this resource"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// 429 Too Many Requests
+func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
+	message := "rate limit exceeded"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+// 422 Unprocessable Entity, the Idempotency-Key belongs to another request
+func (app *application) idempotencyKeyReusedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the Idempotency-Key was already used for a different request"
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, message)
+}
+
+// 409 Conflict, the request with the Idempotency-Key can't be replayed
+func (app *application) idempotencyConflictResponse(w http.ResponseWriter, r *http.Request, message string) {
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
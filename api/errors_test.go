@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestProblemDetails(t *testing.T) {
+	app := newTestApp(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	invalidPerson := writeJSON(t, map[string]interface{}{
+		"name":     "",
+		"lastname": "Petersen",
+		"zipcode":  "xxx",
+		"city":     "Stralsund",
+		"color":    int(1),
+	})
+
+	tests := []struct {
+		name        string
+		method      string
+		urlPath     string
+		accept      string
+		body        []byte
+		wantCode    int
+		wantType    string
+		wantFields  []string
+		wantProblem bool
+	}{
+		{"Legacy not found", http.MethodGet, "/persons/99", "", nil, http.StatusNotFound, "application/json", nil, false},
+		{"Problem not found", http.MethodGet, "/persons/99", "application/problem+json", nil,
+			http.StatusNotFound, "application/problem+json", nil, true},
+		{"Problem among other types", http.MethodGet, "/persons/99", "application/json, application/problem+json;q=0.9", nil,
+			http.StatusNotFound, "application/problem+json", nil, true},
+		{"Problem refused", http.MethodGet, "/persons/99", "application/problem+json;q=0", nil,
+			http.StatusNotFound, "application/json", nil, false},
+		{"Problem validation", http.MethodPost, "/persons", "application/problem+json", invalidPerson,
+			http.StatusUnprocessableEntity, "application/problem+json", []string{"name", "zipcode"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{}
+			if tt.accept != "" {
+				headers.Set("Accept", tt.accept)
+			}
+			code, header, body := ts.do(t, tt.method, tt.urlPath, headers, tt.body)
+
+			if code != tt.wantCode {
+				t.Fatalf("want %d; got %d", tt.wantCode, code)
+			}
+			if ct := header.Get("Content-Type"); ct != tt.wantType {
+				t.Errorf("want Content-Type %s; got %s", tt.wantType, ct)
+			}
+			if !tt.wantProblem {
+				var input struct {
+					Error interface{} `json:"error"`
+				}
+				readJSON(t, body, &input)
+				if input.Error == nil {
+					t.Error("want error")
+				}
+				return
+			}
+
+			var input problemDetails
+			readJSON(t, body, &input)
+			if input.Type != "about:blank" {
+				t.Errorf("want Type %s; got %s", "about:blank", input.Type)
+			}
+			if input.Status != tt.wantCode {
+				t.Errorf("want Status %d; got %d", tt.wantCode, input.Status)
+			}
+			if input.Title != http.StatusText(tt.wantCode) {
+				t.Errorf("want Title %s; got %s", http.StatusText(tt.wantCode), input.Title)
+			}
+			if input.Instance != tt.urlPath {
+				t.Errorf("want Instance %s; got %s", tt.urlPath, input.Instance)
+			}
+			if len(input.Errors) != len(tt.wantFields) {
+				t.Fatalf("want %d errors; got %v", len(tt.wantFields), input.Errors)
+			}
+			for i, field := range tt.wantFields {
+				if input.Errors[i].Field != field {
+					t.Errorf("Errors[%d] want Field %s; got %s", i, field, input.Errors[i].Field)
+				}
+				if input.Errors[i].Code == "" || input.Errors[i].Message == "" {
+					t.Errorf("Errors[%d] want Code and Message; got %+v", i, input.Errors[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"assecor.assessment.test/internal/data"
+	"assecor.assessment.test/internal/events"
+)
+
+// eventStreamReset tells a resuming client that it missed events which are
+// no longer buffered, it should reload the persons.
+const eventStreamReset = "stream.reset"
+
+// sseKeepAlive is the interval of the comments which keep an idle event
+// stream open through proxies.
+const sseKeepAlive = 30 * time.Second
+
+// "GET /persons/events" endpoint, streams the changes of persons as
+// Server-Sent Events. A client resuming with Last-Event-ID first gets the
+// events it missed. The stream ends when the client falls too far behind; it
+// reconnects then, like after any other interruption.
+func (app *application) personEventsHandler(w http.ResponseWriter, r *http.Request) {
+	lastID := app.models.Events.LastID()
+	if h := r.Header.Get("Last-Event-ID"); h != "" {
+		var err error
+		lastID, err = strconv.ParseUint(h, 10, 64)
+		if err != nil {
+			app.badRequestResponse(w, r, errors.New("Last-Event-ID must be the id of an event"))
+			return
+		}
+	}
+
+	replay, ch, complete := app.models.Events.Subscribe(lastID)
+	defer app.models.Events.Unsubscribe(ch)
+
+	rc := http.NewResponseController(w)
+	// The write timeout of the server would end the stream.
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	if !complete {
+		// The id makes the client resume after the reset.
+		reset := events.Event{Type: eventStreamReset}
+		if len(replay) > 0 {
+			reset.ID = replay[0].ID - 1
+		}
+		if err := app.writeEvent(w, reset); err != nil {
+			return
+		}
+	}
+	for _, e := range replay {
+		if err := app.writeEvent(w, e); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := app.writeEvent(w, e); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-app.shutdown:
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// writeEvent writes the event in the text/event-stream format.
+func (app *application) writeEvent(w io.Writer, e events.Event) error {
+	js, err := json.Marshal(app.eventData(e))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, js)
+	return err
+}
+
+// eventData returns the data of the event. Changes of persons are sent as
+// the person after the change, formatted like in the other responses.
+func (app *application) eventData(e events.Event) interface{} {
+	if c, ok := e.Data.(data.PersonChange); ok {
+		return app.formatPerson(c.After)
+	}
+	return e.Data
+}
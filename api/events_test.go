@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"assecor.assessment.test/internal/data"
+)
+
+type sseEvent struct {
+	id, typ, data string
+}
+
+// openEventStream requests the event stream and returns a reader of its
+// events; the stream is closed at the end of the test.
+func openEventStream(t *testing.T, ts *testServer, lastEventID string) (int, *bufio.Reader) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/persons/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	rs, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rs.Body.Close() })
+	if rs.StatusCode == http.StatusOK && rs.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("want text/event-stream; got %q", rs.Header.Get("Content-Type"))
+	}
+	return rs.StatusCode, bufio.NewReader(rs.Body)
+}
+
+func readEvent(t *testing.T, br *bufio.Reader) sseEvent {
+	var e sseEvent
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if e.typ != "" {
+				return e
+			}
+		case strings.HasPrefix(line, "id: "):
+			e.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			e.typ = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			e.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestPersonEvents(t *testing.T) {
+	app := newTestApp(t)
+	// Published before anybody listens, only resuming clients get it.
+	if err := app.models.Persons.Insert(&data.Person{
+		Name: "Peter", Lastname: "Petersen", Zipcode: "18439", City: "Stralsund", Country: "DE", Color: 2,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	t.Run("Live", func(t *testing.T) {
+		code, br := openEventStream(t, ts, "")
+		if code != http.StatusOK {
+			t.Fatalf("want %d; got %d", http.StatusOK, code)
+		}
+		// The subscription exists once the response has started.
+		if code, _, _ := ts.post(t, "/persons", writeJSON(t, map[string]interface{}{
+			"name":     "Hans",
+			"lastname": "Müller",
+			"zipcode":  "67742",
+			"city":     "Lauterecken",
+			"color":    1,
+		})); code != http.StatusCreated {
+			t.Fatalf("want %d; got %d", http.StatusCreated, code)
+		}
+		if code, _, _ := ts.do(t, http.MethodDelete, "/persons/2", nil, nil); code != http.StatusOK {
+			t.Fatalf("want %d; got %d", http.StatusOK, code)
+		}
+
+		e := readEvent(t, br)
+		if e.id != "2" || e.typ != data.EventPersonCreated {
+			t.Fatalf("want event 2 %s; got %+v", data.EventPersonCreated, e)
+		}
+		var person formattedPerson
+		if err := json.Unmarshal([]byte(e.data), &person); err != nil {
+			t.Fatal(err)
+		}
+		if person.ID != 2 || person.Lastname != "Müller" || person.Color != "blau" {
+			t.Errorf("want formatted person 2; got %+v", person)
+		}
+		if e := readEvent(t, br); e.id != "3" || e.typ != data.EventPersonDeleted {
+			t.Errorf("want event 3 %s; got %+v", data.EventPersonDeleted, e)
+		}
+	})
+
+	tests := []struct {
+		name        string
+		lastEventID string
+		wantCode    int
+		want        []string // id and type of the first events
+	}{
+		{"Resume", "1", http.StatusOK, []string{"2 " + data.EventPersonCreated, "3 " + data.EventPersonDeleted}},
+		{"Resume after last", "3", http.StatusOK, nil},
+		{"Unknown id", "99", http.StatusOK, []string{"0 " + eventStreamReset, "1 " + data.EventPersonCreated}},
+		{"Invalid id", "x", http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, br := openEventStream(t, ts, tt.lastEventID)
+			if code != tt.wantCode {
+				t.Fatalf("want %d; got %d", tt.wantCode, code)
+			}
+			for _, want := range tt.want {
+				e := readEvent(t, br)
+				if got := e.id + " " + e.typ; got != want {
+					t.Errorf("want %s; got %s", want, got)
+				}
+			}
+		})
+	}
+
+	t.Run("Import completed", func(t *testing.T) {
+		code, br := openEventStream(t, ts, "3")
+		if code != http.StatusOK {
+			t.Fatalf("want %d; got %d", http.StatusOK, code)
+		}
+		app.config.dsn = "../sample-input.csv"
+		app.config.csv.comma = ","
+		app.importCsv()
+
+		created := 0
+		for {
+			e := readEvent(t, br)
+			if e.typ == data.EventPersonCreated {
+				created++
+				continue
+			}
+			if e.typ != data.EventImportCompleted {
+				t.Fatalf("want %s; got %+v", data.EventImportCompleted, e)
+			}
+			if created != 9 || !strings.Contains(e.data, `"errors":2`) {
+				t.Errorf("want 9 persons created and 2 errors; got %d created, %s", created, e.data)
+			}
+			break
+		}
+	})
+}
@@ -2,21 +2,75 @@ package main
 
 import (
 	"errors"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"assecor.assessment.test/internal/data"
 	"assecor.assessment.test/internal/validator"
+	"github.com/julienschmidt/httprouter"
 )
 
-// "GET /healthcheck" endpoint
-func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
-	data := map[string]string{
-		"status":  "available",
-		"version": version,
+// "GET /healthz/live" endpoint, also served as "GET /healthcheck"
+func (app *application) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	env := map[string]interface{}{
+		"status":      "available",
+		"system_info": app.systemInfo(),
 	}
 
-	err := app.writeJSON(w, http.StatusOK, data, nil)
+	err := app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// "GET /healthz/ready" endpoint
+func (app *application) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	checks := map[string]string{
+		"database":      "ok",
+		"persons_table": "ok",
+		"csv_import":    "ok",
+		"postal_codes":  "ok",
+	}
+
+	if err := app.models.Health.Ping(); err != nil {
+		app.logError(r, err)
+		checks["database"] = "unavailable"
+		checks["persons_table"] = "unknown"
+		status = http.StatusServiceUnavailable
+	} else {
+		ok, err := app.models.Health.TableExists("persons")
+		if err != nil {
+			app.logError(r, err)
+		}
+		if !ok {
+			checks["persons_table"] = "missing"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	if !app.imported.Load() {
+		checks["csv_import"] = "pending"
+		status = http.StatusServiceUnavailable
+	}
+	if app.postalCodesFailed.Load() {
+		checks["postal_codes"] = "failed"
+		status = http.StatusServiceUnavailable
+	}
+
+	env := map[string]interface{}{
+		"status":      "ready",
+		"checks":      checks,
+		"system_info": app.systemInfo(),
+	}
+	if status != http.StatusOK {
+		env["status"] = "unavailable"
+	}
+
+	err := app.writeJSON(w, status, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -25,47 +79,147 @@ func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Reques
 
 // "POST /persons" endpoint
 func (app *application) createPersonHandler(w http.ResponseWriter, r *http.Request) {
+	var person data.Person
+	warnings, ok := app.readPersonInput(w, r, &person)
+	if !ok {
+		return
+	}
+
+	err := app.models.Persons.WithActor(app.contextGetActor(r)).Insert(&person)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusCreated, personResponse{person, warnings}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// "PUT /persons/external/:source/:id" endpoint, creates or replaces the
+// person with the external reference of a partner system
+func (app *application) upsertExternalPersonHandler(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	person := data.Person{
+		Source:     params.ByName("source"),
+		ExternalID: params.ByName("id"),
+	}
+	warnings, ok := app.readPersonInput(w, r, &person)
+	if !ok {
+		return
+	}
+
+	created, err := app.models.Persons.WithActor(app.contextGetActor(r)).Upsert(&person)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	err = app.writeJSON(w, status, personResponse{person, warnings}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// personResponse is a stored person with the warnings of the city check.
+type personResponse struct {
+	data.Person
+	Warnings map[string][]validator.Error `json:"warnings,omitempty"`
+}
+
+// readPersonInput decodes the fields of a person from the request body into
+// person, defaults the country and validates it, including the city check.
+// If the input is rejected the error response is sent and ok is false.
+func (app *application) readPersonInput(w http.ResponseWriter, r *http.Request,
+	person *data.Person) (warnings map[string][]validator.Error, ok bool) {
 	var input struct {
 		Name     string `json:"name"`
 		Lastname string `json:"lastname"`
 		Zipcode  string `json:"zipcode"`
 		City     string `json:"city"`
+		Country  string `json:"country"`
 		Color    int    `json:"color"`
 	}
 	err := app.readJSON(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
-		return
+		return nil, false
 	}
 	v := validator.New()
 
-	person := data.Person{
-		Name:     input.Name,
-		Lastname: input.Lastname,
-		Zipcode:  input.Zipcode,
-		City:     input.City,
-		Color:    input.Color,
+	person.Name = input.Name
+	person.Lastname = input.Lastname
+	person.Zipcode = input.Zipcode
+	person.City = input.City
+	person.Country = input.Country
+	person.Color = input.Color
+	if person.Country == "" {
+		person.Country = data.DefaultCountry
 	}
 
-	if data.ValidatePerson(v, &person); !v.Valid() {
+	if data.ValidatePerson(v, person); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
-		return
+		return nil, false
 	}
+	return app.checkCity(w, r, v, person)
+}
 
-	err = app.models.Persons.Insert(&person)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
+// checkCity runs the configured city check on a valid person. A rejected
+// person gets the validation error response and ok is false; in flag mode a
+// city which doesn't match the zipcode is accepted and returned as warning.
+func (app *application) checkCity(w http.ResponseWriter, r *http.Request, v *validator.Validator,
+	person *data.Person) (warnings map[string][]validator.Error, ok bool) {
+	check := app.config.postal.check
+	if check != data.PostalCheckFlag && check != data.PostalCheckReject {
+		return nil, true
 	}
-	err = app.writeJSON(w, http.StatusCreated, person, nil)
+	err := app.models.CheckCity(v, person)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+	if v.Valid() {
+		return nil, true
 	}
+	if check == data.PostalCheckReject {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	}
+	return v.Errors, true
 }
 
-// "GET /persons" endpoint
+// "GET /persons?include_deleted=&updated_since=" endpoint, only admins may
+// list the deleted persons; updated_since is an RFC 3339 time for
+// incremental syncs, the persons deleted since then are returned to everyone
+// with deleted_at set so the sync can remove them
 func (app *application) listPersonsHandler(w http.ResponseWriter, r *http.Request) {
-	persons, err := app.models.Persons.GetAll()
+	qs := r.URL.Query()
+	v := validator.New()
+	includeDeleted := false
+	if qs.Has("include_deleted") {
+		var err error
+		includeDeleted, err = strconv.ParseBool(qs.Get("include_deleted"))
+		v.Check(err == nil, "include_deleted", "must be true or false")
+	}
+	var since time.Time
+	if qs.Has("updated_since") {
+		var err error
+		since, err = time.Parse(time.RFC3339, qs.Get("updated_since"))
+		v.Check(err == nil, "updated_since", "must be an RFC 3339 time")
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	if includeDeleted && app.config.auth.enabled && !app.contextHasScope(r, data.ScopePersonsAdmin) {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	persons, err := app.models.Persons.GetAllUpdatedSince(since, includeDeleted || !since.IsZero())
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -78,22 +232,35 @@ func (app *application) listPersonsHandler(w http.ResponseWriter, r *http.Reques
 
 // "GET /persons/*path" endpoint
 func (app *application) pathHandler(w http.ResponseWriter, r *http.Request) {
-	parts := strings.Split(r.URL.String(), "/")
+	parts := strings.Split(r.URL.Path, "/")
 	count := len(parts)
-	if count == 3 {
+	if count == 3 && parts[2] == "nearby" {
+		app.listPersonsNearbyHandler(w, r)
+	} else if count == 3 && parts[2] == "duplicates" {
+		app.listDuplicatesHandler(w, r)
+	} else if count == 3 && parts[2] == "events" {
+		app.personEventsHandler(w, r)
+	} else if count == 3 {
 		app.showPersonHandler(w, r, parts[2])
 	} else if count == 4 && parts[2] == "color" {
 		app.listPersonsByFavoriteColorHandler(w, r, parts[3])
+	} else if count == 4 && parts[3] == "history" {
+		app.requireScope(data.ScopePersonsAdmin, func(w http.ResponseWriter, r *http.Request) {
+			app.showPersonHistoryHandler(w, r, parts[2])
+		})(w, r)
 	} else {
 		app.notFoundResponse(w, r)
 	}
 }
 
-// "GET /persons/:id" endpoint
+// "GET /persons/:id" endpoint, answers 304 Not Modified if the person hasn't
+// changed since If-Modified-Since
 func (app *application) showPersonHandler(w http.ResponseWriter, r *http.Request, param string) {
 	id, err := app.readIDParam(param)
 	if err != nil {
-		app.failedValidationResponse(w, r, map[string]string{"personID": err.Error()})
+		v := validator.New()
+		v.AddError("personID", err.Error())
+		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 	person, err := app.models.Persons.Get(id)
@@ -106,7 +273,15 @@ func (app *application) showPersonHandler(w http.ResponseWriter, r *http.Request
 		}
 		return
 	}
-	err = app.writeJSON(w, http.StatusOK, app.formatPerson(person), nil)
+	// HTTP dates have a resolution of seconds.
+	modified := person.UpdatedAt.Truncate(time.Second)
+	headers := http.Header{"Last-Modified": {modified.UTC().Format(http.TimeFormat)}}
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.After(since) {
+		w.Header()["Last-Modified"] = headers["Last-Modified"]
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, app.formatPerson(person), headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -114,13 +289,16 @@ func (app *application) showPersonHandler(w http.ResponseWriter, r *http.Request
 
 // "GET /persons/color/:id" endpoint
 func (app *application) listPersonsByFavoriteColorHandler(w http.ResponseWriter, r *http.Request, param string) {
+	v := validator.New()
 	id, err := app.readIDParam(param)
 	if err != nil {
-		app.failedValidationResponse(w, r, map[string]string{"colorID": err.Error()})
+		v.AddError("colorID", err.Error())
+		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
-	if id >= int64(data.LastColorIndex) {
-		app.failedValidationResponse(w, r, map[string]string{"colorID": "out of range"})
+	if v.CheckError(id < int64(data.LastColorIndex), "colorID",
+		validator.OutOfRange(1, int(data.LastColorIndex)-1)); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 	persons, err := app.models.Persons.GetAllByColor(data.Color(id))
@@ -138,3 +316,342 @@ func (app *application) listPersonsByFavoriteColorHandler(w http.ResponseWriter,
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// "GET /persons/nearby?zipcode=&radius_km=&country=" endpoint
+func (app *application) listPersonsNearbyHandler(w http.ResponseWriter, r *http.Request) {
+	const maxRadiusKm = 1000
+
+	qs := r.URL.Query()
+	zipcode := strings.TrimSpace(qs.Get("zipcode"))
+	country := strings.ToUpper(strings.TrimSpace(qs.Get("country")))
+	if country == "" {
+		country = data.DefaultCountry
+	}
+
+	v := validator.New()
+	v.CheckError(zipcode != "", "zipcode", validator.Required())
+	radiusKm, err := strconv.ParseFloat(qs.Get("radius_km"), 64)
+	v.CheckError(err == nil && radiusKm > 0 && radiusKm <= maxRadiusKm,
+		"radius_km", validator.OutOfRange(0, maxRadiusKm))
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	persons, err := app.models.Persons.GetAllNearby(country, zipcode, radiusKm)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.Add("zipcode", validator.Error{
+				Code:    data.CodeUnknownZipcode,
+				Message: "no coordinates known for zip code",
+			})
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	type nearbyPerson struct {
+		formattedPerson
+		DistanceKm float64 `json:"distance_km"`
+	}
+	formatted := make([]nearbyPerson, len(persons))
+	for i, p := range persons {
+		formatted[i] = nearbyPerson{
+			formattedPerson: app.formatPerson(&p.Person),
+			DistanceKm:      math.Round(p.DistanceKm*100) / 100,
+		}
+	}
+	err = app.writeJSON(w, http.StatusOK, formatted, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// "GET /persons/duplicates" endpoint
+func (app *application) listDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	persons, err := app.models.Persons.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	type cluster struct {
+		Persons []formattedPerson `json:"persons"`
+	}
+	clusters := []cluster{}
+	for _, duplicates := range data.FindDuplicates(persons) {
+		c := cluster{Persons: make([]formattedPerson, len(duplicates))}
+		for i, p := range duplicates {
+			c.Persons[i] = app.formatPerson(p)
+		}
+		clusters = append(clusters, c)
+	}
+	err = app.writeJSON(w, http.StatusOK, clusters, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// "POST /persons/:id/merge" endpoint, merges the source person into the
+// person of the URL and deletes the source. The listed fields are taken from
+// the source, the others are kept.
+func (app *application) mergePersonHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	id, err := app.readIDParam(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+	if err != nil {
+		v.AddError("personID", err.Error())
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	var input struct {
+		SourceID int64    `json:"source_id"`
+		Fields   []string `json:"fields"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v.Check(input.SourceID >= 1, "source_id", "invalid id parameter")
+	v.Check(input.SourceID != id, "source_id", "must not be the merged person")
+	// Every entry must be a merge field, several unknown ones are reported
+	// once.
+	for _, f := range input.Fields {
+		if !validator.PermittedValue(f, data.MergeFields...) {
+			v.Add("fields", validator.OneOf(data.MergeFields...))
+			break
+		}
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	target, err := app.models.Persons.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	source, err := app.models.Persons.Get(input.SourceID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("source_id", "person does not exist")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	merged := *target
+	data.MergePerson(&merged, source, input.Fields)
+	if data.ValidatePerson(v, &merged); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Persons.WithActor(app.contextGetActor(r)).Merge(&merged, source.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, app.formatPerson(&merged), nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// "DELETE /persons/:id" endpoint, the person can be restored until it is
+// purged
+func (app *application) deletePersonHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+	if err != nil {
+		v := validator.New()
+		v.AddError("personID", err.Error())
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Persons.WithActor(app.contextGetActor(r)).Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, map[string]string{"message": "person successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// "POST /persons/:id/restore" endpoint, undoes the deletion of a person
+func (app *application) restorePersonHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+	if err != nil {
+		v := validator.New()
+		v.AddError("personID", err.Error())
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Persons.WithActor(app.contextGetActor(r)).Restore(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	person, err := app.models.Persons.Get(id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, app.formatPerson(person), nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// "GET /persons/:id/history" endpoint, also for deleted and purged persons;
+// it requires the admin scope like "GET /audit"
+func (app *application) showPersonHistoryHandler(w http.ResponseWriter, r *http.Request, param string) {
+	id, err := app.readIDParam(param)
+	if err != nil {
+		v := validator.New()
+		v.AddError("personID", err.Error())
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	events, err := app.models.Audit.GetAllForPerson(id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if len(events) == 0 {
+		app.notFoundResponse(w, r)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, events, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// "GET /audit?since=" endpoint, since is an RFC 3339 time
+func (app *application) listAuditHandler(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if qs := r.URL.Query(); qs.Has("since") {
+		var err error
+		since, err = time.Parse(time.RFC3339, qs.Get("since"))
+		if err != nil {
+			v := validator.New()
+			v.AddError("since", "must be an RFC 3339 time")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+	events, err := app.models.Audit.GetAllSince(since)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, events, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// "GET /stats?color=&city=&country=&zipcode=&lastname=" endpoint, zipcode
+// is a prefix
+func (app *application) statsHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	filter := data.StatsFilter{
+		City:          strings.TrimSpace(qs.Get("city")),
+		Country:       strings.ToUpper(strings.TrimSpace(qs.Get("country"))),
+		ZipcodePrefix: strings.TrimSpace(qs.Get("zipcode")),
+		Lastname:      strings.TrimSpace(qs.Get("lastname")),
+	}
+
+	v := validator.New()
+	if qs.Has("color") {
+		color, err := strconv.Atoi(qs.Get("color"))
+		v.CheckError(err == nil && color >= 1 && color < int(data.LastColorIndex),
+			"color", validator.OutOfRange(1, int(data.LastColorIndex)-1))
+		filter.Color = data.Color(color)
+	}
+	v.CheckError(filter.Country == "" || validator.Matches(filter.Country, validator.CountryRX),
+		"country", validator.Pattern("must be an ISO 3166-1 alpha-2 country code", validator.CountryRX))
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	stats, err := app.models.Stats.Get(filter)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, stats, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// "POST /api-keys" endpoint
+func (app *application) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name string    `json:"name"`
+		Role data.Role `json:"role"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+
+	user := data.User{
+		Name: input.Name,
+		Role: input.Role,
+	}
+
+	if data.ValidateUser(v, &user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	apiKey, err := data.GenerateAPIKey()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.Users.Insert(&user, apiKey)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// The plaintext key is only returned once, we store just its hash.
+	resp := map[string]interface{}{"user": user, "api_key": apiKey}
+	headers := http.Header{"Cache-Control": {"no-store"}}
+	err = app.writeJSON(w, http.StatusCreated, resp, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -1,34 +1,101 @@
 package main
 
 import (
+	"errors"
 	"net/http"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"assecor.assessment.test/internal/data"
+	"assecor.assessment.test/internal/mock"
 )
 
-func TestPing(t *testing.T) {
+func TestLiveness(t *testing.T) {
 	app := newTestApp(t)
 	ts := newTestServer(t, app.routes())
 	defer ts.Close()
 
-	code, _, body := ts.get(t, "/healthcheck")
+	// /healthcheck is the path of the liveness probe before it was split.
+	for _, path := range []string{"/healthz/live", "/healthcheck"} {
+		t.Run(path, func(t *testing.T) {
+			code, _, body := ts.get(t, path)
 
-	if code != http.StatusOK {
-		t.Errorf("want %d; got %d", http.StatusOK, code)
-	}
+			if code != http.StatusOK {
+				t.Errorf("want %d; got %d", http.StatusOK, code)
+			}
 
-	var input struct {
-		Status  string `json:"status"`
-		Version string `json:"version"`
+			var input struct {
+				Status     string            `json:"status"`
+				SystemInfo map[string]string `json:"system_info"`
+			}
+			readJSON(t, body, &input)
+			if input.Status != "available" {
+				t.Errorf("want Status %s; got %s", "available", input.Status)
+			}
+			if input.SystemInfo["version"] != "1.0.0" {
+				t.Errorf("want Version %s; got %s", "1.0.0", input.SystemInfo["version"])
+			}
+			for _, key := range []string{"go_version", "commit", "uptime", "environment"} {
+				if _, ok := input.SystemInfo[key]; !ok {
+					t.Errorf("want system_info key %q", key)
+				}
+			}
+		})
 	}
-	readJSON(t, body, &input)
-	if input.Status != "available" {
-		t.Errorf("want Status %s; got %s", "available", input.Status)
+}
+
+func TestReadiness(t *testing.T) {
+	tests := []struct {
+		name       string
+		pingErr    error
+		missing    []string
+		imported   bool
+		postalErr  bool
+		wantCode   int
+		wantChecks map[string]string
+	}{
+		{"Ready", nil, nil, true, false, http.StatusOK,
+			map[string]string{"database": "ok", "persons_table": "ok", "csv_import": "ok", "postal_codes": "ok"}},
+		{"Import pending", nil, nil, false, false, http.StatusServiceUnavailable,
+			map[string]string{"database": "ok", "persons_table": "ok", "csv_import": "pending"}},
+		{"Database down", errors.New("connection lost"), nil, true, false, http.StatusServiceUnavailable,
+			map[string]string{"database": "unavailable", "persons_table": "unknown", "csv_import": "ok"}},
+		{"Table missing", nil, []string{"persons"}, true, false, http.StatusServiceUnavailable,
+			map[string]string{"database": "ok", "persons_table": "missing", "csv_import": "ok"}},
+		{"Postal codes failed", nil, nil, true, true, http.StatusServiceUnavailable,
+			map[string]string{"database": "ok", "csv_import": "ok", "postal_codes": "failed"}},
 	}
-	if input.Version != "1.0.0" {
-		t.Errorf("want Version %s; got %s", "1.0.0", input.Version)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			health := app.models.Health.(*mock.MockHealthModel)
+			health.PingErr = tt.pingErr
+			health.MissingTables = tt.missing
+			app.imported.Store(tt.imported)
+			app.postalCodesFailed.Store(tt.postalErr)
+
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			code, _, body := ts.get(t, "/healthz/ready")
+			if code != tt.wantCode {
+				t.Fatalf("want %d; got %d", tt.wantCode, code)
+			}
+			var input struct {
+				Status     string            `json:"status"`
+				Checks     map[string]string `json:"checks"`
+				SystemInfo map[string]string `json:"system_info"`
+			}
+			readJSON(t, body, &input)
+			for k, want := range tt.wantChecks {
+				if input.Checks[k] != want {
+					t.Errorf("want check %s %s; got %s", k, want, input.Checks[k])
+				}
+			}
+		})
 	}
 }
 
@@ -76,12 +143,15 @@ func TestShowPerson(t *testing.T) {
 			}
 			if tt.wantBody != nil {
 				var input struct {
-					ID       int64  `json:"id"`
-					Name     string `json:"name"`
-					Lastname string `json:"lastname"`
-					Zipcode  string `json:"zipcode"`
-					City     string `json:"city"`
-					Color    string `json:"color"`
+					ID        int64     `json:"id"`
+					Name      string    `json:"name"`
+					Lastname  string    `json:"lastname"`
+					Zipcode   string    `json:"zipcode"`
+					City      string    `json:"city"`
+					Country   string    `json:"country"`
+					Color     string    `json:"color"`
+					CreatedAt time.Time `json:"created_at"`
+					UpdatedAt time.Time `json:"updated_at"`
 				}
 				readJSON(t, body, &input)
 
@@ -182,12 +252,15 @@ func TestShowPersons(t *testing.T) {
 			}
 			if tt.wantBody != nil {
 				type person struct {
-					ID       int64  `json:"id"`
-					Name     string `json:"name"`
-					Lastname string `json:"lastname"`
-					Zipcode  string `json:"zipcode"`
-					City     string `json:"city"`
-					Color    string `json:"color"`
+					ID        int64     `json:"id"`
+					Name      string    `json:"name"`
+					Lastname  string    `json:"lastname"`
+					Zipcode   string    `json:"zipcode"`
+					City      string    `json:"city"`
+					Country   string    `json:"country"`
+					Color     string    `json:"color"`
+					CreatedAt time.Time `json:"created_at"`
+					UpdatedAt time.Time `json:"updated_at"`
 				}
 				var input []person
 				readJSON(t, body, &input)
@@ -303,12 +376,15 @@ func TestFilterByPersonsFavoriteColor(t *testing.T) {
 			}
 			if tt.wantBody != nil {
 				type person struct {
-					ID       int64  `json:"id"`
-					Name     string `json:"name"`
-					Lastname string `json:"lastname"`
-					Zipcode  string `json:"zipcode"`
-					City     string `json:"city"`
-					Color    string `json:"color"`
+					ID        int64     `json:"id"`
+					Name      string    `json:"name"`
+					Lastname  string    `json:"lastname"`
+					Zipcode   string    `json:"zipcode"`
+					City      string    `json:"city"`
+					Country   string    `json:"country"`
+					Color     string    `json:"color"`
+					CreatedAt time.Time `json:"created_at"`
+					UpdatedAt time.Time `json:"updated_at"`
 				}
 				var input []person
 				readJSON(t, body, &input)
@@ -438,3 +514,895 @@ func TestCreatePersons(t *testing.T) {
 		})
 	}
 }
+
+func TestValidationErrorCodes(t *testing.T) {
+	app := newTestApp(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	type fieldError struct {
+		Field   string                 `json:"field"`
+		Code    string                 `json:"code"`
+		Message string                 `json:"message"`
+		Params  map[string]interface{} `json:"params"`
+	}
+	tests := []struct {
+		name   string
+		person map[string]interface{}
+		want   []fieldError
+	}{
+		{"Empty fields", map[string]interface{}{
+			"name": "", "lastname": "", "zipcode": "", "city": "", "color": 0},
+			[]fieldError{
+				{Field: "city", Code: "required"},
+				{Field: "color", Code: "out_of_range", Params: map[string]interface{}{"min": 1.0, "max": 7.0}},
+				{Field: "lastname", Code: "required"},
+				{Field: "name", Code: "required"},
+				{Field: "zipcode", Code: "required"},
+			}},
+		{"Long lastname", map[string]interface{}{
+			"name": "Hans", "lastname": strings.Repeat("x", 251), "zipcode": "67742", "city": "Lauterecken", "color": 1},
+			[]fieldError{
+				{Field: "lastname", Code: "max_length", Params: map[string]interface{}{"max": 250.0}},
+			}},
+		{"Invalid zipcode", map[string]interface{}{
+			"name": "Hans", "lastname": "Müller", "zipcode": strings.Repeat("x", 251), "city": "Lauterecken", "color": 1},
+			[]fieldError{
+				{Field: "zipcode", Code: "pattern"},
+			}},
+		{"Long name and invalid color", map[string]interface{}{
+			"name": strings.Repeat("x", 251), "lastname": "Müller", "zipcode": "67742", "city": "Lauterecken", "color": 8},
+			[]fieldError{
+				{Field: "color", Code: "out_of_range"},
+				{Field: "name", Code: "max_length"},
+			}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{"Accept": {"application/problem+json"}}
+			code, _, body := ts.do(t, http.MethodPost, "/persons", headers, writeJSON(t, tt.person))
+			if code != http.StatusUnprocessableEntity {
+				t.Fatalf("want %d; got %d", http.StatusUnprocessableEntity, code)
+			}
+
+			var input struct {
+				problemDetails
+				Errors []fieldError `json:"errors"`
+			}
+			readJSON(t, body, &input)
+			if len(input.Errors) != len(tt.want) {
+				t.Fatalf("want %d errors; got %+v", len(tt.want), input.Errors)
+			}
+			for i, want := range tt.want {
+				got := input.Errors[i]
+				if got.Field != want.Field || got.Code != want.Code {
+					t.Errorf("Errors[%d] want %s/%s; got %s/%s", i, want.Field, want.Code, got.Field, got.Code)
+				}
+				for k, v := range want.Params {
+					if got.Params[k] != v {
+						t.Errorf("Errors[%d] want param %s=%v; got %v", i, k, v, got.Params[k])
+					}
+				}
+			}
+		})
+	}
+
+	t.Run("Legacy shape", func(t *testing.T) {
+		code, _, body := ts.post(t, "/persons", writeJSON(t, map[string]interface{}{
+			"name": "Hans", "lastname": strings.Repeat("x", 251), "zipcode": "", "city": "Lauterecken", "color": 1}))
+		if code != http.StatusUnprocessableEntity {
+			t.Fatalf("want %d; got %d", http.StatusUnprocessableEntity, code)
+		}
+		var input struct {
+			Error map[string]string `json:"error"`
+		}
+		readJSON(t, body, &input)
+		if input.Error["lastname"] != "must not be more than 250 bytes long" {
+			t.Errorf("want lastname message; got %v", input.Error)
+		}
+		if input.Error["zipcode"] != "must be provided" {
+			t.Errorf("want zipcode message; got %v", input.Error)
+		}
+	})
+}
+
+func TestCreatePersonsCountry(t *testing.T) {
+	app := newTestApp(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	tests := []struct {
+		name        string
+		country     string
+		zipcode     string
+		wantCode    int
+		wantCountry string
+	}{
+		{"Default country", "", "67742", http.StatusCreated, "DE"},
+		{"German 4 digits", "DE", "6774", http.StatusUnprocessableEntity, ""},
+		{"Austria", "AT", "1010", http.StatusCreated, "AT"},
+		{"Austria 5 digits", "AT", "10100", http.StatusUnprocessableEntity, ""},
+		{"Switzerland", "CH", "8001", http.StatusCreated, "CH"},
+		{"Netherlands", "NL", "1234 AB", http.StatusCreated, "NL"},
+		{"Netherlands without letters", "NL", "1234", http.StatusUnprocessableEntity, ""},
+		{"United Kingdom", "GB", "SW1A 1AA", http.StatusCreated, "GB"},
+		{"Country without rule", "SE", "113 51", http.StatusCreated, "SE"},
+		{"Invalid country", "Germany", "67742", http.StatusUnprocessableEntity, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, body := ts.post(t, "/persons", writeJSON(t, map[string]interface{}{
+				"name":     "Hans",
+				"lastname": "Müller",
+				"zipcode":  tt.zipcode,
+				"city":     "Stadt",
+				"country":  tt.country,
+				"color":    int(data.Blue),
+			}))
+			if code != tt.wantCode {
+				t.Fatalf("want %d; got %d", tt.wantCode, code)
+			}
+			if code != http.StatusCreated {
+				return
+			}
+			var resp data.Person
+			readJSON(t, body, &resp)
+			if resp.Country != tt.wantCountry {
+				t.Errorf("want Country %s; got %s", tt.wantCountry, resp.Country)
+			}
+		})
+	}
+}
+
+func TestPostalCheck(t *testing.T) {
+	app := newTestApp(t)
+	err := app.models.PostalCodes.Replace("DE", []data.PostalCode{
+		{Country: "DE", Zipcode: "67742", City: "Lauterecken"},
+		{Country: "DE", Zipcode: "67742", City: "Heinzenhausen"},
+		{Country: "DE", Zipcode: "80331", City: "München"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	type fieldError struct {
+		Field   string                 `json:"field"`
+		Code    string                 `json:"code"`
+		Message string                 `json:"message"`
+		Params  map[string]interface{} `json:"params"`
+	}
+	tests := []struct {
+		name      string
+		check     string
+		zipcode   string
+		city      string
+		country   string
+		wantCode  int
+		wantField string
+		wantError string
+	}{
+		{"Off", data.PostalCheckOff, "88888", "made up", "DE", http.StatusCreated, "", ""},
+		{"Matching city", data.PostalCheckReject, "67742", "Lauterecken", "DE", http.StatusCreated, "", ""},
+		{"Second city of zipcode", data.PostalCheckReject, "67742", "heinzenhausen", "DE", http.StatusCreated, "", ""},
+		{"Umlaut spelling", data.PostalCheckReject, "80331", "Muenchen", "DE", http.StatusCreated, "", ""},
+		{"Country not in directory", data.PostalCheckReject, "1010", "Wien", "AT", http.StatusCreated, "", ""},
+		{"Mismatch rejected", data.PostalCheckReject, "67742", "Kaiserslautern", "DE", http.StatusUnprocessableEntity, "city", data.CodeCityMismatch},
+		{"Unknown zipcode rejected", data.PostalCheckReject, "88888", "made up", "DE", http.StatusUnprocessableEntity, "zipcode", data.CodeUnknownZipcode},
+		{"Mismatch flagged", data.PostalCheckFlag, "67742", "Kaiserslautern", "DE", http.StatusCreated, "city", data.CodeCityMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app.config.postal.check = tt.check
+			headers := http.Header{"Accept": {"application/problem+json"}}
+			code, _, body := ts.do(t, http.MethodPost, "/persons", headers, writeJSON(t, map[string]interface{}{
+				"name":     "Hans",
+				"lastname": "Müller",
+				"zipcode":  tt.zipcode,
+				"city":     tt.city,
+				"country":  tt.country,
+				"color":    int(data.Blue),
+			}))
+			if code != tt.wantCode {
+				t.Fatalf("want %d; got %d", tt.wantCode, code)
+			}
+
+			var got []fieldError
+			if code == http.StatusCreated {
+				var resp struct {
+					data.Person
+					Warnings map[string][]fieldError `json:"warnings"`
+				}
+				readJSON(t, body, &resp)
+				for field, errs := range resp.Warnings {
+					for _, e := range errs {
+						e.Field = field
+						got = append(got, e)
+					}
+				}
+			} else {
+				var resp struct {
+					problemDetails
+					Errors []fieldError `json:"errors"`
+				}
+				readJSON(t, body, &resp)
+				got = resp.Errors
+			}
+
+			if tt.wantError == "" {
+				if len(got) != 0 {
+					t.Errorf("want no errors; got %+v", got)
+				}
+				return
+			}
+			if len(got) != 1 || got[0].Field != tt.wantField || got[0].Code != tt.wantError {
+				t.Fatalf("want %s/%s; got %+v", tt.wantField, tt.wantError, got)
+			}
+			if tt.wantError == data.CodeCityMismatch {
+				suggestions, _ := got[0].Params["suggestions"].([]interface{})
+				if len(suggestions) != 2 || suggestions[0] != "Heinzenhausen" || suggestions[1] != "Lauterecken" {
+					t.Errorf("want suggestions [Heinzenhausen Lauterecken]; got %v", got[0].Params["suggestions"])
+				}
+			}
+		})
+	}
+}
+
+func TestPersonsNearby(t *testing.T) {
+	app := newTestApp(t)
+	coords := func(lat, lon float64) (*float64, *float64) { return &lat, &lon }
+	directory := []struct {
+		zipcode, city string
+		lat, lon      float64
+	}{
+		{"67742", "Lauterecken", 49.6500, 7.5917},
+		{"67753", "Wolfstein", 49.5847, 7.6061},
+		{"67655", "Kaiserslautern", 49.4447, 7.7689},
+		{"10115", "Berlin", 52.5323, 13.3846},
+	}
+	var entries []data.PostalCode
+	for _, d := range directory {
+		e := data.PostalCode{Country: "DE", Zipcode: d.zipcode, City: d.city}
+		e.Latitude, e.Longitude = coords(d.lat, d.lon)
+		entries = append(entries, e)
+	}
+	if err := app.models.PostalCodes.Replace("DE", entries); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []data.Person{
+		{Name: "Hans", Lastname: "Müller", Zipcode: "67655", City: "Kaiserslautern", Country: "DE", Color: 1},
+		{Name: "Peter", Lastname: "Petersen", Zipcode: "10115", City: "Berlin", Country: "DE", Color: 2},
+		{Name: "Johnny", Lastname: "Johnson", Zipcode: "88888", City: "made up", Country: "DE", Color: 3},
+		{Name: "Milly", Lastname: "Millenium", Zipcode: "67753", City: "Wolfstein", Country: "DE", Color: 4},
+		{Name: "Jonas", Lastname: "Müller", Zipcode: "67742", City: "Lauterecken", Country: "DE", Color: 5},
+	} {
+		if err := app.models.Persons.Insert(&p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	tests := []struct {
+		name     string
+		urlPath  string
+		wantCode int
+		wantIDs  []int64
+	}{
+		{"Within 20 km", "/persons/nearby?zipcode=67742&radius_km=20", http.StatusOK, []int64{5, 4}},
+		{"Within 30 km", "/persons/nearby?zipcode=67742&radius_km=30", http.StatusOK, []int64{5, 4, 1}},
+		{"Explicit country", "/persons/nearby?zipcode=10115&radius_km=1&country=de", http.StatusOK, []int64{2}},
+		{"Small radius", "/persons/nearby?zipcode=67742&radius_km=0.5&country=DE", http.StatusOK, []int64{5}},
+		{"Unknown zipcode", "/persons/nearby?zipcode=88888&radius_km=20", http.StatusUnprocessableEntity, nil},
+		{"Missing zipcode", "/persons/nearby?radius_km=20", http.StatusUnprocessableEntity, nil},
+		{"Missing radius", "/persons/nearby?zipcode=67742", http.StatusUnprocessableEntity, nil},
+		{"Invalid radius", "/persons/nearby?zipcode=67742&radius_km=abc", http.StatusUnprocessableEntity, nil},
+		{"Radius too large", "/persons/nearby?zipcode=67742&radius_km=5000", http.StatusUnprocessableEntity, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, body := ts.get(t, tt.urlPath)
+			if code != tt.wantCode {
+				t.Fatalf("want %d; got %d", tt.wantCode, code)
+			}
+			if code != http.StatusOK {
+				return
+			}
+			var persons []struct {
+				ID         int64     `json:"id"`
+				Name       string    `json:"name"`
+				Lastname   string    `json:"lastname"`
+				Zipcode    string    `json:"zipcode"`
+				City       string    `json:"city"`
+				Country    string    `json:"country"`
+				Color      string    `json:"color"`
+				CreatedAt  time.Time `json:"created_at"`
+				UpdatedAt  time.Time `json:"updated_at"`
+				DistanceKm float64   `json:"distance_km"`
+			}
+			readJSON(t, body, &persons)
+			if len(persons) != len(tt.wantIDs) {
+				t.Fatalf("want %d persons; got %+v", len(tt.wantIDs), persons)
+			}
+			for i, id := range tt.wantIDs {
+				if persons[i].ID != id {
+					t.Errorf("Item[%d] want ID %d; got %d", i, id, persons[i].ID)
+				}
+				if i > 0 && persons[i].DistanceKm < persons[i-1].DistanceKm {
+					t.Errorf("Item[%d] not sorted by distance", i)
+				}
+			}
+			if persons[0].DistanceKm != 0 {
+				t.Errorf("want distance 0 of the zipcode itself; got %v", persons[0].DistanceKm)
+			}
+			if len(persons) > 1 && (persons[1].DistanceKm < 7 || persons[1].DistanceKm > 8) {
+				t.Errorf("want Wolfstein about 7.4 km away; got %v", persons[1].DistanceKm)
+			}
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	app := newTestApp(t)
+	for _, p := range []data.Person{
+		{Name: "Hans", Lastname: "Müller", Zipcode: "67742", City: "Lauterecken", Country: "DE", Color: 1},
+		{Name: "Peter", Lastname: "Petersen", Zipcode: "18439", City: "Stralsund", Country: "DE", Color: 2},
+		{Name: "Jonas", Lastname: "Müller", Zipcode: "67753", City: "Wolfstein", Country: "DE", Color: 1},
+		{Name: "Klaus", Lastname: "Klaussen", Zipcode: "67742", City: "Lauterecken", Country: "DE", Color: 2},
+		{Name: "Franz", Lastname: "Gruber", Zipcode: "1010", City: "Wien", Country: "AT", Color: 7},
+	} {
+		if err := app.models.Persons.Insert(&p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	tests := []struct {
+		name     string
+		urlPath  string
+		wantCode int
+		want     data.Stats
+	}{
+		{"All", "/stats", http.StatusOK, data.Stats{
+			Total:      5,
+			ByColor:    []data.Count{{Key: "blau", Count: 2}, {Key: "grün", Count: 2}, {Key: "weiß", Count: 1}},
+			ByCity:     []data.Count{{Key: "Lauterecken", Count: 2}, {Key: "Stralsund", Count: 1}, {Key: "Wien", Count: 1}, {Key: "Wolfstein", Count: 1}},
+			ByRegion1:  []data.Count{{Key: "6", Count: 3}, {Key: "1", Count: 2}},
+			ByRegion2:  []data.Count{{Key: "67", Count: 3}, {Key: "10", Count: 1}, {Key: "18", Count: 1}},
+			ByLastname: []data.Count{{Key: "Müller", Count: 2}, {Key: "Gruber", Count: 1}, {Key: "Klaussen", Count: 1}, {Key: "Petersen", Count: 1}},
+		}},
+		{"Filter by color and zipcode", "/stats?color=1&zipcode=677", http.StatusOK, data.Stats{
+			Total:      2,
+			ByColor:    []data.Count{{Key: "blau", Count: 2}},
+			ByCity:     []data.Count{{Key: "Lauterecken", Count: 1}, {Key: "Wolfstein", Count: 1}},
+			ByRegion1:  []data.Count{{Key: "6", Count: 2}},
+			ByRegion2:  []data.Count{{Key: "67", Count: 2}},
+			ByLastname: []data.Count{{Key: "Müller", Count: 2}},
+		}},
+		{"Filter by city and country", "/stats?city=lauterecken&country=de", http.StatusOK, data.Stats{
+			Total:      2,
+			ByColor:    []data.Count{{Key: "blau", Count: 1}, {Key: "grün", Count: 1}},
+			ByCity:     []data.Count{{Key: "Lauterecken", Count: 2}},
+			ByRegion1:  []data.Count{{Key: "6", Count: 2}},
+			ByRegion2:  []data.Count{{Key: "67", Count: 2}},
+			ByLastname: []data.Count{{Key: "Klaussen", Count: 1}, {Key: "Müller", Count: 1}},
+		}},
+		{"No match", "/stats?lastname=Nobody", http.StatusOK, data.Stats{
+			ByColor:    []data.Count{},
+			ByCity:     []data.Count{},
+			ByRegion1:  []data.Count{},
+			ByRegion2:  []data.Count{},
+			ByLastname: []data.Count{},
+		}},
+		{"Invalid color", "/stats?color=8", http.StatusUnprocessableEntity, data.Stats{}},
+		{"Invalid country", "/stats?country=Germany", http.StatusUnprocessableEntity, data.Stats{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, body := ts.get(t, tt.urlPath)
+			if code != tt.wantCode {
+				t.Fatalf("want %d; got %d", tt.wantCode, code)
+			}
+			if code != http.StatusOK {
+				return
+			}
+			var got data.Stats
+			readJSON(t, body, &got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("want %+v; got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	app := newTestApp(t)
+	for _, p := range []data.Person{
+		{Name: "Hans", Lastname: "Müller", Zipcode: "67742", City: "Lauterecken", Country: "DE", Color: 1},
+		{Name: "Hans", Lastname: "Mueller", Zipcode: "67742", City: "Lauterecken", Country: "DE", Color: 1},
+		{Name: "Hanz", Lastname: "Müller", Zipcode: "67742", City: "Lauterecken", Country: "DE", Color: 2},
+		{Name: "Jonas", Lastname: "Müller", Zipcode: "67742", City: "Lauterecken", Country: "DE", Color: 1},
+		{Name: "Peter", Lastname: "Petersen", Zipcode: "18439", City: "Stralsund", Country: "DE", Color: 2},
+		{Name: "Petersen", Lastname: "Peter", Zipcode: "18439", City: "Stralsund", Country: "DE", Color: 2},
+		{Name: "Peter", Lastname: "Petersen", Zipcode: "18435", City: "Stralsund", Country: "DE", Color: 2},
+	} {
+		if err := app.models.Persons.Insert(&p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	code, _, body := ts.get(t, "/persons/duplicates")
+	if code != http.StatusOK {
+		t.Fatalf("want %d; got %d", http.StatusOK, code)
+	}
+	var clusters []struct {
+		Persons []struct {
+			ID        int64     `json:"id"`
+			Name      string    `json:"name"`
+			Lastname  string    `json:"lastname"`
+			Zipcode   string    `json:"zipcode"`
+			City      string    `json:"city"`
+			Country   string    `json:"country"`
+			Color     string    `json:"color"`
+			CreatedAt time.Time `json:"created_at"`
+			UpdatedAt time.Time `json:"updated_at"`
+		} `json:"persons"`
+	}
+	readJSON(t, body, &clusters)
+	want := [][]int64{{1, 2, 3}, {5, 6}}
+	if len(clusters) != len(want) {
+		t.Fatalf("want %d clusters; got %+v", len(want), clusters)
+	}
+	for i, ids := range want {
+		if len(clusters[i].Persons) != len(ids) {
+			t.Errorf("Cluster[%d] want %d persons; got %+v", i, len(ids), clusters[i].Persons)
+			continue
+		}
+		for j, id := range ids {
+			if clusters[i].Persons[j].ID != id {
+				t.Errorf("Cluster[%d][%d] want ID %d; got %d", i, j, id, clusters[i].Persons[j].ID)
+			}
+		}
+	}
+}
+
+func TestMergePerson(t *testing.T) {
+	app := newTestApp(t)
+	// The models don't validate, so the third person can have an invalid
+	// color.
+	for _, p := range []data.Person{
+		{Name: "Hans", Lastname: "Müller", Zipcode: "67742", City: "Lauterecken", Country: "DE", Color: 1},
+		{Name: "Hans", Lastname: "Mueller", Zipcode: "67742", City: "Lauterecken", Country: "DE", Color: 3},
+		{Name: "Hans", Lastname: "Müller", Zipcode: "67742", City: "Lauterecken", Country: "DE", Color: 0},
+	} {
+		if err := app.models.Persons.Insert(&p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	tests := []struct {
+		name      string
+		urlPath   string
+		input     map[string]interface{}
+		wantCode  int
+		wantColor string
+	}{
+		{"Unknown target", "/persons/9/merge", map[string]interface{}{"source_id": 2}, http.StatusNotFound, ""},
+		{"Invalid target", "/persons/x/merge", map[string]interface{}{"source_id": 2}, http.StatusUnprocessableEntity, ""},
+		{"Unknown source", "/persons/1/merge", map[string]interface{}{"source_id": 9}, http.StatusUnprocessableEntity, ""},
+		{"Merge with itself", "/persons/1/merge", map[string]interface{}{"source_id": 1}, http.StatusUnprocessableEntity, ""},
+		{"Unknown field", "/persons/1/merge", map[string]interface{}{"source_id": 2, "fields": []string{"id"}}, http.StatusUnprocessableEntity, ""},
+		{"Invalid result", "/persons/1/merge", map[string]interface{}{"source_id": 3, "fields": []string{"color"}}, http.StatusUnprocessableEntity, ""},
+		{"Valid", "/persons/1/merge", map[string]interface{}{"source_id": 2, "fields": []string{"color"}}, http.StatusOK, "violett"},
+		{"Source already merged", "/persons/1/merge", map[string]interface{}{"source_id": 2}, http.StatusUnprocessableEntity, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, body := ts.post(t, tt.urlPath, writeJSON(t, tt.input))
+			if code != tt.wantCode {
+				t.Fatalf("want %d; got %d", tt.wantCode, code)
+			}
+			if code != http.StatusOK {
+				return
+			}
+			var person struct {
+				ID        int64     `json:"id"`
+				Name      string    `json:"name"`
+				Lastname  string    `json:"lastname"`
+				Zipcode   string    `json:"zipcode"`
+				City      string    `json:"city"`
+				Country   string    `json:"country"`
+				Color     string    `json:"color"`
+				CreatedAt time.Time `json:"created_at"`
+				UpdatedAt time.Time `json:"updated_at"`
+			}
+			readJSON(t, body, &person)
+			if person.ID != 1 || person.Lastname != "Müller" || person.Color != tt.wantColor {
+				t.Errorf("want Müller with color %s; got %+v", tt.wantColor, person)
+			}
+		})
+	}
+
+	t.Run("Unknown fields reported once", func(t *testing.T) {
+		headers := http.Header{"Accept": {"application/problem+json"}}
+		input := map[string]interface{}{"source_id": 3, "fields": []string{"id", "color", "created_at"}}
+		code, _, body := ts.do(t, http.MethodPost, "/persons/1/merge", headers, writeJSON(t, input))
+		if code != http.StatusUnprocessableEntity {
+			t.Fatalf("want %d; got %d", http.StatusUnprocessableEntity, code)
+		}
+		var problem struct {
+			problemDetails
+			Errors []struct {
+				Field   string                 `json:"field"`
+				Code    string                 `json:"code"`
+				Message string                 `json:"message"`
+				Params  map[string]interface{} `json:"params"`
+			} `json:"errors"`
+		}
+		readJSON(t, body, &problem)
+		if len(problem.Errors) != 1 || problem.Errors[0].Field != "fields" || problem.Errors[0].Code != "one_of" {
+			t.Errorf("want one one_of error of fields; got %+v", problem.Errors)
+		}
+	})
+
+	persons, err := app.models.Persons.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(persons) != 2 || persons[0].ID != 1 || persons[1].ID != 3 {
+		t.Errorf("want persons 1 and 3 left; got %d persons", len(persons))
+	}
+}
+
+func TestUpsertExternalPerson(t *testing.T) {
+	app := newTestApp(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	person := func(city string, color int) map[string]interface{} {
+		return map[string]interface{}{
+			"name":     "Hans",
+			"lastname": "Müller",
+			"zipcode":  "67742",
+			"city":     city,
+			"color":    color,
+		}
+	}
+	tests := []struct {
+		name     string
+		urlPath  string
+		input    map[string]interface{}
+		wantCode int
+		wantID   int64
+	}{
+		{"Create", "/persons/external/crm/4711", person("Lauterecken", 1), http.StatusCreated, 1},
+		{"Update", "/persons/external/crm/4711", person("Lauterecken", 2), http.StatusOK, 1},
+		{"Other id", "/persons/external/crm/4712", person("Lauterecken", 1), http.StatusCreated, 2},
+		{"Other source", "/persons/external/erp/4711", person("Lauterecken", 1), http.StatusCreated, 3},
+		{"Invalid source", "/persons/external/CRM!/4711", person("Lauterecken", 1), http.StatusUnprocessableEntity, 0},
+		{"Invalid person", "/persons/external/crm/4711", person("", 1), http.StatusUnprocessableEntity, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, body := ts.do(t, http.MethodPut, tt.urlPath, nil, writeJSON(t, tt.input))
+			if code != tt.wantCode {
+				t.Fatalf("want %d; got %d", tt.wantCode, code)
+			}
+			if tt.wantID == 0 {
+				return
+			}
+			var resp data.Person
+			readJSON(t, body, &resp)
+			if resp.ID != tt.wantID || resp.Color != tt.input["color"] {
+				t.Errorf("want ID %d with color %v; got %+v", tt.wantID, tt.input["color"], resp)
+			}
+		})
+	}
+
+	persons, err := app.models.Persons.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(persons) != 3 {
+		t.Fatalf("want 3 persons; got %d", len(persons))
+	}
+	if persons[0].Source != "crm" || persons[0].ExternalID != "4711" || persons[0].Color != 2 {
+		t.Errorf("want crm/4711 with color 2; got %+v", persons[0])
+	}
+}
+
+func TestDeletePerson(t *testing.T) {
+	app := newTestApp(t)
+	for _, p := range []data.Person{
+		{Name: "Hans", Lastname: "Müller", Zipcode: "67742", City: "Lauterecken", Country: "DE", Color: 1},
+		{Name: "Peter", Lastname: "Petersen", Zipcode: "18439", City: "Stralsund", Country: "DE", Color: 2},
+	} {
+		if err := app.models.Persons.Insert(&p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	tests := []struct {
+		name     string
+		method   string
+		urlPath  string
+		wantCode int
+	}{
+		{"Delete invalid id", http.MethodDelete, "/persons/x", http.StatusUnprocessableEntity},
+		{"Delete unknown", http.MethodDelete, "/persons/9", http.StatusNotFound},
+		{"Restore not deleted", http.MethodPost, "/persons/1/restore", http.StatusNotFound},
+		{"Delete", http.MethodDelete, "/persons/1", http.StatusOK},
+		{"Delete again", http.MethodDelete, "/persons/1", http.StatusNotFound},
+		{"Show deleted", http.MethodGet, "/persons/1", http.StatusNotFound},
+		{"Invalid include_deleted", http.MethodGet, "/persons?include_deleted=maybe", http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, _ := ts.do(t, tt.method, tt.urlPath, nil, nil)
+			if code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, code)
+			}
+		})
+	}
+
+	list := func(t *testing.T, urlPath string) []formattedPerson {
+		code, _, body := ts.get(t, urlPath)
+		if code != http.StatusOK {
+			t.Fatalf("want %d; got %d", http.StatusOK, code)
+		}
+		var persons []formattedPerson
+		readJSON(t, body, &persons)
+		return persons
+	}
+
+	t.Run("List without deleted", func(t *testing.T) {
+		persons := list(t, "/persons")
+		if len(persons) != 1 || persons[0].ID != 2 {
+			t.Errorf("want person 2; got %+v", persons)
+		}
+	})
+
+	t.Run("List with deleted", func(t *testing.T) {
+		persons := list(t, "/persons?include_deleted=true")
+		if len(persons) != 2 || persons[0].DeletedAt == nil || persons[1].DeletedAt != nil {
+			t.Errorf("want deleted person 1 and person 2; got %+v", persons)
+		}
+	})
+
+	t.Run("Restore", func(t *testing.T) {
+		code, _, body := ts.post(t, "/persons/1/restore", nil)
+		if code != http.StatusOK {
+			t.Fatalf("want %d; got %d", http.StatusOK, code)
+		}
+		var person formattedPerson
+		readJSON(t, body, &person)
+		if person.ID != 1 || person.DeletedAt != nil {
+			t.Errorf("want restored person 1; got %+v", person)
+		}
+		if persons := list(t, "/persons"); len(persons) != 2 {
+			t.Errorf("want 2 persons; got %d", len(persons))
+		}
+	})
+}
+
+func TestAudit(t *testing.T) {
+	app := newTestApp(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	start := time.Now().Add(-time.Second).UTC().Format(time.RFC3339)
+	code, _, _ := ts.post(t, "/persons", writeJSON(t, map[string]interface{}{
+		"name":     "Hans",
+		"lastname": "Müller",
+		"zipcode":  "67742",
+		"city":     "Lauterecken",
+		"color":    1,
+	}))
+	if code != http.StatusCreated {
+		t.Fatalf("want %d; got %d", http.StatusCreated, code)
+	}
+	for _, req := range []struct{ method, urlPath string }{
+		{http.MethodDelete, "/persons/1"},
+		{http.MethodPost, "/persons/1/restore"},
+	} {
+		if code, _, _ := ts.do(t, req.method, req.urlPath, nil, nil); code != http.StatusOK {
+			t.Fatalf("%s %s: want %d; got %d", req.method, req.urlPath, http.StatusOK, code)
+		}
+	}
+
+	type event struct {
+		ID        int64                  `json:"id"`
+		PersonID  int64                  `json:"person_id"`
+		Actor     string                 `json:"actor"`
+		Operation string                 `json:"operation"`
+		Changes   map[string]data.Change `json:"changes"`
+		CreatedAt time.Time              `json:"created_at"`
+	}
+
+	t.Run("History", func(t *testing.T) {
+		code, _, body := ts.get(t, "/persons/1/history")
+		if code != http.StatusOK {
+			t.Fatalf("want %d; got %d", http.StatusOK, code)
+		}
+		var events []event
+		readJSON(t, body, &events)
+		if len(events) != 3 {
+			t.Fatalf("want 3 events; got %d", len(events))
+		}
+		for i, op := range []string{data.AuditInsert, data.AuditDelete, data.AuditRestore} {
+			if events[i].Operation != op || events[i].Actor != "anonymous" || events[i].PersonID != 1 {
+				t.Errorf("want %s by anonymous; got %+v", op, events[i])
+			}
+		}
+		if c := events[0].Changes["lastname"]; c.Before != nil || c.After != "Müller" {
+			t.Errorf("want lastname inserted; got %+v", c)
+		}
+		if c := events[1].Changes["deleted_at"]; c.Before != nil || c.After == nil || len(events[1].Changes) != 1 {
+			t.Errorf("want only deleted_at set; got %+v", events[1].Changes)
+		}
+	})
+
+	tests := []struct {
+		name       string
+		urlPath    string
+		wantCode   int
+		wantEvents int
+	}{
+		{"Unknown person", "/persons/9/history", http.StatusNotFound, 0},
+		{"Invalid person", "/persons/x/history", http.StatusUnprocessableEntity, 0},
+		{"All", "/audit", http.StatusOK, 3},
+		{"Since start", "/audit?since=" + start, http.StatusOK, 3},
+		{"Since later", "/audit?since=2999-01-01T00:00:00Z", http.StatusOK, 0},
+		{"Invalid since", "/audit?since=yesterday", http.StatusUnprocessableEntity, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, body := ts.get(t, tt.urlPath)
+			if code != tt.wantCode {
+				t.Fatalf("want %d; got %d", tt.wantCode, code)
+			}
+			if code != http.StatusOK {
+				return
+			}
+			var events []event
+			readJSON(t, body, &events)
+			if len(events) != tt.wantEvents {
+				t.Errorf("want %d events; got %d", tt.wantEvents, len(events))
+			}
+		})
+	}
+}
+
+func TestPersonTimestamps(t *testing.T) {
+	app := newTestApp(t)
+	for _, p := range []data.Person{
+		{Name: "Hans", Lastname: "Müller", Zipcode: "67742", City: "Lauterecken", Country: "DE", Color: 1},
+		{Name: "Peter", Lastname: "Petersen", Zipcode: "18439", City: "Stralsund", Country: "DE", Color: 2},
+		{Name: "Anna", Lastname: "Schmidt", Zipcode: "10115", City: "Berlin", Country: "DE", Color: 3},
+	} {
+		if err := app.models.Persons.Insert(&p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Deleted now, between 2025 and 2030.
+	if err := app.models.Persons.Delete(3); err != nil {
+		t.Fatal(err)
+	}
+	// The mock returns the stored persons, so their timestamps can be set.
+	for id, updated := range map[int64]time.Time{
+		1: time.Date(2020, 1, 1, 10, 0, 0, 500_000_000, time.UTC),
+		2: time.Date(2030, 1, 1, 10, 0, 0, 0, time.UTC),
+	} {
+		p, err := app.models.Persons.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.UpdatedAt = updated
+	}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	t.Run("Updated since", func(t *testing.T) {
+		tests := []struct {
+			name        string
+			urlPath     string
+			wantCode    int
+			wantIDs     []int64
+			wantDeleted []int64
+		}{
+			{"All", "/persons", http.StatusOK, []int64{1, 2}, []int64{}},
+			{"Since 2025", "/persons?updated_since=2025-01-01T00:00:00Z", http.StatusOK, []int64{2, 3}, []int64{3}},
+			{"Since exact time", "/persons?updated_since=2030-01-01T11:00:00%2B01:00", http.StatusOK, []int64{2}, []int64{}},
+			{"Since 2040", "/persons?updated_since=2040-01-01T00:00:00Z", http.StatusOK, []int64{}, []int64{}},
+			{"Invalid", "/persons?updated_since=2025-01-01", http.StatusUnprocessableEntity, nil, nil},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				code, _, body := ts.get(t, tt.urlPath)
+				if code != tt.wantCode {
+					t.Fatalf("want %d; got %d", tt.wantCode, code)
+				}
+				if code != http.StatusOK {
+					return
+				}
+				var persons []formattedPerson
+				readJSON(t, body, &persons)
+				ids, deleted := []int64{}, []int64{}
+				for _, p := range persons {
+					ids = append(ids, p.ID)
+					if p.DeletedAt != nil {
+						deleted = append(deleted, p.ID)
+					}
+				}
+				if !reflect.DeepEqual(ids, tt.wantIDs) {
+					t.Errorf("want persons %v; got %v", tt.wantIDs, ids)
+				}
+				if !reflect.DeepEqual(deleted, tt.wantDeleted) {
+					t.Errorf("want deleted persons %v; got %v", tt.wantDeleted, deleted)
+				}
+			})
+		}
+	})
+
+	t.Run("If-Modified-Since", func(t *testing.T) {
+		tests := []struct {
+			name            string
+			ifModifiedSince string
+			wantCode        int
+		}{
+			{"Without header", "", http.StatusOK},
+			{"Not modified", "Wed, 01 Jan 2020 10:00:00 GMT", http.StatusNotModified},
+			{"Not modified since later", "Thu, 02 Jan 2020 10:00:00 GMT", http.StatusNotModified},
+			{"Modified", "Wed, 01 Jan 2020 09:59:59 GMT", http.StatusOK},
+			{"Invalid date", "yesterday", http.StatusOK},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				headers := http.Header{}
+				if tt.ifModifiedSince != "" {
+					headers.Set("If-Modified-Since", tt.ifModifiedSince)
+				}
+				code, header, body := ts.do(t, http.MethodGet, "/persons/1", headers, nil)
+				if code != tt.wantCode {
+					t.Fatalf("want %d; got %d", tt.wantCode, code)
+				}
+				if lm := header.Get("Last-Modified"); lm != "Wed, 01 Jan 2020 10:00:00 GMT" {
+					t.Errorf("want Last-Modified of the update; got %q", lm)
+				}
+				if code == http.StatusNotModified && len(body) > 0 {
+					t.Errorf("want empty body; got %q", body)
+				}
+			})
+		}
+	})
+}
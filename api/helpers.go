@@ -7,8 +7,11 @@ import (
 	"io"
 	"net/http"
 	"reflect"
+	"runtime"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"time"
 
 	"assecor.assessment.test/internal/data"
 )
@@ -21,6 +24,100 @@ func (app *application) readIDParam(param string) (int64, error) {
 	return id, nil
 }
 
+// systemInfo collects the build and runtime details reported by the health
+// endpoints.
+func (app *application) systemInfo() map[string]string {
+	info := map[string]string{
+		"version":     version,
+		"environment": app.config.env,
+		"go_version":  runtime.Version(),
+		"uptime":      time.Since(app.started).Round(time.Second).String(),
+		"commit":      "unknown",
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.revision" {
+				info["commit"] = s.Value
+			}
+		}
+	}
+	return info
+}
+
+// background runs fn in a goroutine which is waited for on shutdown. A panic
+// in fn is logged instead of crashing the server.
+func (app *application) background(fn func()) {
+	app.wg.Add(1)
+	go func() {
+		defer app.wg.Done()
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.Error("background task panicked", "error", fmt.Sprintf("%v", err))
+			}
+		}()
+		fn()
+	}()
+}
+
+// consumer runs fn in a goroutine which, unlike the background tasks, keeps
+// running while the server shuts down. It is for consumers of the events the
+// requests and background tasks publish; fn has to return once app.drained is
+// closed.
+func (app *application) consumer(fn func()) {
+	app.consumers.Add(1)
+	go func() {
+		defer app.consumers.Done()
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.Error("event consumer panicked", "error", fmt.Sprintf("%v", err))
+			}
+		}()
+		fn()
+	}()
+}
+
+// every runs fn in the background at the interval until the server shuts
+// down.
+func (app *application) every(interval time.Duration, fn func()) {
+	app.background(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fn()
+			case <-app.shutdown:
+				return
+			}
+		}
+	})
+}
+
+// stopBackground closes the shutdown channel, so the periodic jobs and event
+// streams stop. It may be called more than once.
+func (app *application) stopBackground() {
+	app.shutdownOnce.Do(func() { close(app.shutdown) })
+}
+
+// waitBackground blocks until all background tasks have finished, then
+// closes app.drained and waits for the event consumers, or until the timeout
+// expired.
+func (app *application) waitBackground(timeout time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		app.wg.Wait()
+		app.drainOnce.Do(func() { close(app.drained) })
+		app.consumers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("background tasks did not finish within %s", timeout)
+	}
+}
+
 // Define a writeJSON() helper for sending responses.
 func (app *application) writeJSON(w http.ResponseWriter, status int, data interface{}, headers http.Header) error {
 	if v, ok := data.([]interface{}); ok {
@@ -37,10 +134,10 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data interf
 	// Append a newline to make it easier to view in terminal applications.
 	js = append(js, '\n')
 
+	w.Header().Set("Content-Type", "application/json")
 	for key, value := range headers {
 		w.Header()[key] = value
 	}
-	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	w.Write(js)
 	return nil
@@ -97,22 +194,37 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 	return nil
 }
 
+// formattedPerson is a person with the color name instead of the color id.
+type formattedPerson struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Lastname   string     `json:"lastname"`
+	Zipcode    string     `json:"zipcode"`
+	City       string     `json:"city"`
+	Country    string     `json:"country"`
+	Color      string     `json:"color"`
+	Source     string     `json:"source,omitempty"`
+	ExternalID string     `json:"external_id,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	DeletedAt  *time.Time `json:"deleted_at,omitempty"`
+}
+
 // Convert color id to string
-func (app *application) formatPerson(persons *data.Person) interface{} {
-	return struct {
-		ID       int64  `json:"id"`
-		Name     string `json:"name"`
-		Lastname string `json:"lastname"`
-		Zipcode  string `json:"zipcode"`
-		City     string `json:"city"`
-		Color    string `json:"color"`
-	}{
-		ID:       persons.ID,
-		Name:     persons.Name,
-		Lastname: persons.Lastname,
-		Zipcode:  persons.Zipcode,
-		City:     persons.City,
-		Color:    data.Color(persons.Color).String(),
+func (app *application) formatPerson(persons *data.Person) formattedPerson {
+	return formattedPerson{
+		ID:         persons.ID,
+		Name:       persons.Name,
+		Lastname:   persons.Lastname,
+		Zipcode:    persons.Zipcode,
+		City:       persons.City,
+		Country:    persons.Country,
+		Color:      data.Color(persons.Color).String(),
+		Source:     persons.Source,
+		ExternalID: persons.ExternalID,
+		CreatedAt:  persons.CreatedAt,
+		UpdatedAt:  persons.UpdatedAt,
+		DeletedAt:  persons.DeletedAt,
 	}
 }
 
@@ -120,21 +232,7 @@ func (app *application) formatPerson(persons *data.Person) interface{} {
 func (app *application) formatPersonArray(persons []*data.Person) interface{} {
 	var formated []interface{}
 	for _, person := range persons {
-		formated = append(formated, struct {
-			ID       int64  `json:"id"`
-			Name     string `json:"name"`
-			Lastname string `json:"lastname"`
-			Zipcode  string `json:"zipcode"`
-			City     string `json:"city"`
-			Color    string `json:"color"`
-		}{
-			ID:       person.ID,
-			Name:     person.Name,
-			Lastname: person.Lastname,
-			Zipcode:  person.Zipcode,
-			City:     person.City,
-			Color:    data.Color(person.Color).String(),
-		})
+		formated = append(formated, app.formatPerson(person))
 	}
 	return formated
 }
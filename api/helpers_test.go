@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackground(t *testing.T) {
+	t.Run("Waits for tasks", func(t *testing.T) {
+		app := newTestApp(t)
+		var done atomic.Int32
+		for i := 0; i < 3; i++ {
+			app.background(func() {
+				time.Sleep(10 * time.Millisecond)
+				done.Add(1)
+			})
+		}
+		if err := app.waitBackground(time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if done.Load() != 3 {
+			t.Errorf("want %d finished tasks; got %d", 3, done.Load())
+		}
+	})
+
+	t.Run("Recovers panics", func(t *testing.T) {
+		app := newTestApp(t)
+		app.background(func() {
+			panic("boom")
+		})
+		if err := app.waitBackground(time.Second); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Stops periodic jobs", func(t *testing.T) {
+		app := newTestApp(t)
+		var runs atomic.Int32
+		app.every(time.Millisecond, func() {
+			runs.Add(1)
+		})
+		time.Sleep(20 * time.Millisecond)
+		close(app.shutdown)
+		if err := app.waitBackground(time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if runs.Load() == 0 {
+			t.Error("want job to run")
+		}
+	})
+
+	t.Run("Deadline", func(t *testing.T) {
+		app := newTestApp(t)
+		release := make(chan struct{})
+		defer close(release)
+		app.background(func() {
+			<-release
+		})
+		if err := app.waitBackground(10 * time.Millisecond); err == nil {
+			t.Error("want deadline error")
+		}
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"assecor.assessment.test/internal/data"
+)
+
+// maxIdempotencyKeyLength is the maximum length of an Idempotency-Key.
+const maxIdempotencyKeyLength = 255
+
+// idempotency makes POST requests with an Idempotency-Key header safe to
+// retry. The first request with a key is handled and its successful response
+// stored for the configured time; repeating the request replays the stored
+// response instead of handling it again. Keys are scoped to the client,
+// anonymous clients are told apart by their IP address.
+// Reusing a key for a different request is rejected with 422, a repeat while
+// the first request is still in progress with 409. Failed requests don't
+// change anything, so their key is released and they can simply be retried.
+func (app *application) idempotency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if r.Method != http.MethodPost || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			app.badRequestResponse(w, r, errors.New("Idempotency-Key must not be more than 255 bytes long"))
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1_048_576))
+		if err != nil {
+			app.badRequestResponse(w, r, errors.New("body must not be larger than 1048576 bytes"))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.New()
+		io.WriteString(hash, r.Method+" "+r.URL.RequestURI()+"\n")
+		hash.Write(body)
+
+		scope := app.contextGetActor(r)
+		if app.contextGetUser(r).IsAnonymous() {
+			scope += ":" + app.clientIP(r)
+		}
+		rec := &data.IdempotencyRecord{
+			Scope:       scope,
+			Key:         key,
+			RequestHash: hex.EncodeToString(hash.Sum(nil)),
+			ExpiresAt:   time.Now().Add(app.config.idempotency.ttl),
+		}
+		err = app.models.Idempotency.Insert(rec)
+		switch {
+		case errors.Is(err, data.ErrDuplicateKey):
+			app.replayResponse(w, r, rec)
+			return
+		case err != nil:
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// Release the key unless the response is stored, also if the
+		// handler panics.
+		stored := false
+		defer func() {
+			if !stored {
+				if err := app.models.Idempotency.Delete(rec.Scope, rec.Key); err != nil {
+					app.logError(r, err)
+				}
+			}
+		}()
+
+		rw := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+		if rw.status < 200 || rw.status >= 300 {
+			return
+		}
+
+		rec.Status = rw.status
+		rec.ContentType = rw.Header().Get("Content-Type")
+		rec.Body = rw.body.Bytes()
+		// Responses which must not be stored, like new API keys, keep the
+		// key in use without being replayable.
+		rec.Stored = !strings.Contains(rw.Header().Get("Cache-Control"), "no-store")
+		err = app.models.Idempotency.Complete(rec)
+		if err != nil {
+			app.logError(r, err)
+			return
+		}
+		stored = true
+	})
+}
+
+// replayResponse answers a repeated request with the stored response of the
+// first request with the same key.
+func (app *application) replayResponse(w http.ResponseWriter, r *http.Request, rec *data.IdempotencyRecord) {
+	prev, err := app.models.Idempotency.Get(rec.Scope, rec.Key)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			// The first request failed or the key expired just now.
+			app.idempotencyConflictResponse(w, r, "the request with this Idempotency-Key is being processed, retry later")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	switch {
+	case prev.RequestHash != rec.RequestHash:
+		app.idempotencyKeyReusedResponse(w, r)
+	case prev.Status == 0:
+		app.idempotencyConflictResponse(w, r, "the request with this Idempotency-Key is being processed, retry later")
+	case !prev.Stored:
+		app.idempotencyConflictResponse(w, r, "the request with this Idempotency-Key was processed, its response can't be replayed")
+	default:
+		w.Header().Set("Content-Type", prev.ContentType)
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(prev.Status)
+		w.Write(prev.Body)
+	}
+}
+
+// responseRecorder passes the response through and keeps a copy of its status
+// and body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *responseRecorder) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseRecorder) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// sdListenFDsStart is the first file descriptor passed by systemd socket
+// activation, see sd_listen_fds(3).
+const sdListenFDsStart = 3
+
+// listen returns the listener the server accepts connections on. A socket
+// inherited through systemd socket activation takes precedence over a
+// configured Unix socket path, which takes precedence over the TCP port.
+func (app *application) listen() (net.Listener, error) {
+	ln, err := systemdListener()
+	if ln != nil || err != nil {
+		return ln, err
+	}
+
+	if len(app.config.listen.socket) > 0 {
+		// Remove a stale socket left behind by a previous run, bind fails
+		// otherwise.
+		err := os.Remove(app.config.listen.socket)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		ln, err := net.Listen("unix", app.config.listen.socket)
+		if err != nil {
+			return nil, err
+		}
+		err = os.Chmod(app.config.listen.socket, os.FileMode(app.config.listen.socketMode))
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		return ln, nil
+	}
+
+	return net.Listen("tcp", fmt.Sprintf(":%d", app.config.port))
+}
+
+// systemdListener returns the first socket passed by systemd, or nil if the
+// process wasn't socket activated. The environment variables are removed so
+// they aren't inherited by child processes.
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if n > 1 {
+		return nil, fmt.Errorf("systemd passed %d sockets, expected one", n)
+	}
+
+	f := os.NewFile(sdListenFDsStart, "LISTEN_FD_3")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// sdNotify sends a state change such as "READY=1" to the service manager
+// using the sd_notify protocol. It does nothing if NOTIFY_SOCKET is not set.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// A leading @ denotes a socket in the abstract namespace.
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListenUnixSocket(t *testing.T) {
+	app := newTestApp(t)
+	app.config.listen.socket = filepath.Join(t.TempDir(), "api.sock")
+	app.config.listen.socketMode = 0o600
+
+	// A stale socket file from an earlier run must not prevent binding.
+	err := os.WriteFile(app.config.listen.socket, nil, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := app.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: app.routes(), ErrorLog: log.New(io.Discard, "", 0)}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	fi, err := os.Stat(app.config.listen.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Type() != os.ModeSocket {
+		t.Errorf("want socket; got %s", fi.Mode())
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("want permissions %#o; got %#o", 0o600, fi.Mode().Perm())
+	}
+
+	c := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", app.config.listen.socket)
+		},
+	}}
+	rs, err := c.Get("http://localhost/healthz/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Body.Close()
+	if rs.StatusCode != http.StatusOK {
+		t.Errorf("want %d; got %d", http.StatusOK, rs.StatusCode)
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	t.Run("Not running under systemd", func(t *testing.T) {
+		t.Setenv("NOTIFY_SOCKET", "")
+		if err := sdNotify("READY=1"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Notify socket", func(t *testing.T) {
+		socket := filepath.Join(t.TempDir(), "notify.sock")
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		t.Setenv("NOTIFY_SOCKET", socket)
+
+		err = sdNotify("READY=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 64)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != "READY=1" {
+			t.Errorf("want %q; got %q", "READY=1", got)
+		}
+	})
+}
+
+func TestServeFailure(t *testing.T) {
+	app := newTestApp(t)
+	app.config.server.drainTimeout = 5 * time.Second
+	app.config.tls.cert = filepath.Join(t.TempDir(), "missing.pem")
+	app.config.tls.key = app.config.tls.cert
+	var stopped bool
+	app.background(func() {
+		<-app.shutdown
+		stopped = true
+	})
+
+	if err := app.serve(); err == nil {
+		t.Fatal("want error for the missing certificate")
+	}
+	if !stopped {
+		t.Error("want background tasks done when serve returns")
+	}
+}
+
+func TestServeRedirectPortInUse(t *testing.T) {
+	busy, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	free, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+
+	app := newTestApp(t)
+	app.config.port = port
+	app.config.server.drainTimeout = 5 * time.Second
+	app.config.tls.cert, app.config.tls.key = newTestCert(t, "localhost", nil, false).write(t, t.TempDir())
+	app.config.tls.redirectPort = busy.Addr().(*net.TCPAddr).Port
+
+	if err := app.serve(); err == nil {
+		t.Fatal("want error for the redirect port in use")
+	}
+	// The listener of the server is closed again.
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+}
@@ -3,73 +3,250 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"assecor.assessment.test/internal/data"
+	"assecor.assessment.test/internal/events"
+	"assecor.assessment.test/internal/jwt"
 	"assecor.assessment.test/internal/validator"
 	_ "github.com/duckdb/duckdb-go/v2"
 )
 
 const version = "1.0.0"
 
-type config struct {
-	port int
-	dsn  string
-}
-
 // Application struct to hold the dependencies for our HTTP handlers, helpers,
 // and middleware.
 type application struct {
 	config config
-	logger *log.Logger
+	logger *slog.Logger
 	models data.Models
+	// verifier checks bearer tokens, it is nil when no keys are configured
+	// and bearer tokens are rejected.
+	verifier *jwt.Verifier
+	started  time.Time
+	// postalCodesFailed is set if the postal code directory couldn't be
+	// loaded; the readiness probe fails then.
+	postalCodesFailed atomic.Bool
+	// imported is set once the startup CSV import has finished (or there was
+	// nothing to import) and is reported by the readiness probe.
+	imported atomic.Bool
+	// wg tracks the goroutines started by background().
+	wg sync.WaitGroup
+	// shutdown is closed when the server starts shutting down, periodic jobs
+	// and event streams stop then.
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+	// drained is closed when the requests and background tasks are done
+	// after the shutdown, the event consumers tracked by consumers stop then.
+	drained   chan struct{}
+	drainOnce sync.Once
+	consumers sync.WaitGroup
 }
 
 func main() {
-	var cfg config
-	flag.IntVar(&cfg.port, "port", 4000, "API server port")
-	flag.StringVar(&cfg.dsn, "dsn", "", "Data source name")
-	flag.Parse()
+	// "api config print [flags]" shows the effective configuration.
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "print" {
+		_, fs, err := loadConfig(os.Args[3:], os.LookupEnv)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		printConfig(os.Stdout, fs)
+		return
+	}
+
+	cfg, _, err := loadConfig(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
-	// Initialize a new logger which writes messages to the standard out stream,
-	// prefixed with the current date and time.
-	logger := log.New(os.Stdout, "", log.Ldate|log.Ltime)
+	// Initialize a new structured logger which writes messages at or above
+	// the configured level to the standard out stream.
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: cfg.log.level}))
 
 	db, err := openDB(cfg)
 	if err != nil {
-		logger.Fatal(err)
+		logger.Error(err.Error())
+		os.Exit(1)
 	}
 
-	defer db.Close()
-	logger.Printf("database connection established")
+	logger.Info("database connection established", "path", cfg.db.path)
 
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-	}
-	if len(cfg.dsn) > 0 {
-		v := validator.New()
-		app.models.LoadFromCsv(v, cfg.dsn)
-		if !v.Valid() {
-			for k, m := range v.Errors {
-				app.logger.Printf("[%s]: %s\n", k, m)
-			}
-		}
+		config:   cfg,
+		logger:   logger,
+		models:   data.NewModels(db, cfg.db.queryTimeout, events.NewBus(cfg.events.replay)),
+		started:  time.Now(),
+		shutdown: make(chan struct{}),
+		drained:  make(chan struct{}),
 	}
+	app.verifier, err = newVerifier(cfg)
+	if err == nil {
+		err = app.bootstrapAdmin()
+	}
+	if err != nil {
+		logger.Error(err.Error())
+		// The schema has been migrated, flush it before exiting.
+		closeDB(db, cfg.db.queryTimeout)
+		os.Exit(1)
+	}
+	// Subscribe to the events before the import publishes any.
+	app.runWebhooks()
+	// Import the postal code directory and the CSV file in the background so
+	// the liveness probe answers while large files are still being loaded;
+	// readiness is reported once the import has finished.
+	app.background(func() {
+		app.loadPostalCodes()
+		app.importCsv()
+	})
+	app.every(cfg.persons.purgeInterval, app.purgePersons)
+	app.every(time.Hour, app.deleteExpiredIdempotencyKeys)
 
 	err = app.serve()
+	// serve() only returns after the background tasks are done, also if it
+	// fails; flush the database to disk before closing it.
+	if err := closeDB(db, cfg.db.queryTimeout); err != nil {
+		logger.Error(err.Error())
+	}
 	if err != nil {
-		logger.Fatal(err)
+		logger.Error(err.Error())
+		os.Exit(1)
 	}
 }
 
-// Create internal database
-func openDB(_ config) (*sql.DB, error) {
-	db, err := sql.Open("duckdb", "")
+// bootstrapAdmin registers the configured admin API key unless it is
+// already known from an earlier run against the same database file. Without
+// an admin key it fails if authentication is enabled but no client could
+// authenticate, because there are neither bearer token keys nor API keys.
+func (app *application) bootstrapAdmin() error {
+	if len(app.config.auth.adminKey) == 0 {
+		if !app.config.auth.enabled || app.verifier != nil {
+			return nil
+		}
+		n, err := app.models.Users.Count()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return errors.New("auth-enabled requires auth-admin-key, jwt-jwks or jwt-pem, no API keys are stored yet")
+		}
+		return nil
+	}
+	_, err := app.models.Users.GetForKey(app.config.auth.adminKey)
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		return err
+	}
+	admin := &data.User{Name: "admin", Role: data.RoleAdmin}
+	return app.models.Users.Insert(admin, app.config.auth.adminKey)
+}
+
+// newVerifier loads the bearer token keys from the configured JWKS or PEM
+// file. Without a key file no verifier is created.
+func newVerifier(cfg config) (*jwt.Verifier, error) {
+	var keys *jwt.KeySet
+	var err error
+	switch {
+	case len(cfg.jwt.jwks) > 0:
+		keys, err = jwt.LoadJWKS(cfg.jwt.jwks)
+	case len(cfg.jwt.pem) > 0:
+		keys, err = jwt.LoadPEM(cfg.jwt.pem)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return jwt.NewVerifier(keys, cfg.jwt.issuer, cfg.jwt.audience), nil
+}
+
+// loadPostalCodes replaces the postal code directory with the configured
+// file. The CSV import checks cities against it, so it is loaded first.
+func (app *application) loadPostalCodes() {
+	if len(app.config.postal.directory) == 0 {
+		return
+	}
+	n, err := app.models.LoadPostalCodes(app.config.postal.directory, app.config.postal.country)
+	if err != nil {
+		app.postalCodesFailed.Store(true)
+		app.logger.Error("loading postal code directory failed", "file", app.config.postal.directory, "error", err.Error())
+		return
+	}
+	app.logger.Info("postal code directory loaded", "file", app.config.postal.directory, "entries", n)
+}
+
+// purgePersons permanently removes the persons deleted longer ago than the
+// retention.
+func (app *application) purgePersons() {
+	n, err := app.models.Persons.WithActor(data.ActorPurge).Purge(time.Now().Add(-app.config.persons.retention))
+	if err != nil {
+		app.logger.Error("purging deleted persons failed", "error", err.Error())
+		return
+	}
+	if n > 0 {
+		app.logger.Info("purged deleted persons", "count", n)
+	}
+}
+
+// deleteExpiredIdempotencyKeys removes the keys which can't be replayed
+// anymore.
+func (app *application) deleteExpiredIdempotencyKeys() {
+	if _, err := app.models.Idempotency.DeleteExpired(); err != nil {
+		app.logger.Warn("removing expired idempotency keys failed", "error", err.Error())
+	}
+}
+
+// importCsv loads the persons from the configured CSV file and marks the
+// application as ready afterwards.
+func (app *application) importCsv() {
+	defer app.imported.Store(true)
+
+	if len(app.config.dsn) == 0 {
+		return
+	}
+	opts := data.CsvOptions{
+		LazyQuotes:  app.config.csv.lazyQuotes,
+		Country:     app.config.csv.country,
+		PostalCheck: app.config.postal.check,
+		Duplicates:  app.config.csv.duplicates,
+		Source:      app.config.csv.source,
+	}
+	opts.Comma, _ = utf8.DecodeRuneInString(app.config.csv.comma)
+	if len(app.config.csv.comment) > 0 {
+		opts.Comment, _ = utf8.DecodeRuneInString(app.config.csv.comment)
+	}
+
+	v := validator.New()
+	app.models.LoadFromCsv(v, app.config.dsn, opts)
+	errCount := 0
+	for k, errs := range v.Errors {
+		for _, e := range errs {
+			app.logger.Warn(e.Message, "key", k)
+			errCount++
+		}
+	}
+	app.logger.Info("csv import finished", "file", app.config.dsn)
+	app.models.Events.Publish(data.EventImportCompleted, map[string]interface{}{
+		"file":   app.config.dsn,
+		"errors": errCount,
+	})
+}
+
+// Open the DuckDB database, in-memory unless a file path is configured, and
+// create the schema if it doesn't exist yet.
+func openDB(cfg config) (*sql.DB, error) {
+	db, err := sql.Open("duckdb", cfg.db.path)
 	if err != nil {
 		return nil, err
 	}
@@ -80,21 +257,23 @@ func openDB(_ config) (*sql.DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	query := `
-		CREATE SEQUENCE seq_personid START 1;
-		CREATE TABLE IF NOT EXISTS persons (
-			id INTEGER PRIMARY KEY DEFAULT NEXTVAL('seq_personid'),	
-			name TEXT NOT NULL,
-			lastname TEXT NOT NULL,
-			zipcode TEXT NOT NULL,
-			city TEXT NOT NULL,
-			color INTEGER NOT NULL)`
+
 	ctxDB, cancelDB := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancelDB()
-	_, err = db.ExecContext(ctxDB, query)
+	err = data.Migrate(ctxDB, db)
 	if err != nil {
 		db.Close()
 		return nil, err
 	}
 	return db, nil
 }
+
+// closeDB writes the DuckDB write-ahead log into the database file and
+// closes the connection pool.
+func closeDB(db *sql.DB, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, "CHECKPOINT")
+	return errors.Join(err, db.Close())
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"assecor.assessment.test/internal/data"
+	"assecor.assessment.test/internal/jwt"
+)
+
+func TestImportCsv(t *testing.T) {
+	app := newTestApp(t)
+	app.config.dsn = filepath.Join(t.TempDir(), "persons.csv")
+	app.config.csv.comma = ","
+	app.config.csv.country = "DE"
+	err := os.WriteFile(app.config.dsn, []byte(`Müller, Hans, 67742 Lauterecken, 1
+Schmidt, Anna, 10115Berlin, 2
+Bart, Bertram,
+12313 Wasweißich, 1
+Gruber, Franz, 1010 Wien, 2, AT
+de Vries, Jan, 1234 AB Amsterdam, 3, nl
+Smith, John, SW1A 1AA London, 4, GB
+Huber, Sepp, 1010 Wien, 5
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app.importCsv()
+	if !app.imported.Load() {
+		t.Error("want import marked as finished")
+	}
+
+	persons, err := app.models.Persons.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		zipcode, city, country string
+	}{
+		{"67742", "Lauterecken", "DE"},
+		{"10115", "Berlin", "DE"},
+		{"1010", "Wien", "AT"},
+		{"1234 AB", "Amsterdam", "NL"},
+		{"SW1A 1AA", "London", "GB"},
+	}
+	if len(persons) != len(want) {
+		t.Fatalf("want %d persons; got %d", len(want), len(persons))
+	}
+	for i, w := range want {
+		p := persons[i]
+		if p.Zipcode != w.zipcode || p.City != w.city || p.Country != w.country {
+			t.Errorf("Item[%d] want %s/%s/%s; got %s/%s/%s", i,
+				w.zipcode, w.city, w.country, p.Zipcode, p.City, p.Country)
+		}
+	}
+}
+
+func TestImportCsvPostalCheck(t *testing.T) {
+	app := newTestApp(t)
+	app.config.dsn = "../sample-input.csv"
+	app.config.csv.comma = ","
+	app.config.csv.country = "DE"
+	app.config.postal.directory = "../sample-postal-codes.tab"
+	app.config.postal.country = "DE"
+	app.config.postal.check = data.PostalCheckReject
+
+	app.loadPostalCodes()
+	cities, err := app.models.PostalCodes.Cities("DE", "67742")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cities) != 2 {
+		t.Fatalf("want 2 cities of 67742; got %v", cities)
+	}
+
+	app.importCsv()
+	persons, err := app.models.Persons.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only Lauterecken and Stralsund are in the directory.
+	if len(persons) != 2 {
+		t.Fatalf("want 2 persons; got %d", len(persons))
+	}
+	if persons[0].City != "Lauterecken" || persons[1].City != "Stralsund" {
+		t.Errorf("want Lauterecken and Stralsund; got %s and %s", persons[0].City, persons[1].City)
+	}
+}
+
+func TestImportCsvDuplicates(t *testing.T) {
+	tests := []struct {
+		mode      string
+		wantCount int
+		wantColor int
+	}{
+		{data.DuplicatesInsert, 4, 1},
+		{data.DuplicatesSkip, 3, 1},
+		{data.DuplicatesUpdate, 3, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			app := newTestApp(t)
+			app.config.dsn = filepath.Join(t.TempDir(), "persons.csv")
+			app.config.csv.comma = ","
+			app.config.csv.duplicates = tt.mode
+			err := os.WriteFile(app.config.dsn, []byte(`Müller, Hans, 67742 Lauterecken, 1
+Petersen, Peter, 18439 Stralsund, 2
+Mueller, Hans, 67742 Lauterecken, 4
+Müller, Hana, 67742 Lauterecken, 5
+`), 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			app.importCsv()
+			persons, err := app.models.Persons.GetAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(persons) != tt.wantCount {
+				t.Fatalf("want %d persons; got %d", tt.wantCount, len(persons))
+			}
+			if persons[0].Color != tt.wantColor {
+				t.Errorf("want color %d of the first person; got %d", tt.wantColor, persons[0].Color)
+			}
+			// Hana differs from Hans by a typo only, but is somebody else.
+			if last := persons[len(persons)-1]; last.Name != "Hana" || last.Color != 5 {
+				t.Errorf("want Hana inserted; got %+v", last)
+			}
+		})
+	}
+}
+
+func TestImportCsvSource(t *testing.T) {
+	app := newTestApp(t)
+	app.config.dsn = filepath.Join(t.TempDir(), "persons.csv")
+	app.config.csv.comma = ","
+	app.config.csv.source = "crm"
+
+	for _, content := range []string{
+		`Müller, Hans, 67742 Lauterecken, 1, , 1
+Petersen, Peter, 18439 Stralsund, 2, DE, 2
+Johnson, Johnny, 88888 made up, 3
+`,
+		`Müller, Hans, 67742 Lauterecken, 5, , 1
+Petersen, Peter, 18435 Stralsund, 2, DE, 2
+`,
+	} {
+		if err := os.WriteFile(app.config.dsn, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		app.importCsv()
+	}
+
+	persons, err := app.models.Persons.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(persons) != 3 {
+		t.Fatalf("want 3 persons; got %d", len(persons))
+	}
+	if persons[0].ExternalID != "1" || persons[0].Color != 5 {
+		t.Errorf("want external ID 1 with color 5; got %+v", persons[0])
+	}
+	if persons[1].ExternalID != "2" || persons[1].Zipcode != "18435" {
+		t.Errorf("want external ID 2 with zipcode 18435; got %+v", persons[1])
+	}
+	if persons[2].Source != "" {
+		t.Errorf("want person without external ID; got %+v", persons[2])
+	}
+}
+
+func TestPurgePersons(t *testing.T) {
+	app := newTestApp(t)
+	app.config.persons.retention = time.Hour
+	for _, p := range []data.Person{
+		{Name: "Hans", Lastname: "Müller", Zipcode: "67742", City: "Lauterecken", Country: "DE", Color: 1},
+		{Name: "Peter", Lastname: "Petersen", Zipcode: "18439", City: "Stralsund", Country: "DE", Color: 2},
+	} {
+		if err := app.models.Persons.Insert(&p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := app.models.Persons.Delete(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Within the retention the deleted person is kept.
+	app.purgePersons()
+	persons, err := app.models.Persons.GetAllIncludingDeleted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(persons) != 2 {
+		t.Fatalf("want 2 persons; got %d", len(persons))
+	}
+
+	app.config.persons.retention = 0
+	app.purgePersons()
+	persons, err = app.models.Persons.GetAllIncludingDeleted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(persons) != 1 || persons[0].ID != 2 {
+		t.Errorf("want person 2 left; got %d persons", len(persons))
+	}
+	if err := app.models.Persons.Restore(1); !errors.Is(err, data.ErrRecordNotFound) {
+		t.Errorf("want %v; got %v", data.ErrRecordNotFound, err)
+	}
+	events, err := app.models.Audit.GetAllForPerson(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := events[len(events)-1]; last.Operation != data.AuditPurge || last.Actor != data.ActorPurge {
+		t.Errorf("want purge by %s; got %s by %s", data.ActorPurge, last.Operation, last.Actor)
+	}
+	for _, e := range events {
+		if c := e.Changes["lastname"]; c.Before != nil || c.After != nil {
+			t.Errorf("want lastname redacted from %s; got %v", e.Operation, c)
+		}
+	}
+}
+
+func TestBootstrapAdmin(t *testing.T) {
+	tests := []struct {
+		name        string
+		authEnabled bool
+		adminKey    string
+		verifier    bool
+		storedKey   bool
+		wantErr     bool
+	}{
+		{"Auth disabled", false, "", false, false, false},
+		{"Admin key", true, "secret", false, false, false},
+		{"Bearer tokens", true, "", true, false, false},
+		{"Stored API key", true, "", false, true, false},
+		{"No way to authenticate", true, "", false, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			app.config.auth.enabled = tt.authEnabled
+			app.config.auth.adminKey = tt.adminKey
+			if tt.verifier {
+				app.verifier = jwt.NewVerifier(nil, "", "")
+			}
+			if tt.storedKey {
+				err := app.models.Users.Insert(&data.User{Name: "dashboard", Role: data.RoleReader}, "key")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := app.bootstrapAdmin()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("want error %t; got %v", tt.wantErr, err)
+			}
+			if tt.adminKey == "" {
+				return
+			}
+			user, err := app.models.Users.GetForKey(tt.adminKey)
+			if err != nil || user.Role != data.RoleAdmin {
+				t.Errorf("want admin for the key; got %+v, %v", user, err)
+			}
+		})
+	}
+}
@@ -1,8 +1,16 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"assecor.assessment.test/internal/data"
 )
 
 func (app *application) recoverPanic(next http.Handler) http.Handler {
@@ -25,3 +33,181 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// authenticate identifies the client either by the API key sent in the
+// X-API-Key header or by a bearer token in the Authorization header and
+// stores it in the request context. Requests without credentials are treated
+// as anonymous.
+//
+// The rate limiter only knows the client after authentication, so failed
+// authentications are limited separately by IP address, with a much smaller
+// budget than the requests: once a client used up its burst of invalid
+// credentials, its credentials aren't even checked anymore until the bucket
+// has refilled.
+func (app *application) authenticate(next http.Handler) http.Handler {
+	var failures *rateLimiter
+	if app.config.auth.failuresPerMinute > 0 {
+		failures = newRateLimiter(app.config.auth.failuresPerMinute/60, app.config.auth.failuresBurst)
+		// Slowly refilled buckets are only dropped once they are full.
+		refill := failures.duration(float64(failures.burst))
+		app.every(time.Minute, func() {
+			failures.cleanup(refill, time.Now())
+		})
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "X-API-Key")
+
+		authorization, apiKey := r.Header.Get("Authorization"), r.Header.Get("X-API-Key")
+		ip := "ip:" + app.clientIP(r)
+		if failures != nil && (authorization != "" || apiKey != "") {
+			if res := failures.check(ip, time.Now()); !res.allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(res.retryAfter.Seconds()))))
+				app.rateLimitExceededResponse(w, r)
+				return
+			}
+		}
+		failed := func() {
+			if failures != nil {
+				failures.allow(ip, time.Now())
+			}
+		}
+
+		if authorization != "" {
+			token, ok := strings.CutPrefix(authorization, "Bearer ")
+			if !ok || app.verifier == nil {
+				failed()
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+			claims, err := app.verifier.Verify(token)
+			if err != nil {
+				failed()
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+			user := &data.User{Name: claims.Subject}
+			r = app.contextSetUser(r, user, claims.Scopes)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if apiKey == "" {
+			r = app.contextSetUser(r, data.AnonymousUser, nil)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, err := app.models.Users.GetForKey(apiKey)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				failed()
+				app.invalidAPIKeyResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		r = app.contextSetUser(r, user, user.Role.Scopes())
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireScope only calls the next handler if the authenticated user was
+// granted the scope, either through the role of its API key or by its bearer
+// token. When authentication is disabled every request is let through.
+func (app *application) requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !app.config.auth.enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+		user := app.contextGetUser(r)
+		if user.IsAnonymous() {
+			app.authenticationRequiredResponse(w, r)
+			return
+		}
+		if !app.contextHasScope(r, scope) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// rateLimit limits the number of requests per client with a token bucket.
+// Authenticated clients are identified by their API key or token subject,
+// everybody else by IP address.
+func (app *application) rateLimit(next http.Handler) http.Handler {
+	if !app.config.limiter.enabled {
+		return next
+	}
+	limiter := newRateLimiter(app.config.limiter.rps, app.config.limiter.burst)
+
+	// Remove the buckets of clients which haven't been seen for a while in the
+	// background.
+	app.every(time.Minute, func() {
+		limiter.cleanup(3*time.Minute, time.Now())
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := userKey(app.contextGetUser(r))
+		if key == "" {
+			key = "ip:" + app.clientIP(r)
+		}
+
+		res := limiter.allow(key, time.Now())
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(app.config.limiter.burst))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(res.reset.Seconds()))))
+		if !res.allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(res.retryAfter.Seconds()))))
+			app.rateLimitExceededResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// userKey identifies an authenticated client by its API key or token
+// subject; it is empty for anonymous clients.
+func userKey(user *data.User) string {
+	switch {
+	case user.IsAnonymous():
+		return ""
+	case user.ID > 0:
+		return "key:" + strconv.FormatInt(user.ID, 10)
+	default:
+		return "sub:" + user.Name
+	}
+}
+
+// enableCORS allows browser-based front-ends served from one of the trusted
+// origins to call the API and answers their preflight requests.
+func (app *application) enableCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The response depends on the origin and, for preflight requests, on
+		// the requested method, so caches must keep them apart.
+		w.Header().Add("Vary", "Origin")
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+
+		origin := r.Header.Get("Origin")
+		if origin != "" && slices.Contains(app.config.cors.trustedOrigins, origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+
+			// A preflight request is an OPTIONS request carrying the method
+			// of the actual request in Access-Control-Request-Method.
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Idempotency-Key, If-Modified-Since, Last-Event-ID, X-API-Key")
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(app.config.cors.maxAge.Seconds())))
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			w.Header().Set("Access-Control-Expose-Headers", "Idempotent-Replayed, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, Retry-After")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"assecor.assessment.test/internal/data"
+	"assecor.assessment.test/internal/jwt"
+)
+
+func TestAuthentication(t *testing.T) {
+	app := newTestApp(t)
+	app.config.auth.enabled = true
+
+	keys := map[data.Role]string{}
+	for _, role := range []data.Role{data.RoleReader, data.RoleWriter, data.RoleAdmin} {
+		key, err := data.GenerateAPIKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = app.models.Users.Insert(&data.User{Name: string(role), Role: role}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[role] = key
+	}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	person := writeJSON(t, map[string]interface{}{
+		"name":     "Hans",
+		"lastname": "Müller",
+		"zipcode":  "67742",
+		"city":     "Lauterecken",
+		"color":    int(data.Blue),
+	})
+	apiKey := writeJSON(t, map[string]interface{}{
+		"name": "dashboard",
+		"role": data.RoleReader,
+	})
+
+	tests := []struct {
+		name     string
+		method   string
+		urlPath  string
+		apiKey   string
+		body     []byte
+		wantCode int
+	}{
+		{"Health without key", http.MethodGet, "/healthz/live", "", nil, http.StatusOK},
+		{"List without key", http.MethodGet, "/persons", "", nil, http.StatusUnauthorized},
+		{"List with unknown key", http.MethodGet, "/persons", "foo", nil, http.StatusUnauthorized},
+		{"List as reader", http.MethodGet, "/persons", keys[data.RoleReader], nil, http.StatusOK},
+		{"List deleted as writer", http.MethodGet, "/persons?include_deleted=true", keys[data.RoleWriter], nil, http.StatusForbidden},
+		{"List deleted as admin", http.MethodGet, "/persons?include_deleted=true", keys[data.RoleAdmin], nil, http.StatusOK},
+		{"Show as reader", http.MethodGet, "/persons/1", keys[data.RoleReader], nil, http.StatusNotFound},
+		{"Create as reader", http.MethodPost, "/persons", keys[data.RoleReader], person, http.StatusForbidden},
+		{"Create as writer", http.MethodPost, "/persons", keys[data.RoleWriter], person, http.StatusCreated},
+		{"Create as admin", http.MethodPost, "/persons", keys[data.RoleAdmin], person, http.StatusCreated},
+		{"Audit as writer", http.MethodGet, "/audit", keys[data.RoleWriter], nil, http.StatusForbidden},
+		{"Audit as admin", http.MethodGet, "/audit", keys[data.RoleAdmin], nil, http.StatusOK},
+		{"History as reader", http.MethodGet, "/persons/1/history", keys[data.RoleReader], nil, http.StatusForbidden},
+		{"History as writer", http.MethodGet, "/persons/1/history", keys[data.RoleWriter], nil, http.StatusForbidden},
+		{"History as admin", http.MethodGet, "/persons/1/history", keys[data.RoleAdmin], nil, http.StatusOK},
+		{"New key as writer", http.MethodPost, "/api-keys", keys[data.RoleWriter], apiKey, http.StatusForbidden},
+		{"New key as admin", http.MethodPost, "/api-keys", keys[data.RoleAdmin], apiKey, http.StatusCreated},
+		{"WebSocket without upgrade as reader", http.MethodGet, "/ws", keys[data.RoleReader], nil, http.StatusUpgradeRequired},
+		{"Webhooks as writer", http.MethodGet, "/webhooks", keys[data.RoleWriter], nil, http.StatusForbidden},
+		{"Webhooks as admin", http.MethodGet, "/webhooks", keys[data.RoleAdmin], nil, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{}
+			if tt.apiKey != "" {
+				headers.Set("X-API-Key", tt.apiKey)
+			}
+			code, header, _ := ts.do(t, tt.method, tt.urlPath, headers, tt.body)
+
+			if code != tt.wantCode {
+				t.Fatalf("want %d; got %d", tt.wantCode, code)
+			}
+			if code == http.StatusUnauthorized && header.Get("WWW-Authenticate") == "" {
+				t.Error("want WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestCreateAPIKey(t *testing.T) {
+	app := newTestApp(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	tests := []struct {
+		name     string
+		role     data.Role
+		wantCode int
+	}{
+		{"Reader", data.RoleReader, http.StatusCreated},
+		{"Writer", data.RoleWriter, http.StatusCreated},
+		{"Unknown role", data.Role("root"), http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, body := ts.post(t, "/api-keys", writeJSON(t, map[string]interface{}{
+				"name": "client",
+				"role": tt.role,
+			}))
+			if code != tt.wantCode {
+				t.Fatalf("want %d; got %d", tt.wantCode, code)
+			}
+			if code != http.StatusCreated {
+				return
+			}
+			var resp struct {
+				User   data.User `json:"user"`
+				APIKey string    `json:"api_key"`
+			}
+			readJSON(t, body, &resp)
+
+			user, err := app.models.Users.GetForKey(resp.APIKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.Role != tt.role {
+				t.Errorf("want Role %s; got %s", tt.role, user.Role)
+			}
+		})
+	}
+}
+
+func TestBearerAuthentication(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := writeJWKS(t, map[string]interface{}{"rsa": &rsaKey.PublicKey, "ec": &ecKey.PublicKey})
+
+	app := newTestApp(t)
+	app.config.auth.enabled = true
+	app.verifier = jwt.NewVerifier(keys, "https://gateway.example", "assecor-api")
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	now := time.Now().Unix()
+	valid := map[string]interface{}{
+		"sub":   "dashboard",
+		"iss":   "https://gateway.example",
+		"aud":   []string{"assecor-api", "other"},
+		"exp":   now + 60,
+		"nbf":   now - 60,
+		"scope": "persons:read persons:write",
+	}
+	with := func(key string, value interface{}) map[string]interface{} {
+		claims := map[string]interface{}{}
+		for k, v := range valid {
+			claims[k] = v
+		}
+		claims[key] = value
+		return claims
+	}
+	person := writeJSON(t, map[string]interface{}{
+		"name":     "Hans",
+		"lastname": "Müller",
+		"zipcode":  "67742",
+		"city":     "Lauterecken",
+		"color":    int(data.Blue),
+	})
+
+	tests := []struct {
+		name     string
+		token    string
+		method   string
+		body     []byte
+		wantCode int
+	}{
+		{"RS256", signJWT(t, "RS256", "rsa", rsaKey, valid), http.MethodGet, nil, http.StatusOK},
+		{"ES256", signJWT(t, "ES256", "ec", ecKey, valid), http.MethodGet, nil, http.StatusOK},
+		{"Write scope", signJWT(t, "ES256", "ec", ecKey, valid), http.MethodPost, person, http.StatusCreated},
+		{"Missing write scope", signJWT(t, "ES256", "ec", ecKey, with("scope", "persons:read")),
+			http.MethodPost, person, http.StatusForbidden},
+		{"Scopes as scp array", signJWT(t, "ES256", "ec", ecKey, with("scp", []string{"persons:write"})),
+			http.MethodPost, person, http.StatusCreated},
+		{"Unknown key", signJWT(t, "ES256", "", otherKey, valid), http.MethodGet, nil, http.StatusUnauthorized},
+		{"Key id mismatch", signJWT(t, "RS256", "ec", rsaKey, valid), http.MethodGet, nil, http.StatusUnauthorized},
+		{"Expired", signJWT(t, "ES256", "ec", ecKey, with("exp", now-120)), http.MethodGet, nil, http.StatusUnauthorized},
+		{"Missing sub", signJWT(t, "ES256", "ec", ecKey, with("sub", nil)), http.MethodGet, nil, http.StatusUnauthorized},
+		{"Empty sub", signJWT(t, "ES256", "ec", ecKey, with("sub", "")), http.MethodGet, nil, http.StatusUnauthorized},
+		{"Missing exp", signJWT(t, "ES256", "ec", ecKey, with("exp", nil)), http.MethodGet, nil, http.StatusUnauthorized},
+		{"Not yet valid", signJWT(t, "ES256", "ec", ecKey, with("nbf", now+120)), http.MethodGet, nil, http.StatusUnauthorized},
+		{"Wrong issuer", signJWT(t, "ES256", "ec", ecKey, with("iss", "evil")), http.MethodGet, nil, http.StatusUnauthorized},
+		{"Wrong audience", signJWT(t, "ES256", "ec", ecKey, with("aud", "other")), http.MethodGet, nil, http.StatusUnauthorized},
+		{"Unsigned", signJWT(t, "none", "", nil, valid), http.MethodGet, nil, http.StatusUnauthorized},
+		{"Malformed", "foo.bar", http.MethodGet, nil, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{}
+			headers.Set("Authorization", "Bearer "+tt.token)
+			code, header, _ := ts.do(t, tt.method, "/persons", headers, tt.body)
+
+			if code != tt.wantCode {
+				t.Fatalf("want %d; got %d", tt.wantCode, code)
+			}
+			if code == http.StatusUnauthorized && header.Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("want WWW-Authenticate %s; got %s", "Bearer", header.Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	app := newTestApp(t)
+	app.config.limiter.enabled = true
+	app.config.limiter.rps = 0.01
+	app.config.limiter.burst = 2
+	app.config.limiter.trustedProxies = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	tests := []struct {
+		name          string
+		forwardedFor  string
+		wantCode      int
+		wantRemaining string
+	}{
+		{"First request", "", http.StatusOK, "1"},
+		{"Second request", "", http.StatusOK, "0"},
+		{"Burst exceeded", "", http.StatusTooManyRequests, "0"},
+		{"Other client behind proxy", "203.0.113.7", http.StatusOK, "1"},
+		{"Spoofed hop before client", "10.0.0.1, 203.0.113.7", http.StatusOK, "0"},
+		{"Client behind proxy exceeded", "203.0.113.7", http.StatusTooManyRequests, "0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{}
+			if tt.forwardedFor != "" {
+				headers.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			code, header, _ := ts.do(t, http.MethodGet, "/healthz/live", headers, nil)
+
+			if code != tt.wantCode {
+				t.Fatalf("want %d; got %d", tt.wantCode, code)
+			}
+			if header.Get("RateLimit-Limit") != "2" {
+				t.Errorf("want RateLimit-Limit %s; got %s", "2", header.Get("RateLimit-Limit"))
+			}
+			if header.Get("RateLimit-Remaining") != tt.wantRemaining {
+				t.Errorf("want RateLimit-Remaining %s; got %s", tt.wantRemaining, header.Get("RateLimit-Remaining"))
+			}
+			if code == http.StatusTooManyRequests && header.Get("Retry-After") == "" {
+				t.Error("want Retry-After header")
+			}
+		})
+	}
+}
+
+func TestAuthenticationFailureLimit(t *testing.T) {
+	app := newTestApp(t)
+	app.config.auth.enabled = true
+	app.config.auth.failuresPerMinute = 1
+	app.config.auth.failuresBurst = 2
+	// The request limiter has a far larger budget than the failures.
+	app.config.limiter.enabled = true
+	app.config.limiter.rps = 100
+	app.config.limiter.burst = 100
+	app.config.limiter.trustedProxies = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+
+	key, err := data.GenerateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.models.Users.Insert(&data.User{Name: "reader", Role: data.RoleReader}, key); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	tests := []struct {
+		name          string
+		forwardedFor  string
+		apiKey        string
+		authorization string
+		wantCode      int
+	}{
+		{"Invalid key", "", "wrong", "", http.StatusUnauthorized},
+		{"Invalid token", "", "", "Bearer wrong", http.StatusUnauthorized},
+		{"Too many failures", "", "wrong", "", http.StatusTooManyRequests},
+		{"Valid key after failures", "", key, "", http.StatusTooManyRequests},
+		{"Without credentials", "", "", "", http.StatusOK},
+		{"Valid key of other client", "203.0.113.7", key, "", http.StatusOK},
+		{"Invalid key of other client", "203.0.113.7", "wrong", "", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{}
+			if tt.forwardedFor != "" {
+				headers.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			if tt.apiKey != "" {
+				headers.Set("X-API-Key", tt.apiKey)
+			}
+			if tt.authorization != "" {
+				headers.Set("Authorization", tt.authorization)
+			}
+			code, header, _ := ts.do(t, http.MethodGet, "/healthz/live", headers, nil)
+			if code != tt.wantCode {
+				t.Fatalf("want %d; got %d", tt.wantCode, code)
+			}
+			if code == http.StatusTooManyRequests && header.Get("Retry-After") == "" {
+				t.Error("want Retry-After header")
+			}
+		})
+	}
+}
+
+func TestAuthenticationFailureLimitWithoutLimiter(t *testing.T) {
+	app := newTestApp(t)
+	app.config.auth.enabled = true
+	app.config.auth.failuresPerMinute = 1
+	app.config.auth.failuresBurst = 2
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	headers := http.Header{}
+	headers.Set("X-API-Key", "wrong")
+	for i, want := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		code, _, _ := ts.do(t, http.MethodGet, "/healthz/live", headers, nil)
+		if code != want {
+			t.Fatalf("request %d: want %d; got %d", i+1, want, code)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	app := newTestApp(t)
+	app.config.limiter.trustedProxies = []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.0.2.1/32"),
+	}
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor string
+		want         string
+	}{
+		{"Direct client", "198.51.100.1:1234", "", "198.51.100.1"},
+		{"Untrusted proxy", "198.51.100.1:1234", "203.0.113.7", "198.51.100.1"},
+		{"Trusted proxy", "192.0.2.1:1234", "203.0.113.7", "203.0.113.7"},
+		{"Proxy chain", "10.0.0.2:1234", "203.0.113.7, 10.0.0.5", "203.0.113.7"},
+		{"Spoofed header", "10.0.0.2:1234", "1.2.3.4, 203.0.113.7", "203.0.113.7"},
+		{"Invalid hop", "10.0.0.2:1234", "foo, 10.0.0.5", "10.0.0.5"},
+		{"Unix socket peer", "@", "203.0.113.7", "203.0.113.7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwardedFor != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			if got := app.clientIP(r); got != tt.want {
+				t.Errorf("want %s; got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCORS(t *testing.T) {
+	app := newTestApp(t)
+	app.config.cors.trustedOrigins = []string{"https://dashboard.example"}
+	app.config.cors.maxAge = 10 * time.Minute
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	tests := []struct {
+		name          string
+		method        string
+		origin        string
+		requestMethod string
+		wantCode      int
+		wantOrigin    string
+		wantMethods   bool
+	}{
+		{"Trusted origin", http.MethodGet, "https://dashboard.example", "", http.StatusOK, "https://dashboard.example", false},
+		{"Untrusted origin", http.MethodGet, "https://evil.example", "", http.StatusOK, "", false},
+		{"No origin", http.MethodGet, "", "", http.StatusOK, "", false},
+		{"Preflight", http.MethodOptions, "https://dashboard.example", http.MethodPost, http.StatusNoContent, "https://dashboard.example", true},
+		{"Untrusted preflight", http.MethodOptions, "https://evil.example", http.MethodPost, http.StatusOK, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{}
+			if tt.origin != "" {
+				headers.Set("Origin", tt.origin)
+			}
+			if tt.requestMethod != "" {
+				headers.Set("Access-Control-Request-Method", tt.requestMethod)
+			}
+			code, header, _ := ts.do(t, tt.method, "/persons", headers, nil)
+
+			if code != tt.wantCode {
+				t.Fatalf("want %d; got %d", tt.wantCode, code)
+			}
+			if got := header.Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("want Access-Control-Allow-Origin %q; got %q", tt.wantOrigin, got)
+			}
+			if !slices.Contains(header.Values("Vary"), "Origin") {
+				t.Errorf("want Vary Origin; got %v", header.Values("Vary"))
+			}
+			if tt.wantMethods {
+				if header.Get("Access-Control-Allow-Methods") == "" {
+					t.Error("want Access-Control-Allow-Methods header")
+				}
+				if header.Get("Access-Control-Max-Age") != "600" {
+					t.Errorf("want Access-Control-Max-Age %s; got %s", "600", header.Get("Access-Control-Max-Age"))
+				}
+			}
+		})
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	app := newTestApp(t)
+	app.config.idempotency.ttl = time.Hour
+	app.config.limiter.trustedProxies = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	person := func(name string) []byte {
+		return writeJSON(t, map[string]interface{}{
+			"name":     name,
+			"lastname": "Müller",
+			"zipcode":  "67742",
+			"city":     "Lauterecken",
+			"color":    1,
+		})
+	}
+	// a request which is still being processed
+	err := app.models.Idempotency.Insert(&data.IdempotencyRecord{
+		Scope:       "anonymous:127.0.0.1",
+		Key:         "in-progress",
+		RequestHash: fmt.Sprintf("%x", sha256.Sum256(append([]byte("POST /persons\n"), person("Hans")...))),
+		ExpiresAt:   time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		method       string
+		urlPath      string
+		key          string
+		body         []byte
+		wantCode     int
+		wantReplayed bool
+		wantID       int64
+		forwardedFor string
+	}{
+		{"First request", http.MethodPost, "/persons", "k1", person("Hans"), http.StatusCreated, false, 1, ""},
+		{"Repeated request", http.MethodPost, "/persons", "k1", person("Hans"), http.StatusCreated, true, 1, ""},
+		{"Other anonymous client", http.MethodPost, "/persons", "k1", person("Hans"), http.StatusCreated, false, 2, "203.0.113.7"},
+		{"Different body", http.MethodPost, "/persons", "k1", person("Jonas"), http.StatusUnprocessableEntity, false, 0, ""},
+		{"Different path", http.MethodPost, "/api-keys", "k1", person("Hans"), http.StatusUnprocessableEntity, false, 0, ""},
+		{"Other key", http.MethodPost, "/persons", "k2", person("Hans"), http.StatusCreated, false, 3, ""},
+		{"Without key", http.MethodPost, "/persons", "", person("Hans"), http.StatusCreated, false, 4, ""},
+		{"Failed request", http.MethodPost, "/persons", "k3", person(""), http.StatusUnprocessableEntity, false, 0, ""},
+		{"Retry of failed request", http.MethodPost, "/persons", "k3", person("Hans"), http.StatusCreated, false, 5, ""},
+		{"In progress", http.MethodPost, "/persons", "in-progress", person("Hans"), http.StatusConflict, false, 0, ""},
+		{"Key too long", http.MethodPost, "/persons", strings.Repeat("k", 256), person("Hans"), http.StatusBadRequest, false, 0, ""},
+		{"API key", http.MethodPost, "/api-keys", "k4", []byte(`{"name": "client", "role": "reader"}`), http.StatusCreated, false, 0, ""},
+		{"Repeated API key", http.MethodPost, "/api-keys", "k4", []byte(`{"name": "client", "role": "reader"}`), http.StatusConflict, false, 0, ""},
+		{"GET ignores key", http.MethodGet, "/persons/1", "k1", nil, http.StatusOK, false, 1, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{}
+			if tt.key != "" {
+				headers.Set("Idempotency-Key", tt.key)
+			}
+			if tt.forwardedFor != "" {
+				headers.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			code, header, body := ts.do(t, tt.method, tt.urlPath, headers, tt.body)
+			if code != tt.wantCode {
+				t.Fatalf("want %d; got %d: %s", tt.wantCode, code, body)
+			}
+			if replayed := header.Get("Idempotent-Replayed") == "true"; replayed != tt.wantReplayed {
+				t.Errorf("want replayed %t; got %t", tt.wantReplayed, replayed)
+			}
+			if tt.wantID == 0 {
+				return
+			}
+			var resp struct {
+				ID int64 `json:"id"`
+			}
+			if err := json.Unmarshal(body, &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.ID != tt.wantID {
+				t.Errorf("want ID %d; got %d", tt.wantID, resp.ID)
+			}
+		})
+	}
+
+	persons, err := app.models.Persons.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(persons) != 5 {
+		t.Errorf("want 5 persons; got %d", len(persons))
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bucket is a token bucket which is refilled with rps tokens per second up
+// to burst tokens.
+type bucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+type rateLimiter struct {
+	mu      sync.Mutex
+	rps     float64
+	burst   int
+	buckets map[string]*bucket
+}
+
+// limiterResult describes the state of a client bucket after a request.
+type limiterResult struct {
+	allowed    bool
+	remaining  int
+	reset      time.Duration // until the bucket is full again
+	retryAfter time.Duration // until the next token is available
+}
+
+func newRateLimiter(rps float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rps:     rps,
+		burst:   burst,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow takes a token from the bucket of the client, creating a full
+// bucket for clients we haven't seen before.
+func (l *rateLimiter) allow(key string, now time.Time) limiterResult {
+	return l.take(key, now, true)
+}
+
+// check reports whether the bucket of the client has a token left without
+// taking it.
+func (l *rateLimiter) check(key string, now time.Time) limiterResult {
+	return l.take(key, now, false)
+}
+
+func (l *rateLimiter) take(key string, now time.Time, take bool) limiterResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, found := l.buckets[key]
+	if !found {
+		b = &bucket{tokens: float64(l.burst), lastSeen: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.burst), b.tokens+now.Sub(b.lastSeen).Seconds()*l.rps)
+	b.lastSeen = now
+
+	var res limiterResult
+	if b.tokens >= 1 {
+		if take {
+			b.tokens--
+		}
+		res.allowed = true
+	} else {
+		res.retryAfter = l.duration(1 - b.tokens)
+	}
+	res.remaining = int(b.tokens)
+	res.reset = l.duration(float64(l.burst) - b.tokens)
+	return res
+}
+
+// duration returns the time it takes to refill the given number of tokens.
+func (l *rateLimiter) duration(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rps * float64(time.Second))
+}
+
+// cleanup removes the buckets of clients which haven't been seen for the
+// given time. Their buckets would be full again anyway.
+func (l *rateLimiter) cleanup(idle time.Duration, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, b := range l.buckets {
+		if now.Sub(b.lastSeen) > idle {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// clientIP returns the address of the client. X-Forwarded-For is only
+// honoured if the request was sent by a trusted proxy or through a Unix
+// domain socket, in which case the right-most address which doesn't belong
+// to a trusted proxy is used.
+func (app *application) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	// Peers connected through a Unix domain socket have no IP address. They
+	// run on this host, i.e. they are the local reverse proxy.
+	_, err = netip.ParseAddr(host)
+	local := err != nil
+	if !local && !app.trustedProxy(host) {
+		return host
+	}
+
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if _, err := netip.ParseAddr(hop); err != nil {
+			break
+		}
+		host = hop
+		if !app.trustedProxy(hop) {
+			break
+		}
+	}
+	return host
+}
+
+func (app *application) trustedProxy(host string) bool {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range app.config.limiter.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrefixes parses a comma separated list of IP addresses and CIDR
+// ranges.
+func parsePrefixes(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			addr, err := netip.ParseAddr(p)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"net/http"
 
+	"assecor.assessment.test/internal/data"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -14,11 +15,31 @@ func (app *application) routes() http.Handler {
 
 	// Register the relevant methods, URL patterns and handler functions
 	// for testing purposes only, not required
-	router.HandlerFunc(http.MethodGet, "/healthcheck", app.healthcheckHandler)
-	router.HandlerFunc(http.MethodPost, "/persons", app.createPersonHandler)
-	router.HandlerFunc(http.MethodGet, "/persons", app.listPersonsHandler)
-	// catches /persons/:id, /persons/color/:id
-	router.HandlerFunc(http.MethodGet, "/persons/*path", app.pathHandler)
+	router.HandlerFunc(http.MethodGet, "/healthz/live", app.livenessHandler)
+	router.HandlerFunc(http.MethodGet, "/healthz/ready", app.readinessHandler)
+	// the path of the liveness probe before it was split, kept for existing
+	// probes and clients
+	router.HandlerFunc(http.MethodGet, "/healthcheck", app.livenessHandler)
+	router.HandlerFunc(http.MethodPost, "/persons", app.requireScope(data.ScopePersonsWrite, app.createPersonHandler))
+	router.HandlerFunc(http.MethodGet, "/persons", app.requireScope(data.ScopePersonsRead, app.listPersonsHandler))
+	// catches /persons/:id, /persons/:id/history, /persons/color/:id,
+	// /persons/nearby, /persons/duplicates, /persons/events; the history
+	// requires the admin scope
+	router.HandlerFunc(http.MethodGet, "/persons/*path", app.requireScope(data.ScopePersonsRead, app.pathHandler))
+	router.HandlerFunc(http.MethodPut, "/persons/external/:source/:id", app.requireScope(data.ScopePersonsWrite, app.upsertExternalPersonHandler))
+	router.HandlerFunc(http.MethodPost, "/persons/:id/merge", app.requireScope(data.ScopePersonsWrite, app.mergePersonHandler))
+	router.HandlerFunc(http.MethodDelete, "/persons/:id", app.requireScope(data.ScopePersonsWrite, app.deletePersonHandler))
+	router.HandlerFunc(http.MethodPost, "/persons/:id/restore", app.requireScope(data.ScopePersonsWrite, app.restorePersonHandler))
+	router.HandlerFunc(http.MethodGet, "/ws", app.requireScope(data.ScopePersonsRead, app.wsHandler))
+	router.HandlerFunc(http.MethodGet, "/stats", app.requireScope(data.ScopePersonsRead, app.statsHandler))
+	router.HandlerFunc(http.MethodGet, "/audit", app.requireScope(data.ScopePersonsAdmin, app.listAuditHandler))
 
-	return app.recoverPanic(router)
+	router.HandlerFunc(http.MethodPost, "/api-keys", app.requireScope(data.ScopeAPIKeysWrite, app.createAPIKeyHandler))
+
+	router.HandlerFunc(http.MethodPost, "/webhooks", app.requireScope(data.ScopeWebhooksWrite, app.createWebhookHandler))
+	router.HandlerFunc(http.MethodGet, "/webhooks", app.requireScope(data.ScopeWebhooksWrite, app.listWebhooksHandler))
+	router.HandlerFunc(http.MethodDelete, "/webhooks/:id", app.requireScope(data.ScopeWebhooksWrite, app.deleteWebhookHandler))
+	router.HandlerFunc(http.MethodGet, "/webhooks/:id/dead-letters", app.requireScope(data.ScopeWebhooksWrite, app.listDeadLettersHandler))
+
+	return app.recoverPanic(app.enableCORS(app.authenticate(app.rateLimit(app.idempotency(router)))))
 }
@@ -4,44 +4,136 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 )
 
 func (app *application) serve() error {
 	srv := &http.Server{
-		Addr:         fmt.Sprintf(":%d", app.config.port),
 		Handler:      app.routes(),
-		IdleTimeout:  time.Minute,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 30 * time.Second,
+		IdleTimeout:  app.config.server.idleTimeout,
+		ReadTimeout:  app.config.server.readTimeout,
+		WriteTimeout: app.config.server.writeTimeout,
+		ErrorLog:     slog.NewLogLogger(app.logger.Handler(), slog.LevelError),
 	}
 
+	var redirectSrv *http.Server
+	// abort stops the redirect server and the background tasks if the server
+	// fails instead of shutting down, serve only returns once they are done.
+	abort := func(err error) error {
+		if redirectSrv != nil {
+			err = errors.Join(err, redirectSrv.Close())
+		}
+		app.stopBackground()
+		return errors.Join(err, app.waitBackground(app.config.server.drainTimeout))
+	}
+
+	useTLS := len(app.config.tls.cert) > 0
+	if useTLS {
+		cr, err := newCertReloader(app.config.tls.cert, app.config.tls.key)
+		if err != nil {
+			return abort(err)
+		}
+		srv.TLSConfig, err = app.newTLSConfig(cr)
+		if err != nil {
+			return abort(err)
+		}
+
+		// Reload the certificate on SIGHUP, e.g. after it was renewed. Only new
+		// connections pick up the new certificate, open ones are not dropped.
+		go func() {
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			for range hup {
+				if err := cr.reload(); err != nil {
+					app.logger.Error("reloading certificate failed", "error", err)
+					continue
+				}
+				app.logger.Info("reloaded certificate", "cert", app.config.tls.cert)
+			}
+		}()
+
+		if app.config.tls.redirectPort > 0 {
+			redirectSrv = &http.Server{
+				Addr:         fmt.Sprintf(":%d", app.config.tls.redirectPort),
+				Handler:      http.HandlerFunc(app.redirectToHTTPS),
+				IdleTimeout:  app.config.server.idleTimeout,
+				ReadTimeout:  app.config.server.readTimeout,
+				WriteTimeout: app.config.server.writeTimeout,
+				ErrorLog:     srv.ErrorLog,
+			}
+		}
+	}
+
+	ln, err := app.listen()
+	if err != nil {
+		return abort(err)
+	}
+	// The redirect server is only started along with the server, a port which
+	// is in use fails serve like the main one.
+	if redirectSrv != nil {
+		redirectLn, err := net.Listen("tcp", redirectSrv.Addr)
+		if err != nil {
+			ln.Close()
+			return abort(err)
+		}
+		go func() {
+			app.logger.Info("starting redirect server", "addr", redirectSrv.Addr)
+			err := redirectSrv.Serve(redirectLn)
+			if !errors.Is(err, http.ErrServerClosed) {
+				app.logger.Error("redirect server failed", "error", err)
+			}
+		}()
+	}
+	// Shutdown waits for the open event streams, end them and the periodic
+	// jobs as soon as it starts.
+	srv.RegisterOnShutdown(app.stopBackground)
+
 	shutdownError := make(chan error)
 	go func() {
 		quit := make(chan os.Signal, 1)
 		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 		s := <-quit
 		// Update the log entry to say "shutting down server" instead of "caught signal".
-		app.logger.Printf("shutting down server after %s", s.String())
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		app.logger.Info("shutting down server", "signal", s.String())
+		if err := sdNotify("STOPPING=1"); err != nil {
+			app.logger.Error("notifying service manager failed", "error", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), app.config.server.shutdownTimeout)
 		defer cancel()
 		// Call Shutdown() on our server, passing in the context we just made.
 		// Shutdown() will return nil if the graceful shutdown was successful, or an
 		// error (which may happen because of a problem closing the listeners, or
-		// because the shutdown didn't complete before the 5-second context deadline is
+		// because the shutdown didn't complete before the configured deadline is
 		// hit). We relay this return value to the shutdownError channel.
-		shutdownError <- srv.Shutdown(ctx)
+		err := srv.Shutdown(ctx)
+		if redirectSrv != nil {
+			err = errors.Join(err, redirectSrv.Shutdown(ctx))
+		}
+		// No new requests are accepted anymore, wait for the work started in
+		// the background.
+		app.logger.Info("completing background tasks")
+		err = errors.Join(err, app.waitBackground(app.config.server.drainTimeout))
+		shutdownError <- err
 	}()
 
-	app.logger.Printf("starting server %s", srv.Addr)
+	app.logger.Info("starting server", "addr", ln.Addr().String(), "env", app.config.env, "tls", useTLS)
+	if err := sdNotify("READY=1\nSTATUS=serving on " + ln.Addr().String()); err != nil {
+		app.logger.Error("notifying service manager failed", "error", err)
+	}
 
-	err := srv.ListenAndServe()
+	if useTLS {
+		// The certificate is provided by TLSConfig.GetCertificate.
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		err = srv.Serve(ln)
+	}
 	if !errors.Is(err, http.ErrServerClosed) {
-		return err
+		return abort(err)
 	}
 	// Otherwise, we wait to receive the return value from Shutdown() on the
 	// shutdownError channel. If return value is an error, we know that there was a
@@ -51,6 +143,6 @@ func (app *application) serve() error {
 		return err
 	}
 
-	app.logger.Printf("stopped server %s", srv.Addr)
+	app.logger.Info("stopped server", "addr", ln.Addr().String())
 	return nil
 }
@@ -2,23 +2,37 @@ package main
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"assecor.assessment.test/internal/jwt"
 	"assecor.assessment.test/internal/mock"
 )
 
 func newTestApp(_ *testing.T) *application {
 	return &application{
-		logger: log.New(io.Discard, "", 0),
-		models: mock.NewTestModels(),
+		logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		models:   mock.NewTestModels(),
+		started:  time.Now(),
+		shutdown: make(chan struct{}),
+		drained:  make(chan struct{}),
 	}
 }
 
@@ -76,6 +90,37 @@ func (ts *testServer) post(t *testing.T, urlPath string, body []byte) (int, http
 	return rs.StatusCode, rs.Header, body
 }
 
+func (ts *testServer) do(t *testing.T, method, urlPath string, headers http.Header,
+	body []byte) (int, http.Header, []byte) {
+	req, err := http.NewRequest(method, ts.URL+urlPath, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range headers {
+		req.Header[key] = value
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rs, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := rs.Body.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	body, err = io.ReadAll(rs.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rs.StatusCode, rs.Header, body
+}
+
 func readJSON(t *testing.T, body []byte, dst interface{}) {
 	dec := json.NewDecoder(bytes.NewReader(body))
 	dec.DisallowUnknownFields()
@@ -122,3 +167,73 @@ func writeJSON(t *testing.T, data interface{}) []byte {
 	}
 	return js
 }
+
+// writeJWKS stores the public keys as JSON Web Key Set in a temporary file
+// and loads it again.
+func writeJWKS(t *testing.T, keys map[string]interface{}) *jwt.KeySet {
+	b64 := base64.RawURLEncoding.EncodeToString
+	var set struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	for kid, key := range keys {
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, map[string]string{
+				"kty": "RSA", "kid": kid, "use": "sig",
+				"n": b64(key.N.Bytes()),
+				"e": b64(big.NewInt(int64(key.E)).Bytes()),
+			})
+		case *ecdsa.PublicKey:
+			set.Keys = append(set.Keys, map[string]string{
+				"kty": "EC", "kid": kid, "crv": "P-256",
+				"x": b64(key.X.FillBytes(make([]byte, 32))),
+				"y": b64(key.Y.FillBytes(make([]byte, 32))),
+			})
+		}
+	}
+	fileName := filepath.Join(t.TempDir(), "jwks.json")
+	err := os.WriteFile(fileName, writeJSON(t, set), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, err := jwt.LoadJWKS(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks
+}
+
+// signJWT creates a compact serialized token. Claims with a nil value are
+// left out.
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	payload := map[string]interface{}{}
+	for k, v := range claims {
+		if v != nil {
+			payload[k] = v
+		}
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	input := b64(writeJSON(t, header)) + "." + b64(writeJSON(t, payload))
+	digest := sha256.Sum256([]byte(input))
+
+	var sig []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return input + "." + b64(sig)
+}
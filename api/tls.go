@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+)
+
+// certReloader serves the current certificate to new TLS handshakes and can
+// replace it at runtime, established connections keep the certificate they
+// were set up with.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Pointer[tls.Certificate]
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	err := cr.reload()
+	if err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// reload reads the certificate and key files again. On error the previous
+// certificate stays in use.
+func (cr *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.cert.Store(&cert)
+	return nil
+}
+
+func (cr *certReloader) getCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return cr.cert.Load(), nil
+}
+
+// newTLSConfig returns the server TLS configuration including HTTP/2 and, if
+// a client CA bundle is configured, mutual TLS.
+func (app *application) newTLSConfig(cr *certReloader) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.getCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+
+	if len(app.config.tls.clientCA) > 0 {
+		pem, err := os.ReadFile(app.config.tls.clientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls client ca %s: no certificates found", app.config.tls.clientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// redirectToHTTPS sends clients of the plain HTTP port to the same URL on
+// the HTTPS port.
+func (app *application) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if app.config.port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(app.config.port))
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
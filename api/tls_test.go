@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate signed by parent, or self-signed if parent is
+// nil.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, cn string, parent *testCert, isCA bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write stores the certificate and key as PEM files in dir.
+func (c *testCert) write(t *testing.T, dir string) (string, string) {
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "Test CA", nil, true)
+	first := newTestCert(t, "first", ca, false)
+	second := newTestCert(t, "second", ca, false)
+	client := newTestCert(t, "client", ca, false)
+	stranger := newTestCert(t, "stranger", nil, false)
+
+	certFile, keyFile := first.write(t, dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.der}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := newTestApp(t)
+	app.config.tls.clientCA = caFile
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := app.newTLSConfig(cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Use a plain http.Server, httptest would install its own certificate.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler:   app.routes(),
+		TLSConfig: tlsConfig,
+		ErrorLog:  log.New(io.Discard, "", 0),
+	}
+	go srv.ServeTLS(ln, "", "")
+	defer srv.Close()
+	url := "https://" + ln.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(t *testing.T, clientCert *testCert) (*http.Response, error) {
+		clientTLS := &tls.Config{RootCAs: roots}
+		if clientCert != nil {
+			clientTLS.Certificates = []tls.Certificate{clientCert.tlsCertificate()}
+		}
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS, ForceAttemptHTTP2: true}}
+		rs, err := c.Get(url + "/healthz/live")
+		if err == nil {
+			rs.Body.Close()
+		}
+		return rs, err
+	}
+
+	t.Run("Client certificate", func(t *testing.T) {
+		rs, err := get(t, client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rs.ProtoMajor != 2 {
+			t.Errorf("want HTTP/2; got %s", rs.Proto)
+		}
+		if cn := rs.TLS.PeerCertificates[0].Subject.CommonName; cn != "first" {
+			t.Errorf("want server certificate %s; got %s", "first", cn)
+		}
+	})
+
+	t.Run("Missing client certificate", func(t *testing.T) {
+		if _, err := get(t, nil); err == nil {
+			t.Error("want handshake error")
+		}
+	})
+
+	t.Run("Untrusted client certificate", func(t *testing.T) {
+		if _, err := get(t, stranger); err == nil {
+			t.Error("want handshake error")
+		}
+	})
+
+	t.Run("Reload", func(t *testing.T) {
+		second.write(t, dir)
+		if err := cr.reload(); err != nil {
+			t.Fatal(err)
+		}
+		rs, err := get(t, client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cn := rs.TLS.PeerCertificates[0].Subject.CommonName; cn != "second" {
+			t.Errorf("want server certificate %s; got %s", "second", cn)
+		}
+	})
+
+	t.Run("Failed reload keeps certificate", func(t *testing.T) {
+		err := os.WriteFile(certFile, []byte("garbage"), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cr.reload(); err == nil {
+			t.Fatal("want reload error")
+		}
+		rs, err := get(t, client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cn := rs.TLS.PeerCertificates[0].Subject.CommonName; cn != "second" {
+			t.Errorf("want server certificate %s; got %s", "second", cn)
+		}
+	})
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		name    string
+		port    int
+		host    string
+		urlPath string
+		want    string
+	}{
+		{"Custom port", 4000, "api.example:8080", "/persons?x=1", "https://api.example:4000/persons?x=1"},
+		{"Default port", 443, "api.example", "/persons/1", "https://api.example/persons/1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			app.config.port = tt.port
+
+			r := httptest.NewRequest(http.MethodGet, tt.urlPath, nil)
+			r.Host = tt.host
+			w := httptest.NewRecorder()
+			app.redirectToHTTPS(w, r)
+
+			if w.Code != http.StatusPermanentRedirect {
+				t.Fatalf("want %d; got %d", http.StatusPermanentRedirect, w.Code)
+			}
+			if loc := w.Header().Get("Location"); loc != tt.want {
+				t.Errorf("want Location %s; got %s", tt.want, loc)
+			}
+		})
+	}
+}
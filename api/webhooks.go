@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"assecor.assessment.test/internal/data"
+	"assecor.assessment.test/internal/events"
+	"assecor.assessment.test/internal/validator"
+	"github.com/julienschmidt/httprouter"
+)
+
+// webhookBatch is the maximum number of deliveries sent to a webhook per
+// interval.
+const webhookBatch = 100
+
+// "POST /webhooks" endpoint, registers a URL receiving the events of the
+// given types. The secret for checking the signatures is only returned once.
+func (app *application) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+
+	hook := data.Webhook{
+		URL:    input.URL,
+		Events: input.Events,
+	}
+
+	if data.ValidateWebhook(v, &hook); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	hook.Secret, err = data.GenerateWebhookSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.Webhooks.Insert(&hook)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	resp := map[string]interface{}{"webhook": hook, "secret": hook.Secret}
+	headers := http.Header{
+		"Cache-Control": {"no-store"},
+		"Location":      {fmt.Sprintf("/webhooks/%d", hook.ID)},
+	}
+	err = app.writeJSON(w, http.StatusCreated, resp, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// "GET /webhooks" endpoint
+func (app *application) listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	hooks, err := app.models.Webhooks.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, hooks, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// "DELETE /webhooks/:id" endpoint, queued deliveries are dropped
+func (app *application) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+	if err != nil {
+		v := validator.New()
+		v.AddError("webhookID", err.Error())
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Webhooks.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, map[string]string{"message": "webhook successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// "GET /webhooks/:id/dead-letters" endpoint, lists the deliveries which
+// were given up after the maximum number of attempts
+func (app *application) listDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+	if err != nil {
+		v := validator.New()
+		v.AddError("webhookID", err.Error())
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	if _, err := app.models.Webhooks.Get(id); err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	deliveries, err := app.models.Webhooks.GetDeadLetters(id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, deliveries, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// runWebhooks queues the events of the bus for the subscribed webhooks and
+// delivers the queued events periodically until the server shuts down. The
+// subscription is made before returning, so no event published afterwards is
+// missed unless the replay buffer overflows.
+func (app *application) runWebhooks() {
+	lastID := app.models.Events.LastID()
+	_, ch, _ := app.models.Events.Subscribe(lastID)
+	// catchUp subscribes again after lastID and queues the events from the
+	// replay buffer.
+	catchUp := func() {
+		var replay []events.Event
+		var complete bool
+		replay, ch, complete = app.models.Events.Subscribe(lastID)
+		if !complete && len(replay) > 0 {
+			app.logger.Error("webhook events lost, the replay buffer is too small",
+				"from", lastID+1, "to", replay[0].ID-1)
+		}
+		for _, e := range replay {
+			app.queueWebhookEvent(e)
+			lastID = e.ID
+		}
+	}
+	// The draining requests and the import still publish changes during the
+	// shutdown, so the events are queued until they are done.
+	app.consumer(func() {
+		for {
+			select {
+			case e, ok := <-ch:
+				if !ok {
+					// Dropped for falling behind.
+					catchUp()
+					continue
+				}
+				app.queueWebhookEvent(e)
+				lastID = e.ID
+			case <-app.drained:
+				// Nothing is published anymore, the events still buffered
+				// are in the replay buffer after lastID.
+				app.models.Events.Unsubscribe(ch)
+				catchUp()
+				app.models.Events.Unsubscribe(ch)
+				return
+			}
+		}
+	})
+	app.every(app.config.webhooks.interval, app.deliverWebhooks)
+}
+
+// queueWebhookEvent stores the event for delivery to the webhooks subscribed
+// to its type. Persons are formatted like in the responses.
+func (app *application) queueWebhookEvent(e events.Event) {
+	payload := map[string]interface{}{
+		"event":      e.Type,
+		"created_at": e.Time.UTC(),
+		"data":       app.eventData(e),
+	}
+	js, err := json.Marshal(payload)
+	if err == nil {
+		_, err = app.models.Webhooks.Enqueue(e.Type, js)
+	}
+	if err != nil {
+		app.logger.Error("queueing webhook event failed", "event", e.Type, "error", err.Error())
+	}
+}
+
+// deliverWebhooks sends the deliveries which are due, to every webhook
+// concurrently. Failed deliveries are retried with exponential backoff and
+// moved to the dead letters after the maximum number of attempts. After a
+// failure the further deliveries to the webhook wait for the next interval,
+// so a receiver which is down costs one timeout per interval.
+func (app *application) deliverWebhooks() {
+	deliveries, err := app.models.Webhooks.GetDue(time.Now(), webhookBatch)
+	if err != nil {
+		app.logger.Error("loading webhook deliveries failed", "error", err.Error())
+		return
+	}
+	client := &http.Client{
+		Timeout: app.config.webhooks.timeout,
+		// A redirect could point anywhere, it counts as failure.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	perWebhook := map[int64][]*data.WebhookDelivery{}
+	for _, d := range deliveries {
+		perWebhook[d.WebhookID] = append(perWebhook[d.WebhookID], d)
+	}
+	var wg sync.WaitGroup
+	for _, deliveries := range perWebhook {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, d := range deliveries {
+				select {
+				case <-app.shutdown:
+					return
+				default:
+				}
+				if !app.attemptWebhookDelivery(client, d) {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// attemptWebhookDelivery sends the delivery and records the outcome. It
+// reports whether the delivery succeeded.
+func (app *application) attemptWebhookDelivery(client *http.Client, d *data.WebhookDelivery) bool {
+	deliveryErr := app.deliverWebhook(client, d)
+	var err error
+	if deliveryErr == nil {
+		err = app.models.Webhooks.Delivered(d.ID)
+	} else {
+		d.Attempts++
+		d.LastError = deliveryErr.Error()
+		d.NextAttemptAt = time.Now().Add(app.config.webhooks.backoff << (d.Attempts - 1))
+		if d.Attempts >= app.config.webhooks.maxAttempts {
+			d.Status = data.DeliveryDead
+			app.logger.Warn("webhook delivery failed permanently", "webhook", d.WebhookID,
+				"delivery", d.ID, "error", d.LastError)
+		}
+		err = app.models.Webhooks.Failed(d)
+	}
+	if err != nil {
+		app.logger.Error("updating webhook delivery failed", "delivery", d.ID, "error", err.Error())
+	}
+	return deliveryErr == nil
+}
+
+// deliverWebhook posts the payload to the webhook. The receiver has to
+// answer with a 2xx status.
+func (app *application) deliverWebhook(client *http.Client, d *data.WebhookDelivery) error {
+	req, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "assecor-webhooks/"+version)
+	req.Header.Set("X-Webhook-Event", d.EventType)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(d.ID, 10))
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+signWebhook(d.Secret, timestamp, d.Payload))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Read some of the body so the connection can be reused.
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// signWebhook returns the hex encoded HMAC-SHA256 of the timestamp and the
+// payload, joined by a dot. Signing the timestamp lets receivers reject
+// replayed requests.
+func signWebhook(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"assecor.assessment.test/internal/data"
+)
+
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// newWebhookReceiver returns a server which answers with the status returned
+// by status for the nth request, counting from 1, and passes the requests on.
+func newWebhookReceiver(t *testing.T, status func(n int64) int) (*httptest.Server, <-chan webhookRequest) {
+	requests := make(chan webhookRequest, 10)
+	var n atomic.Int64
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		requests <- webhookRequest{header: r.Header, body: body}
+		w.WriteHeader(status(n.Add(1)))
+	}))
+	t.Cleanup(receiver.Close)
+	return receiver, requests
+}
+
+func receiveWebhook(t *testing.T, requests <-chan webhookRequest) webhookRequest {
+	select {
+	case r := <-requests:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook delivery received")
+		return webhookRequest{}
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	app := newTestApp(t)
+	app.config.webhooks.interval = 10 * time.Millisecond
+	app.config.webhooks.timeout = time.Second
+	app.config.webhooks.backoff = 10 * time.Millisecond
+	app.config.webhooks.maxAttempts = 3
+	app.runWebhooks()
+	defer func() {
+		close(app.shutdown)
+		if err := app.waitBackground(5 * time.Second); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// Fails twice before accepting the delivery.
+	flaky, flakyRequests := newWebhookReceiver(t, func(n int64) int {
+		if n <= 2 {
+			return http.StatusInternalServerError
+		}
+		return http.StatusNoContent
+	})
+	broken, brokenRequests := newWebhookReceiver(t, func(int64) int {
+		return http.StatusServiceUnavailable
+	})
+
+	register := func(t *testing.T, url string, events ...string) (data.Webhook, string) {
+		code, header, resp := ts.post(t, "/webhooks", writeJSON(t, map[string]interface{}{"url": url, "events": events}))
+		if code != http.StatusCreated {
+			t.Fatalf("want %d; got %d: %s", http.StatusCreated, code, resp)
+		}
+		if header.Get("Cache-Control") != "no-store" {
+			t.Errorf("want Cache-Control no-store; got %q", header.Get("Cache-Control"))
+		}
+		var input struct {
+			Webhook data.Webhook `json:"webhook"`
+			Secret  string       `json:"secret"`
+		}
+		readJSON(t, resp, &input)
+		if input.Secret == "" {
+			t.Fatal("want secret")
+		}
+		return input.Webhook, input.Secret
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		tests := []struct {
+			name string
+			body string
+		}{
+			{"No URL", `{"events": ["person.created"]}`},
+			{"Relative URL", `{"url": "/hook", "events": ["person.created"]}`},
+			{"FTP URL", `{"url": "ftp://example.com/hook", "events": ["person.created"]}`},
+			{"No events", `{"url": "http://example.com/hook"}`},
+			{"Unknown event", `{"url": "http://example.com/hook", "events": ["person.eaten"]}`},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				code, _, body := ts.post(t, "/webhooks", []byte(tt.body))
+				if code != http.StatusUnprocessableEntity {
+					t.Errorf("want %d; got %d: %s", http.StatusUnprocessableEntity, code, body)
+				}
+			})
+		}
+	})
+
+	flakyHook, secret := register(t, flaky.URL, data.EventPersonCreated)
+	brokenHook, _ := register(t, broken.URL, data.EventPersonCreated, data.EventPersonDeleted)
+
+	t.Run("List", func(t *testing.T) {
+		code, _, body := ts.get(t, "/webhooks")
+		if code != http.StatusOK {
+			t.Fatalf("want %d; got %d", http.StatusOK, code)
+		}
+		var hooks []data.Webhook
+		readJSON(t, body, &hooks)
+		if len(hooks) != 2 || hooks[0].URL != flaky.URL || hooks[1].URL != broken.URL {
+			t.Errorf("want both webhooks; got %+v", hooks)
+		}
+	})
+
+	code, _, body := ts.post(t, "/persons", writeJSON(t, map[string]interface{}{
+		"name": "Hans", "lastname": "Müller", "zipcode": "67742", "city": "Lauterecken", "color": 1}))
+	if code != http.StatusCreated {
+		t.Fatalf("want %d; got %d: %s", http.StatusCreated, code, body)
+	}
+
+	t.Run("Retried until delivered", func(t *testing.T) {
+		var r webhookRequest
+		for i := 0; i < 3; i++ {
+			r = receiveWebhook(t, flakyRequests)
+		}
+		if got := r.header.Get("X-Webhook-Event"); got != data.EventPersonCreated {
+			t.Errorf("want event %q; got %q", data.EventPersonCreated, got)
+		}
+		want := "sha256=" + signWebhook(secret, r.header.Get("X-Webhook-Timestamp"), r.body)
+		if got := r.header.Get("X-Webhook-Signature"); got != want {
+			t.Errorf("want signature %q; got %q", want, got)
+		}
+		var payload struct {
+			Event     string          `json:"event"`
+			CreatedAt time.Time       `json:"created_at"`
+			Data      formattedPerson `json:"data"`
+		}
+		readJSON(t, r.body, &payload)
+		if payload.Event != data.EventPersonCreated || payload.Data.Name != "Hans" || payload.Data.Color != "blau" {
+			t.Errorf("want created Hans; got %+v", payload)
+		}
+	})
+
+	t.Run("Dead letter", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			receiveWebhook(t, brokenRequests)
+		}
+		// The delivery is marked dead right after the last attempt.
+		var dead []data.WebhookDelivery
+		for deadline := time.Now().Add(5 * time.Second); len(dead) == 0 && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+			code, _, body := ts.get(t, fmt.Sprintf("/webhooks/%d/dead-letters", brokenHook.ID))
+			if code != http.StatusOK {
+				t.Fatalf("want %d; got %d", http.StatusOK, code)
+			}
+			readJSON(t, body, &dead)
+		}
+		if len(dead) != 1 || dead[0].Attempts != 3 || dead[0].EventType != data.EventPersonCreated ||
+			dead[0].LastError != "unexpected status 503 Service Unavailable" {
+			t.Fatalf("want one dead person.created delivery; got %+v", dead)
+		}
+		select {
+		case <-brokenRequests:
+			t.Error("want no attempt after the dead letter")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		code, _, _ := ts.get(t, fmt.Sprintf("/webhooks/%d/dead-letters", flakyHook.ID))
+		if code != http.StatusOK {
+			t.Errorf("want %d; got %d", http.StatusOK, code)
+		}
+		code, _, _ = ts.get(t, "/webhooks/99/dead-letters")
+		if code != http.StatusNotFound {
+			t.Errorf("want %d; got %d", http.StatusNotFound, code)
+		}
+	})
+
+	t.Run("Only subscribed events", func(t *testing.T) {
+		code, _, body := ts.do(t, http.MethodDelete, "/persons/1", nil, nil)
+		if code != http.StatusOK {
+			t.Fatalf("want %d; got %d: %s", http.StatusOK, code, body)
+		}
+		r := receiveWebhook(t, brokenRequests)
+		if got := r.header.Get("X-Webhook-Event"); got != data.EventPersonDeleted {
+			t.Errorf("want event %q; got %q", data.EventPersonDeleted, got)
+		}
+		select {
+		case r := <-flakyRequests:
+			t.Errorf("want no delivery to the person.created webhook; got %s", r.body)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		path := fmt.Sprintf("/webhooks/%d", brokenHook.ID)
+		code, _, _ := ts.do(t, http.MethodDelete, path, nil, nil)
+		if code != http.StatusOK {
+			t.Fatalf("want %d; got %d", http.StatusOK, code)
+		}
+		code, _, _ = ts.do(t, http.MethodDelete, path, nil, nil)
+		if code != http.StatusNotFound {
+			t.Errorf("want %d; got %d", http.StatusNotFound, code)
+		}
+		code, _, _ = ts.get(t, path+"/dead-letters")
+		if code != http.StatusNotFound {
+			t.Errorf("want %d; got %d", http.StatusNotFound, code)
+		}
+	})
+}
+
+func TestWebhooksSlowReceiver(t *testing.T) {
+	app := newTestApp(t)
+	app.config.webhooks.interval = 10 * time.Millisecond
+	app.config.webhooks.timeout = 2 * time.Second
+	app.config.webhooks.backoff = time.Minute
+	app.config.webhooks.maxAttempts = 3
+	app.runWebhooks()
+	defer func() {
+		close(app.shutdown)
+		if err := app.waitBackground(5 * time.Second); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// Doesn't answer until the delivery times out or the test ends.
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer slow.Close()
+	defer close(release)
+	fast, fastRequests := newWebhookReceiver(t, func(int64) int {
+		return http.StatusNoContent
+	})
+	for _, url := range []string{slow.URL, fast.URL} {
+		hook := data.Webhook{URL: url, Events: []string{data.EventPersonCreated}, Secret: "secret"}
+		if err := app.models.Webhooks.Insert(&hook); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, zipcode := range []string{"67742", "18439"} {
+		p := &data.Person{Name: "Hans", Lastname: "Müller", Zipcode: zipcode, City: "Lauterecken", Country: "DE", Color: 1}
+		if err := app.models.Persons.Insert(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Both events reach the fast receiver before the first delivery to the
+	// slow one times out.
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		receiveWebhook(t, fastRequests)
+	}
+	if elapsed := time.Since(start); elapsed >= app.config.webhooks.timeout {
+		t.Errorf("want deliveries before the timeout of the slow receiver; took %v", elapsed)
+	}
+}
+
+func TestWebhooksDuringShutdown(t *testing.T) {
+	app := newTestApp(t)
+	app.config.webhooks.interval = time.Hour
+	app.runWebhooks()
+	hook := data.Webhook{URL: "http://example.com/hook", Events: []string{data.EventPersonCreated}, Secret: "secret"}
+	if err := app.models.Webhooks.Insert(&hook); err != nil {
+		t.Fatal(err)
+	}
+
+	// Like the import, a background task which still publishes a change
+	// after the shutdown started.
+	app.stopBackground()
+	app.background(func() {
+		time.Sleep(20 * time.Millisecond)
+		p := &data.Person{Name: "Hans", Lastname: "Müller", Zipcode: "67742", City: "Lauterecken", Country: "DE", Color: 1}
+		if err := app.models.Persons.Insert(p); err != nil {
+			t.Error(err)
+		}
+	})
+	if err := app.waitBackground(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	due, err := app.models.Webhooks.GetDue(time.Now(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) != 1 {
+		t.Errorf("want 1 queued delivery; got %d", len(due))
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"assecor.assessment.test/internal/data"
+	"assecor.assessment.test/internal/events"
+	"assecor.assessment.test/internal/validator"
+	"github.com/coder/websocket"
+)
+
+const (
+	// wsPingInterval is the interval of the pings checking that the client
+	// is still there; it has wsWriteTimeout to answer.
+	wsPingInterval = 30 * time.Second
+	// wsWriteTimeout is how long a message may take to be sent. Clients
+	// which don't read fast enough are disconnected.
+	wsWriteTimeout = 10 * time.Second
+	// wsMaxSubscriptions is the maximum number of subscriptions of a
+	// connection.
+	wsMaxSubscriptions = 20
+	// wsReadLimit is the maximum size of a client message.
+	wsReadLimit = 4096
+)
+
+// wsMessage is a message of the client. Subscriptions are identified by the
+// ID chosen by the client, the filters are optional.
+type wsMessage struct {
+	Type          string `json:"type"` // subscribe, unsubscribe or ping
+	ID            string `json:"id"`
+	Color         int    `json:"color"`
+	ZipcodePrefix string `json:"zipcode_prefix"`
+}
+
+// wsFilter selects the persons a subscription receives events of.
+type wsFilter struct {
+	color         data.Color
+	zipcodePrefix string
+}
+
+func (f wsFilter) matches(p *data.Person) bool {
+	return (f.color == 0 || data.Color(p.Color) == f.color) && strings.HasPrefix(p.Zipcode, f.zipcodePrefix)
+}
+
+// "GET /ws" endpoint, a WebSocket connection on which the client subscribes
+// to the changes of persons matching a color and/or zipcode prefix and
+// receives them as JSON messages:
+//
+//	-> {"type": "subscribe", "id": "blue", "color": 1, "zipcode_prefix": "10"}
+//	<- {"type": "subscribed", "id": "blue"}
+//	<- {"type": "event", "event": "person.created", "subscriptions": ["blue"], "data": {...}}
+//	-> {"type": "unsubscribe", "id": "blue"}
+//	-> {"type": "ping"}
+//	<- {"type": "pong"}
+//
+// Events of a person are sent once, with the IDs of all matching
+// subscriptions. A change matches if the person matched before or after it,
+// so subscribers also learn about persons leaving their filter.
+func (app *application) wsHandler(w http.ResponseWriter, r *http.Request) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		w.Header().Set("Upgrade", "websocket")
+		app.errorResponse(w, r, http.StatusUpgradeRequired, "this endpoint requires a WebSocket connection")
+		return
+	}
+	rc := http.NewResponseController(w)
+	// The server timeouts would end the connection.
+	for _, set := range []func(time.Time) error{rc.SetReadDeadline, rc.SetWriteDeadline} {
+		if err := set(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{OriginPatterns: app.wsOriginPatterns()})
+	if err != nil {
+		// Accept has already answered the request.
+		return
+	}
+	defer conn.CloseNow()
+	conn.SetReadLimit(wsReadLimit)
+
+	// The handler context ends with the connection, the reader and the
+	// pinger cancel it when they fail.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	messages := make(chan wsMessage)
+	go func() {
+		defer cancel()
+		for {
+			var msg wsMessage
+			typ, b, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+			if typ != websocket.MessageText || json.Unmarshal(b, &msg) != nil {
+				conn.Close(websocket.StatusUnsupportedData, "messages must be JSON objects")
+				return
+			}
+			select {
+			case messages <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		defer cancel()
+		ticker := time.NewTicker(wsPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				pingCtx, pingCancel := context.WithTimeout(ctx, wsWriteTimeout)
+				err := conn.Ping(pingCtx)
+				pingCancel()
+				if err != nil {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	lastID := app.models.Events.LastID()
+	_, ch, _ := app.models.Events.Subscribe(lastID)
+	defer func() { app.models.Events.Unsubscribe(ch) }()
+
+	subscriptions := map[string]wsFilter{}
+	for {
+		var reply interface{}
+		select {
+		case msg := <-messages:
+			reply = app.wsHandleMessage(subscriptions, msg)
+		case e, ok := <-ch:
+			if !ok {
+				// Dropped by the bus for falling behind, resume from the
+				// replay buffer if it still has the missed events.
+				var replay []events.Event
+				var complete bool
+				replay, ch, complete = app.models.Events.Subscribe(lastID)
+				if !complete {
+					conn.Close(websocket.StatusTryAgainLater, "missed events, reconnect and reload")
+					return
+				}
+				for _, e := range replay {
+					lastID = e.ID
+					if err := app.wsSendEvent(ctx, conn, subscriptions, e); err != nil {
+						return
+					}
+				}
+				continue
+			}
+			lastID = e.ID
+			if err := app.wsSendEvent(ctx, conn, subscriptions, e); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		case <-app.shutdown:
+			conn.Close(websocket.StatusGoingAway, "server shutting down")
+			return
+		}
+		if reply != nil {
+			if err := wsWrite(ctx, conn, reply); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// wsHandleMessage applies the client message to the subscriptions and
+// returns the reply.
+func (app *application) wsHandleMessage(subscriptions map[string]wsFilter, msg wsMessage) interface{} {
+	v := validator.New()
+	switch msg.Type {
+	case "ping":
+		return map[string]string{"type": "pong"}
+	case "subscribe":
+		v.CheckError(msg.ID != "", "id", validator.Required())
+		v.CheckError(len(msg.ID) <= 50, "id", validator.MaxLength(50))
+		v.CheckError(msg.Color == 0 || (msg.Color >= 1 && msg.Color < int(data.LastColorIndex)),
+			"color", validator.OutOfRange(1, int(data.LastColorIndex)-1))
+		v.CheckError(len(msg.ZipcodePrefix) <= 20, "zipcode_prefix", validator.MaxLength(20))
+		_, exists := subscriptions[msg.ID]
+		v.Check(exists || len(subscriptions) < wsMaxSubscriptions, "id", "too many subscriptions")
+		if !v.Valid() {
+			break
+		}
+		subscriptions[msg.ID] = wsFilter{color: data.Color(msg.Color), zipcodePrefix: msg.ZipcodePrefix}
+		return map[string]string{"type": "subscribed", "id": msg.ID}
+	case "unsubscribe":
+		_, exists := subscriptions[msg.ID]
+		if v.Check(exists, "id", "unknown subscription"); !v.Valid() {
+			break
+		}
+		delete(subscriptions, msg.ID)
+		return map[string]string{"type": "unsubscribed", "id": msg.ID}
+	default:
+		v.CheckError(false, "type", validator.OneOf("subscribe", "unsubscribe", "ping"))
+	}
+	return map[string]interface{}{"type": "error", "id": msg.ID, "error": v.Messages()}
+}
+
+// wsSendEvent sends a change of a person to the client if any of the
+// subscriptions matches the person before or after the change.
+func (app *application) wsSendEvent(ctx context.Context, conn *websocket.Conn, subscriptions map[string]wsFilter, e events.Event) error {
+	c, ok := e.Data.(data.PersonChange)
+	if !ok {
+		return nil
+	}
+	ids := []string{}
+	for id, f := range subscriptions {
+		if f.matches(c.After) || (c.Before != nil && f.matches(c.Before)) {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	slices.Sort(ids)
+	return wsWrite(ctx, conn, map[string]interface{}{
+		"type":          "event",
+		"event":         e.Type,
+		"subscriptions": ids,
+		"data":          app.eventData(e),
+	})
+}
+
+// wsWrite sends the message as JSON. Clients which don't take it within
+// wsWriteTimeout are disconnected.
+func wsWrite(ctx context.Context, conn *websocket.Conn, msg interface{}) error {
+	js, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, wsWriteTimeout)
+	defer cancel()
+	return conn.Write(ctx, websocket.MessageText, js)
+}
+
+// wsOriginPatterns returns the hosts of the trusted CORS origins, browsers
+// on other origins can't connect.
+func (app *application) wsOriginPatterns() []string {
+	var patterns []string
+	for _, origin := range app.config.cors.trustedOrigins {
+		if u, err := url.Parse(origin); err == nil && u.Host != "" {
+			patterns = append(patterns, u.Host)
+		}
+	}
+	return patterns
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"assecor.assessment.test/internal/data"
+	"github.com/coder/websocket"
+)
+
+type wsReply struct {
+	Type          string            `json:"type"`
+	ID            string            `json:"id"`
+	Event         string            `json:"event"`
+	Subscriptions []string          `json:"subscriptions"`
+	Data          formattedPerson   `json:"data"`
+	Error         map[string]string `json:"error"`
+}
+
+// dialWebSocket connects to the WebSocket endpoint, the connection is closed
+// at the end of the test.
+func dialWebSocket(t *testing.T, ts *testServer) *websocket.Conn {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.CloseNow() })
+	return conn
+}
+
+func wsSend(t *testing.T, conn *websocket.Conn, msg string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := conn.Write(ctx, websocket.MessageText, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func wsReceive(t *testing.T, conn *websocket.Conn) wsReply {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, b, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply wsReply
+	if err := json.Unmarshal(b, &reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func TestWebSocket(t *testing.T) {
+	app := newTestApp(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	t.Run("Without upgrade", func(t *testing.T) {
+		code, header, _ := ts.get(t, "/ws")
+		if code != http.StatusUpgradeRequired {
+			t.Errorf("want %d; got %d", http.StatusUpgradeRequired, code)
+		}
+		if header.Get("Upgrade") != "websocket" {
+			t.Errorf("want Upgrade websocket; got %q", header.Get("Upgrade"))
+		}
+	})
+
+	t.Run("Ping", func(t *testing.T) {
+		conn := dialWebSocket(t, ts)
+		wsSend(t, conn, `{"type": "ping"}`)
+		if reply := wsReceive(t, conn); reply.Type != "pong" {
+			t.Errorf("want pong; got %+v", reply)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		// CloseRead reads the pong frame.
+		ctx = conn.CloseRead(ctx)
+		if err := conn.Ping(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	conn := dialWebSocket(t, ts)
+
+	t.Run("Invalid messages", func(t *testing.T) {
+		tests := []struct {
+			name  string
+			msg   string
+			field string
+		}{
+			{"Unknown type", `{"type": "subscribe-all"}`, "type"},
+			{"No ID", `{"type": "subscribe", "color": 1}`, "id"},
+			{"Unknown color", `{"type": "subscribe", "id": "a", "color": 42}`, "color"},
+			{"Unknown subscription", `{"type": "unsubscribe", "id": "a"}`, "id"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				wsSend(t, conn, tt.msg)
+				reply := wsReceive(t, conn)
+				if reply.Type != "error" || reply.Error[tt.field] == "" {
+					t.Errorf("want error for %s; got %+v", tt.field, reply)
+				}
+			})
+		}
+	})
+
+	for _, msg := range []string{
+		`{"type": "subscribe", "id": "blue", "color": 1}`,
+		`{"type": "subscribe", "id": "berlin", "zipcode_prefix": "10"}`,
+	} {
+		wsSend(t, conn, msg)
+		if reply := wsReceive(t, conn); reply.Type != "subscribed" {
+			t.Fatalf("want subscribed; got %+v", reply)
+		}
+	}
+
+	insert := func(t *testing.T, zipcode string, color int) *data.Person {
+		p := &data.Person{Name: "Hans", Lastname: "Müller", Zipcode: zipcode, City: "Berlin", Country: "DE", Color: color}
+		if err := app.models.Persons.Insert(p); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	t.Run("Matching events", func(t *testing.T) {
+		// Matches neither subscription and isn't sent.
+		insert(t, "67742", 2)
+		p := insert(t, "10115", 1)
+		reply := wsReceive(t, conn)
+		if reply.Type != "event" || reply.Event != data.EventPersonCreated || reply.Data.ID != p.ID {
+			t.Fatalf("want created person %d; got %+v", p.ID, reply)
+		}
+		if strings.Join(reply.Subscriptions, ",") != "berlin,blue" {
+			t.Errorf("want subscriptions berlin,blue; got %v", reply.Subscriptions)
+		}
+
+		q := insert(t, "67742", 1)
+		reply = wsReceive(t, conn)
+		if reply.Data.Zipcode != "67742" || strings.Join(reply.Subscriptions, ",") != "blue" {
+			t.Errorf("want person 67742 for blue; got %+v", reply)
+		}
+
+		// Leaves the blue filter, which still gets the update.
+		q.Color = 2
+		if err := app.models.Persons.Update(q); err != nil {
+			t.Fatal(err)
+		}
+		reply = wsReceive(t, conn)
+		if reply.Event != data.EventPersonUpdated || reply.Data.ID != q.ID || reply.Data.Color != "grün" ||
+			strings.Join(reply.Subscriptions, ",") != "blue" {
+			t.Errorf("want updated person %d for blue; got %+v", q.ID, reply)
+		}
+
+		if err := app.models.Persons.Delete(p.ID); err != nil {
+			t.Fatal(err)
+		}
+		reply = wsReceive(t, conn)
+		if reply.Event != data.EventPersonDeleted || reply.Data.ID != p.ID {
+			t.Errorf("want deleted person %d; got %+v", p.ID, reply)
+		}
+	})
+
+	t.Run("Unsubscribe", func(t *testing.T) {
+		wsSend(t, conn, `{"type": "unsubscribe", "id": "blue"}`)
+		if reply := wsReceive(t, conn); reply.Type != "unsubscribed" || reply.ID != "blue" {
+			t.Fatalf("want unsubscribed blue; got %+v", reply)
+		}
+		insert(t, "67742", 1)
+		p := insert(t, "10117", 3)
+		reply := wsReceive(t, conn)
+		if reply.Data.ID != p.ID || strings.Join(reply.Subscriptions, ",") != "berlin" {
+			t.Errorf("want person %d for berlin; got %+v", p.ID, reply)
+		}
+	})
+
+	t.Run("Shutdown", func(t *testing.T) {
+		close(app.shutdown)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, _, err := conn.Read(ctx)
+		if status := websocket.CloseStatus(err); status != websocket.StatusGoingAway {
+			t.Errorf("want close status %v; got %v", websocket.StatusGoingAway, err)
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			t.Error("connection not closed")
+		}
+	})
+}
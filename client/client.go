@@ -0,0 +1,251 @@
+// Package client is a Go client for the persons API. It authenticates with
+// an API key, retries requests failing with a temporary error and decodes
+// error responses into ErrNotFound, *ValidationError and *Error:
+//
+//	c := client.New("https://persons.example.com", apiKey)
+//	p, err := c.GetPerson(ctx, 42)
+//	if errors.Is(err, client.ErrNotFound) {
+//		...
+//	}
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is matched by the errors of requests for resources which don't
+// exist, use errors.Is.
+var ErrNotFound = errors.New("client: resource not found")
+
+// Error is an error response of the API, except for failed validations.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("client: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Is reports whether the error is a 404 Not Found response for ErrNotFound.
+func (e *Error) Is(target error) bool {
+	return target == ErrNotFound && e.StatusCode == http.StatusNotFound
+}
+
+// ValidationError is the 422 Unprocessable Entity response to a request with
+// invalid fields. Fields holds the failed checks per field.
+type ValidationError struct {
+	Message string
+	Fields  map[string][]FieldError
+}
+
+// FieldError is a failed check of a field. Code is stable and can be mapped
+// to UI messages, Params holds the values of the rule, e.g. the maximum
+// length.
+type FieldError struct {
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Params  map[string]interface{} `json:"params,omitempty"`
+}
+
+func (e *ValidationError) Error() string {
+	fields := make([]string, 0, len(e.Fields))
+	for field := range e.Fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	var b strings.Builder
+	b.WriteString("client: ")
+	b.WriteString(e.Message)
+	for i, field := range fields {
+		if i == 0 {
+			b.WriteString(": ")
+		} else {
+			b.WriteString("; ")
+		}
+		for j, fe := range e.Fields[field] {
+			if j > 0 {
+				b.WriteString(", ")
+			}
+			fmt.Fprintf(&b, "%s %s", field, fe.Message)
+		}
+	}
+	return b.String()
+}
+
+// Client sends requests to the API. The fields may be changed before the
+// first request; a Client is safe for concurrent use.
+type Client struct {
+	// BaseURL is the URL of the API without trailing slash.
+	BaseURL string
+	// APIKey is sent in the X-API-Key header unless it is empty.
+	APIKey string
+	// HTTPClient sends the requests, its timeout applies to every attempt.
+	HTTPClient *http.Client
+	// MaxRetries is the number of retries of requests failing with a
+	// network error, 429 Too Many Requests, 502 Bad Gateway, 503 Service
+	// Unavailable or 504 Gateway Timeout. POST requests are also retried on
+	// 409 Conflict, which the API answers while an earlier attempt with the
+	// same Idempotency-Key is still being processed.
+	MaxRetries int
+	// RetryBackoff is the delay before the first retry, it doubles for
+	// every further retry. A longer Retry-After of the response wins.
+	RetryBackoff time.Duration
+}
+
+// New returns a client of the API at baseURL which authenticates with the
+// API key, 30 second timeouts and 3 retries.
+func New(baseURL, apiKey string) *Client {
+	return &Client{
+		BaseURL:      strings.TrimSuffix(baseURL, "/"),
+		APIKey:       apiKey,
+		HTTPClient:   &http.Client{Timeout: 30 * time.Second},
+		MaxRetries:   3,
+		RetryBackoff: 500 * time.Millisecond,
+	}
+}
+
+// do sends the request with the JSON encoded body, if not nil, and decodes
+// the response into dst, if not nil. POST requests get an Idempotency-Key so
+// they can be retried without creating duplicates.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, dst interface{}) error {
+	var js []byte
+	if body != nil {
+		var err error
+		js, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var idempotencyKey string
+	if method == http.MethodPost {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		idempotencyKey = hex.EncodeToString(b)
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(js))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Accept", "application/json, application/problem+json")
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if c.APIKey != "" {
+			req.Header.Set("X-API-Key", c.APIKey)
+		}
+		if idempotencyKey != "" {
+			req.Header.Set("Idempotency-Key", idempotencyKey)
+		}
+
+		resp, err := c.HTTPClient.Do(req)
+		var retryAfter time.Duration
+		switch {
+		case err != nil:
+			if ctx.Err() != nil || attempt >= c.MaxRetries {
+				return err
+			}
+		case !retryable(resp.StatusCode, idempotencyKey != "") || attempt >= c.MaxRetries:
+			defer resp.Body.Close()
+			return decodeResponse(resp, dst)
+		default:
+			if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+				retryAfter = time.Duration(s) * time.Second
+			}
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(max(c.RetryBackoff<<attempt, retryAfter))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// retryable reports whether a request failing with the status may succeed
+// when retried. A conflict of a request with an Idempotency-Key means that an
+// earlier attempt is still in progress.
+func retryable(status int, idempotent bool) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	case http.StatusConflict:
+		return idempotent
+	}
+	return false
+}
+
+// decodeResponse decodes a successful response into dst and turns error
+// responses into errors. Both the problem documents and the legacy
+// {"error": ...} shape are understood.
+func decodeResponse(resp *http.Response, dst interface{}) error {
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		if dst == nil {
+			return nil
+		}
+		if err := json.Unmarshal(b, dst); err != nil {
+			return fmt.Errorf("client: decoding response: %w", err)
+		}
+		return nil
+	}
+
+	var problem struct {
+		Detail string `json:"detail"`
+		Errors []struct {
+			Field string `json:"field"`
+			FieldError
+		} `json:"errors"`
+		// legacy shape, a message or the first message per field
+		Error json.RawMessage `json:"error"`
+	}
+	message := http.StatusText(resp.StatusCode)
+	fields := map[string][]FieldError{}
+	if json.Unmarshal(b, &problem) == nil {
+		if problem.Detail != "" {
+			message = problem.Detail
+		}
+		for _, e := range problem.Errors {
+			fields[e.Field] = append(fields[e.Field], e.FieldError)
+		}
+		var legacyFields map[string]string
+		if json.Unmarshal(problem.Error, &message) != nil && json.Unmarshal(problem.Error, &legacyFields) == nil {
+			message = "the request contains invalid fields"
+			for field, msg := range legacyFields {
+				fields[field] = append(fields[field], FieldError{Message: msg})
+			}
+		}
+	}
+	if resp.StatusCode == http.StatusUnprocessableEntity {
+		return &ValidationError{Message: message, Fields: fields}
+	}
+	return &Error{StatusCode: resp.StatusCode, Message: message}
+}
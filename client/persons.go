@@ -0,0 +1,156 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Color is the favorite color of a person.
+type Color int
+
+const (
+	Blue Color = iota + 1
+	Green
+	Purple
+	Red
+	Yellow
+	Turquoise
+	White
+)
+
+var colorName = map[Color]string{
+	Blue:      "blau",
+	Green:     "grün",
+	Purple:    "violett",
+	Red:       "rot",
+	Yellow:    "gelb",
+	Turquoise: "türkis",
+	White:     "weiß",
+}
+
+// String returns the name of the color used by the API.
+func (c Color) String() string {
+	return colorName[c]
+}
+
+// UnmarshalJSON accepts the color ID as well as the name the API responds
+// with. Unknown names are decoded as 0.
+func (c *Color) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		var id int
+		if err := json.Unmarshal(b, &id); err != nil {
+			return fmt.Errorf("color must be a number or name: %s", b)
+		}
+		*c = Color(id)
+		return nil
+	}
+	*c = 0
+	for color, n := range colorName {
+		if n == name {
+			*c = color
+		}
+	}
+	return nil
+}
+
+// Person is a person stored by the API.
+type Person struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Lastname   string     `json:"lastname"`
+	Zipcode    string     `json:"zipcode"`
+	City       string     `json:"city"`
+	Country    string     `json:"country"` // ISO 3166-1 alpha-2 code
+	Color      Color      `json:"color"`
+	Source     string     `json:"source,omitempty"`
+	ExternalID string     `json:"external_id,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	DeletedAt  *time.Time `json:"deleted_at,omitempty"`
+	// Warnings holds the fields CreatePerson accepted although they failed
+	// a check, e.g. a city which doesn't match the zipcode.
+	Warnings map[string][]FieldError `json:"warnings,omitempty"`
+}
+
+// NewPerson holds the fields of a person to create. The API uses its default
+// country if Country is empty.
+type NewPerson struct {
+	Name     string `json:"name"`
+	Lastname string `json:"lastname"`
+	Zipcode  string `json:"zipcode"`
+	City     string `json:"city"`
+	Country  string `json:"country,omitempty"`
+	Color    Color  `json:"color"`
+}
+
+// ListOptions filter the persons returned by ListPersons.
+type ListOptions struct {
+	// UpdatedSince only returns the persons changed at or after the time,
+	// for incremental syncs. The persons deleted since then are returned
+	// too, with DeletedAt set. It is ignored if zero.
+	UpdatedSince time.Time
+	// IncludeDeleted also returns the deleted persons, it requires an admin
+	// API key.
+	IncludeDeleted bool
+}
+
+// CreatePerson stores a new person and returns it with its ID. The request
+// is retried with the same Idempotency-Key, so a retry never creates a second
+// person.
+func (c *Client) CreatePerson(ctx context.Context, p *NewPerson) (*Person, error) {
+	var person Person
+	err := c.do(ctx, http.MethodPost, "/persons", nil, p, &person)
+	if err != nil {
+		return nil, err
+	}
+	return &person, nil
+}
+
+// GetPerson returns the person with the ID or an error matching ErrNotFound.
+func (c *Client) GetPerson(ctx context.Context, id int64) (*Person, error) {
+	var person Person
+	err := c.do(ctx, http.MethodGet, "/persons/"+strconv.FormatInt(id, 10), nil, nil, &person)
+	if err != nil {
+		return nil, err
+	}
+	return &person, nil
+}
+
+// ListPersons returns the persons ordered by ID, opts may be nil.
+func (c *Client) ListPersons(ctx context.Context, opts *ListOptions) ([]*Person, error) {
+	query := url.Values{}
+	if opts != nil && !opts.UpdatedSince.IsZero() {
+		query.Set("updated_since", opts.UpdatedSince.UTC().Format(time.RFC3339Nano))
+	}
+	if opts != nil && opts.IncludeDeleted {
+		query.Set("include_deleted", "true")
+	}
+	persons := []*Person{}
+	err := c.do(ctx, http.MethodGet, "/persons", query, nil, &persons)
+	if err != nil {
+		return nil, err
+	}
+	return persons, nil
+}
+
+// ListPersonsByColor returns the persons with the favorite color. The API
+// answers 404 Not Found if nobody has the color, which is returned as an
+// empty list.
+func (c *Client) ListPersonsByColor(ctx context.Context, color Color) ([]*Person, error) {
+	persons := []*Person{}
+	err := c.do(ctx, http.MethodGet, "/persons/color/"+strconv.Itoa(int(color)), nil, nil, &persons)
+	if errors.Is(err, ErrNotFound) {
+		return []*Person{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return persons, nil
+}
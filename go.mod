@@ -5,8 +5,11 @@ go 1.24.0
 toolchain go1.24.12
 
 require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/coder/websocket v1.8.14
 	github.com/duckdb/duckdb-go/v2 v2.5.5
 	github.com/julienschmidt/httprouter v1.3.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
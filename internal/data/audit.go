@@ -0,0 +1,177 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// Operations recorded in the audit log.
+const (
+	AuditInsert  = "insert"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditRestore = "restore"
+	AuditPurge   = "purge"
+)
+
+// Actors of changes which aren't made on behalf of a client.
+const (
+	ActorSystem    = "system"
+	ActorCsvImport = "csv-import"
+	ActorPurge     = "purge"
+)
+
+// AuditEvent is a change of a person. Changes holds the changed fields with
+// their values before and after the change; on insert all fields were null
+// before. A purge erases the values of all changes of the person, only which
+// fields changed, by whom and when is kept.
+type AuditEvent struct {
+	ID        int64             `json:"id"`
+	PersonID  int64             `json:"person_id"`
+	Actor     string            `json:"actor"`
+	Operation string            `json:"operation"`
+	Changes   map[string]Change `json:"changes"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// Change is the value of a field before and after a change.
+type Change struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// NewAuditEvent returns the event of the change from before to after, either
+// of which may be nil. It returns nil if nothing changed. The values of purges
+// are redacted.
+func NewAuditEvent(actor, operation string, before, after *Person) *AuditEvent {
+	if actor == "" {
+		actor = ActorSystem
+	}
+	event := &AuditEvent{
+		Actor:     actor,
+		Operation: operation,
+		Changes:   DiffPersons(before, after),
+		CreatedAt: time.Now().UTC(),
+	}
+	if len(event.Changes) == 0 {
+		return nil
+	}
+	if operation == AuditPurge {
+		event.Changes = RedactChanges(event.Changes)
+	}
+	if before != nil {
+		event.PersonID = before.ID
+	} else {
+		event.PersonID = after.ID
+	}
+	return event
+}
+
+// DiffPersons returns the fields which differ between the persons. A nil
+// person has no fields, as have empty external references and deletion
+// times.
+func DiffPersons(before, after *Person) map[string]Change {
+	b, a := personFields(before), personFields(after)
+	changes := map[string]Change{}
+	for k, v := range b {
+		if a[k] != v {
+			changes[k] = Change{Before: v, After: a[k]}
+		}
+	}
+	for k, v := range a {
+		if _, ok := b[k]; !ok {
+			changes[k] = Change{After: v}
+		}
+	}
+	return changes
+}
+
+// RedactChanges returns the changes without their values.
+func RedactChanges(changes map[string]Change) map[string]Change {
+	redacted := make(map[string]Change, len(changes))
+	for k := range changes {
+		redacted[k] = Change{}
+	}
+	return redacted
+}
+
+func personFields(p *Person) map[string]interface{} {
+	if p == nil {
+		return nil
+	}
+	fields := map[string]interface{}{
+		"name":     p.Name,
+		"lastname": p.Lastname,
+		"zipcode":  p.Zipcode,
+		"city":     p.City,
+		"country":  p.Country,
+		"color":    p.Color,
+	}
+	if p.Source != "" {
+		fields["source"] = p.Source
+		fields["external_id"] = p.ExternalID
+	}
+	if p.DeletedAt != nil {
+		fields["deleted_at"] = p.DeletedAt.UTC().Format(time.RFC3339Nano)
+	}
+	return fields
+}
+
+type AuditModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// GetAllForPerson returns the changes of the person, oldest first.
+func (m *AuditModel) GetAllForPerson(personID int64) ([]*AuditEvent, error) {
+	query := `
+		SELECT id, person_id, actor, operation, changes, created_at
+		FROM audit_log
+		WHERE person_id = $1
+		ORDER BY id`
+
+	return m.query(query, personID)
+}
+
+// GetAllSince returns the changes made at or after the given time, oldest
+// first.
+func (m *AuditModel) GetAllSince(since time.Time) ([]*AuditEvent, error) {
+	query := `
+		SELECT id, person_id, actor, operation, changes, created_at
+		FROM audit_log
+		WHERE created_at >= $1
+		ORDER BY id`
+
+	return m.query(query, since.UTC())
+}
+
+func (m *AuditModel) query(query string, args ...interface{}) ([]*AuditEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*AuditEvent{}
+	for rows.Next() {
+		var e AuditEvent
+		var changes string
+		err := rows.Scan(&e.ID, &e.PersonID, &e.Actor, &e.Operation, &changes, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(changes), &e.Changes); err != nil {
+			return nil, err
+		}
+		events = append(events, &e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
@@ -0,0 +1,151 @@
+package data
+
+import (
+	"sort"
+)
+
+// What LoadFromCsv does with a record of the same person as an existing one,
+// see IsSamePerson.
+const (
+	DuplicatesInsert = "insert" // insert it anyway
+	DuplicatesSkip   = "skip"   // ignore the record
+	DuplicatesUpdate = "update" // overwrite the existing person with the record
+)
+
+// IsDuplicate reports whether two persons are probably the same. They have
+// to live in the same country with the same zipcode, and their names have to
+// be similar after folding case, punctuation and umlauts, allowing for small
+// typos; name and lastname may be swapped.
+func IsDuplicate(a, b *Person) bool {
+	if a.Country != b.Country || foldName(a.Zipcode) != foldName(b.Zipcode) {
+		return false
+	}
+	aName, aLastname := foldName(a.Name), foldName(a.Lastname)
+	bName, bLastname := foldName(b.Name), foldName(b.Lastname)
+	return (similar(aName, bName) && similar(aLastname, bLastname)) ||
+		(similar(aName, bLastname) && similar(aLastname, bName))
+}
+
+// IsSamePerson reports whether two persons have the same names and live in
+// the same country with the same zipcode, after folding case, punctuation and
+// umlauts. Unlike IsDuplicate it allows no typos, it decides which person an
+// import overwrites.
+func IsSamePerson(a, b *Person) bool {
+	return a.Country == b.Country && foldName(a.Zipcode) == foldName(b.Zipcode) &&
+		foldName(a.Name) == foldName(b.Name) && foldName(a.Lastname) == foldName(b.Lastname)
+}
+
+// FindDuplicates returns the clusters of persons which are duplicates of each
+// other, directly or through another person of the cluster. The persons of a
+// cluster are sorted by ID, the clusters by the ID of their first person.
+func FindDuplicates(persons []*Person) [][]*Person {
+	// Only persons with the same zipcode can be duplicates, so only compare
+	// the persons of each zipcode with each other.
+	byZipcode := map[string][]int{}
+	for i, p := range persons {
+		key := p.Country + "|" + foldName(p.Zipcode)
+		byZipcode[key] = append(byZipcode[key], i)
+	}
+
+	parent := make([]int, len(persons))
+	for i := range parent {
+		parent[i] = i
+	}
+	var root func(i int) int
+	root = func(i int) int {
+		if parent[i] != i {
+			parent[i] = root(parent[i])
+		}
+		return parent[i]
+	}
+	for _, idx := range byZipcode {
+		for i := 0; i < len(idx); i++ {
+			for j := i + 1; j < len(idx); j++ {
+				if IsDuplicate(persons[idx[i]], persons[idx[j]]) {
+					parent[root(idx[j])] = root(idx[i])
+				}
+			}
+		}
+	}
+
+	clusters := map[int][]*Person{}
+	for i, p := range persons {
+		r := root(i)
+		clusters[r] = append(clusters[r], p)
+	}
+	duplicates := [][]*Person{}
+	for _, c := range clusters {
+		if len(c) < 2 {
+			continue
+		}
+		sort.Slice(c, func(i, j int) bool {
+			return c[i].ID < c[j].ID
+		})
+		duplicates = append(duplicates, c)
+	}
+	sort.Slice(duplicates, func(i, j int) bool {
+		return duplicates[i][0].ID < duplicates[j][0].ID
+	})
+	return duplicates
+}
+
+// MergeFields are the fields which can be taken from the source person of a
+// merge.
+var MergeFields = []string{"name", "lastname", "zipcode", "city", "country", "color"}
+
+// MergePerson copies the fields, named as in MergeFields, from source to
+// target.
+func MergePerson(target, source *Person, fields []string) {
+	for _, f := range fields {
+		switch f {
+		case "name":
+			target.Name = source.Name
+		case "lastname":
+			target.Lastname = source.Lastname
+		case "zipcode":
+			target.Zipcode = source.Zipcode
+		case "city":
+			target.City = source.City
+		case "country":
+			target.Country = source.Country
+		case "color":
+			target.Color = source.Color
+		}
+	}
+}
+
+// similar reports whether two folded names are equal apart from a typo; one
+// edit is allowed for names up to six letters, two for longer names.
+func similar(a, b string) bool {
+	if a == "" || b == "" {
+		return a == b
+	}
+	ra, rb := []rune(a), []rune(b)
+	maxEdits := 1
+	if min(len(ra), len(rb)) > 6 {
+		maxEdits = 2
+	}
+	return levenshtein(ra, rb) <= maxEdits
+}
+
+// levenshtein returns the minimum number of single rune insertions, deletions
+// and substitutions to change a into b.
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,39 @@
+package data
+
+import "assecor.assessment.test/internal/events"
+
+// Types of the events published on the event bus.
+const (
+	EventPersonCreated   = "person.created"
+	EventPersonUpdated   = "person.updated"
+	EventPersonDeleted   = "person.deleted"
+	EventImportCompleted = "import.completed"
+)
+
+// PersonChange is the data of the person events, the person before and
+// after the change. Before is nil for created persons.
+type PersonChange struct {
+	Before *Person
+	After  *Person
+}
+
+// PublishChange publishes the change of a person recorded in the audit log
+// on the bus, with a PersonChange as data. A restored person is published as
+// updated; purges aren't published, the person was deleted before.
+func PublishChange(bus *events.Bus, operation string, before, after *Person) {
+	if bus == nil {
+		return
+	}
+	var typ string
+	switch operation {
+	case AuditInsert:
+		typ = EventPersonCreated
+	case AuditUpdate, AuditRestore:
+		typ = EventPersonUpdated
+	case AuditDelete:
+		typ = EventPersonDeleted
+	default:
+		return
+	}
+	bus.Publish(typ, PersonChange{Before: before, After: after})
+}
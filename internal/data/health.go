@@ -0,0 +1,39 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type HealthModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// Ping verifies that the database connection is still alive.
+func (m *HealthModel) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	return m.DB.PingContext(ctx)
+}
+
+// TableExists reports whether a table with the given name exists in the
+// database catalog.
+func (m *HealthModel) TableExists(name string) (bool, error) {
+	query := `
+		SELECT count(*)
+		FROM information_schema.tables
+		WHERE table_name = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	var count int
+	err := m.DB.QueryRowContext(ctx, query, name).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
@@ -0,0 +1,144 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/duckdb/duckdb-go/v2"
+)
+
+// ErrDuplicateKey is returned by IdempotencyModel.Insert if the key is
+// already in use.
+var ErrDuplicateKey = errors.New("duplicate key")
+
+// IdempotencyRecord is a request made with an Idempotency-Key header. Keys
+// are scoped to the client. The response is stored once the request has
+// been handled; Status is 0 while it is still in progress.
+type IdempotencyRecord struct {
+	Scope       string
+	Key         string
+	RequestHash string
+	Status      int
+	ContentType string
+	Body        []byte
+	// Stored is false for responses which must not be stored, such as newly
+	// generated API keys; they can't be replayed.
+	Stored    bool
+	ExpiresAt time.Time
+}
+
+type IdempotencyModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// Insert stores a new request in progress. An expired record with the same
+// key is replaced, ErrDuplicateKey is returned if there is a valid one.
+func (m *IdempotencyModel) Insert(rec *IdempotencyRecord) error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `
+		DELETE FROM idempotency_keys
+		WHERE scope = $1 AND key = $2 AND expires_at <= $3`,
+		rec.Scope, rec.Key, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	result, err := m.DB.ExecContext(ctx, `
+		INSERT OR IGNORE INTO idempotency_keys (scope, key, request_hash, expires_at)
+		VALUES ($1, $2, $3, $4)`,
+		rec.Scope, rec.Key, rec.RequestHash, rec.ExpiresAt.UTC())
+	if err != nil {
+		// INSERT OR IGNORE only ignores the keys committed before. A
+		// concurrent insert of the same key fails with a constraint
+		// violation or a conflict on commit instead.
+		var dbErr *duckdb.Error
+		if errors.As(err, &dbErr) && (dbErr.Type == duckdb.ErrorTypeConstraint || dbErr.Type == duckdb.ErrorTypeTransaction) {
+			return ErrDuplicateKey
+		}
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrDuplicateKey
+	}
+	return nil
+}
+
+// Get returns the record of the key unless it has expired.
+func (m *IdempotencyModel) Get(scope, key string) (*IdempotencyRecord, error) {
+	query := `
+		SELECT scope, key, request_hash, coalesce(status, 0), coalesce(content_type, ''),
+			coalesce(body, ''::BLOB), stored, expires_at
+		FROM idempotency_keys
+		WHERE scope = $1 AND key = $2 AND expires_at > $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	var rec IdempotencyRecord
+	err := m.DB.QueryRowContext(ctx, query, scope, key, time.Now().UTC()).Scan(
+		&rec.Scope, &rec.Key, &rec.RequestHash, &rec.Status, &rec.ContentType,
+		&rec.Body, &rec.Stored, &rec.ExpiresAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &rec, nil
+}
+
+// Complete stores the response of the request.
+func (m *IdempotencyModel) Complete(rec *IdempotencyRecord) error {
+	query := `
+		UPDATE idempotency_keys
+		SET status = $1, content_type = $2, body = $3, stored = $4
+		WHERE scope = $5 AND key = $6`
+
+	var body []byte
+	if rec.Stored {
+		body = rec.Body
+	}
+	args := []interface{}{rec.Status, rec.ContentType, body, rec.Stored, rec.Scope, rec.Key}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Delete removes the record, so the key can be used again.
+func (m *IdempotencyModel) Delete(scope, key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `
+		DELETE FROM idempotency_keys
+		WHERE scope = $1 AND key = $2`, scope, key)
+	return err
+}
+
+// DeleteExpired removes the expired records and returns their number.
+func (m *IdempotencyModel) DeleteExpired() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `
+		DELETE FROM idempotency_keys
+		WHERE expires_at <= $1`, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,119 @@
+package data
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyInsert(t *testing.T) {
+	m := newTestModels(t)
+	valid := time.Now().Add(time.Hour)
+
+	rec := &IdempotencyRecord{Scope: "user:1", Key: "key", RequestHash: "hash", ExpiresAt: valid}
+	if err := m.Idempotency.Insert(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Conflict", func(t *testing.T) {
+		other := &IdempotencyRecord{Scope: "user:1", Key: "key", RequestHash: "other", ExpiresAt: valid}
+		if err := m.Idempotency.Insert(other); !errors.Is(err, ErrDuplicateKey) {
+			t.Fatalf("want %v; got %v", ErrDuplicateKey, err)
+		}
+		got, err := m.Idempotency.Get("user:1", "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.RequestHash != "hash" || got.Status != 0 {
+			t.Errorf("want the first request in progress; got %+v", got)
+		}
+	})
+
+	t.Run("Other scope", func(t *testing.T) {
+		other := &IdempotencyRecord{Scope: "user:2", Key: "key", RequestHash: "hash", ExpiresAt: valid}
+		if err := m.Idempotency.Insert(other); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		errs := make(chan error, 8)
+		for i := 0; i < cap(errs); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- m.Idempotency.Insert(&IdempotencyRecord{Scope: "user:3", Key: "key", RequestHash: "hash", ExpiresAt: valid})
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		var inserted int
+		for err := range errs {
+			switch {
+			case err == nil:
+				inserted++
+			case !errors.Is(err, ErrDuplicateKey):
+				t.Errorf("want %v; got %v", ErrDuplicateKey, err)
+			}
+		}
+		if inserted != 1 {
+			t.Errorf("want 1 insert; got %d", inserted)
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		expired := &IdempotencyRecord{Scope: "user:4", Key: "key", RequestHash: "old", ExpiresAt: time.Now().Add(-time.Second)}
+		if err := m.Idempotency.Insert(expired); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.Idempotency.Get("user:4", "key"); !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("want %v; got %v", ErrRecordNotFound, err)
+		}
+		renewed := &IdempotencyRecord{Scope: "user:4", Key: "key", RequestHash: "new", ExpiresAt: valid}
+		if err := m.Idempotency.Insert(renewed); err != nil {
+			t.Fatal(err)
+		}
+		got, err := m.Idempotency.Get("user:4", "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.RequestHash != "new" {
+			t.Errorf("want request hash %q; got %q", "new", got.RequestHash)
+		}
+	})
+}
+
+func TestIdempotencyComplete(t *testing.T) {
+	m := newTestModels(t)
+	valid := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name     string
+		stored   bool
+		wantBody string
+	}{
+		{"Stored", true, `{"id":1}`},
+		{"Not stored", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &IdempotencyRecord{Scope: "user:1", Key: tt.name, RequestHash: "hash", ExpiresAt: valid}
+			if err := m.Idempotency.Insert(rec); err != nil {
+				t.Fatal(err)
+			}
+			rec.Status, rec.ContentType, rec.Body, rec.Stored = 201, "application/json", []byte(`{"id":1}`), tt.stored
+			if err := m.Idempotency.Complete(rec); err != nil {
+				t.Fatal(err)
+			}
+			got, err := m.Idempotency.Get("user:1", tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != 201 || got.ContentType != "application/json" || got.Stored != tt.stored || string(got.Body) != tt.wantBody {
+				t.Errorf("want response %d %q stored %v; got %+v", 201, tt.wantBody, tt.stored, got)
+			}
+		})
+	}
+}
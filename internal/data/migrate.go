@@ -0,0 +1,85 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Migrate creates the tables or adds the columns which are missing in the
+// database. Every statement can be repeated, so it is run on every start.
+func Migrate(ctx context.Context, db *sql.DB) error {
+	const schema = `
+		CREATE SEQUENCE IF NOT EXISTS seq_personid START 1;
+		CREATE TABLE IF NOT EXISTS persons (
+			id INTEGER PRIMARY KEY DEFAULT NEXTVAL('seq_personid'),	
+			name TEXT NOT NULL,
+			lastname TEXT NOT NULL,
+			zipcode TEXT NOT NULL,
+			city TEXT NOT NULL,
+			color INTEGER NOT NULL);
+		ALTER TABLE persons ADD COLUMN IF NOT EXISTS country TEXT DEFAULT 'DE';
+		ALTER TABLE persons ADD COLUMN IF NOT EXISTS source TEXT;
+		ALTER TABLE persons ADD COLUMN IF NOT EXISTS external_id TEXT;
+		ALTER TABLE persons ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+		ALTER TABLE persons ADD COLUMN IF NOT EXISTS created_at TIMESTAMP;
+		ALTER TABLE persons ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP;
+		UPDATE persons
+		SET created_at = get_current_timestamp() AT TIME ZONE 'UTC',
+			updated_at = get_current_timestamp() AT TIME ZONE 'UTC'
+		WHERE created_at IS NULL;
+		CREATE UNIQUE INDEX IF NOT EXISTS persons_external_ref ON persons (source, external_id);
+		CREATE SEQUENCE IF NOT EXISTS seq_apikeyid START 1;
+		CREATE TABLE IF NOT EXISTS api_keys (
+			id INTEGER PRIMARY KEY DEFAULT NEXTVAL('seq_apikeyid'),
+			key_hash TEXT NOT NULL UNIQUE,
+			name TEXT NOT NULL,
+			role TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT current_timestamp);
+		CREATE TABLE IF NOT EXISTS postal_codes (
+			country TEXT NOT NULL,
+			zipcode TEXT NOT NULL,
+			city TEXT NOT NULL,
+			PRIMARY KEY (country, zipcode, city));
+		ALTER TABLE postal_codes ADD COLUMN IF NOT EXISTS latitude DOUBLE;
+		ALTER TABLE postal_codes ADD COLUMN IF NOT EXISTS longitude DOUBLE;
+		CREATE TABLE IF NOT EXISTS idempotency_keys (
+			scope TEXT NOT NULL,
+			key TEXT NOT NULL,
+			request_hash TEXT NOT NULL,
+			status INTEGER,
+			content_type TEXT,
+			body BLOB,
+			stored BOOLEAN NOT NULL DEFAULT false,
+			expires_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (scope, key));
+		CREATE SEQUENCE IF NOT EXISTS seq_auditid START 1;
+		CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY DEFAULT NEXTVAL('seq_auditid'),
+			person_id INTEGER NOT NULL,
+			actor TEXT NOT NULL,
+			operation TEXT NOT NULL,
+			changes TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL);
+		CREATE INDEX IF NOT EXISTS audit_log_person ON audit_log (person_id);
+		CREATE SEQUENCE IF NOT EXISTS seq_webhookid START 1;
+		CREATE TABLE IF NOT EXISTS webhooks (
+			id INTEGER PRIMARY KEY DEFAULT NEXTVAL('seq_webhookid'),
+			url TEXT NOT NULL,
+			events TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL);
+		CREATE SEQUENCE IF NOT EXISTS seq_deliveryid START 1;
+		CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id INTEGER PRIMARY KEY DEFAULT NEXTVAL('seq_deliveryid'),
+			webhook_id INTEGER NOT NULL,
+			event_type TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			status TEXT NOT NULL,
+			attempts INTEGER NOT NULL,
+			next_attempt_at TIMESTAMP NOT NULL,
+			last_error TEXT,
+			created_at TIMESTAMP NOT NULL);
+		CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries (status, next_attempt_at)`
+	_, err := db.ExecContext(ctx, schema)
+	return err
+}
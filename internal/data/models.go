@@ -9,8 +9,9 @@ import (
 	"os"
 	"strconv"
 	"strings"
-	"unicode"
+	"time"
 
+	"assecor.assessment.test/internal/events"
 	"assecor.assessment.test/internal/validator"
 )
 
@@ -18,22 +19,108 @@ var (
 	ErrRecordNotFound = errors.New("record not found")
 )
 
+// PersonStore stores the persons. Changes are recorded in the audit log with
+// the actor of the store, see WithActor.
+type PersonStore interface {
+	Insert(persion *Person) error
+	Get(id int64) (*Person, error)
+	GetAll() ([]*Person, error)
+	GetAllByColor(color Color) ([]*Person, error)
+	GetAllNearby(country, zipcode string, radiusKm float64) ([]*NearbyPerson, error)
+	GetAllByZipcode(country, zipcode string) ([]*Person, error)
+	Update(person *Person) error
+	Upsert(person *Person) (bool, error)
+	Merge(target *Person, sourceID int64) error
+	GetAllIncludingDeleted() ([]*Person, error)
+	GetAllUpdatedSince(since time.Time, includeDeleted bool) ([]*Person, error)
+	Delete(id int64) error
+	Restore(id int64) error
+	Purge(deletedBefore time.Time) (int64, error)
+	WithActor(actor string) PersonStore
+}
+
 type Models struct {
-	Persons interface {
-		Insert(persion *Person) error
-		Get(id int64) (*Person, error)
-		GetAll() ([]*Person, error)
-		GetAllByColor(color Color) ([]*Person, error)
+	Persons PersonStore
+	Health  interface {
+		Ping() error
+		TableExists(name string) (bool, error)
+	}
+	Users interface {
+		Insert(user *User, apiKey string) error
+		GetForKey(apiKey string) (*User, error)
+		Count() (int, error)
+	}
+	PostalCodes interface {
+		Replace(country string, entries []PostalCode) error
+		Cities(country, zipcode string) ([]string, error)
+		HasCountry(country string) (bool, error)
+	}
+	Stats interface {
+		Get(filter StatsFilter) (*Stats, error)
 	}
+	Idempotency interface {
+		Insert(rec *IdempotencyRecord) error
+		Get(scope, key string) (*IdempotencyRecord, error)
+		Complete(rec *IdempotencyRecord) error
+		Delete(scope, key string) error
+		DeleteExpired() (int64, error)
+	}
+	Audit interface {
+		GetAllForPerson(personID int64) ([]*AuditEvent, error)
+		GetAllSince(since time.Time) ([]*AuditEvent, error)
+	}
+	Webhooks interface {
+		Insert(h *Webhook) error
+		Get(id int64) (*Webhook, error)
+		GetAll() ([]*Webhook, error)
+		Delete(id int64) error
+		Enqueue(eventType string, payload []byte) (int64, error)
+		GetDue(now time.Time, limit int) ([]*WebhookDelivery, error)
+		GetDeadLetters(webhookID int64) ([]*WebhookDelivery, error)
+		Delivered(id int64) error
+		Failed(d *WebhookDelivery) error
+	}
+	// Events receives the changes of persons.
+	Events *events.Bus
 }
 
-func NewModels(db *sql.DB) Models {
+// NewModels returns the models backed by the database. Every query is
+// cancelled after the given timeout, the changes of persons are published on
+// the bus.
+func NewModels(db *sql.DB, timeout time.Duration, bus *events.Bus) Models {
 	return Models{
-		Persons: &PersonModel{DB: db},
+		Persons:     &PersonModel{DB: db, Timeout: timeout, Events: bus},
+		Health:      &HealthModel{DB: db, Timeout: timeout},
+		Users:       &UserModel{DB: db, Timeout: timeout},
+		PostalCodes: &PostalCodeModel{DB: db, Timeout: timeout},
+		Stats:       &StatsModel{DB: db, Timeout: timeout},
+		Idempotency: &IdempotencyModel{DB: db, Timeout: timeout},
+		Audit:       &AuditModel{DB: db, Timeout: timeout},
+		Webhooks:    &WebhookModel{DB: db, Timeout: timeout},
+		Events:      bus,
 	}
 }
 
-func (m Models) LoadFromCsv(v *validator.Validator, fileName string) {
+// CsvOptions controls how LoadFromCsv reads the file.
+type CsvOptions struct {
+	Comma      rune   // field delimiter, ',' if zero
+	Comment    rune   // lines starting with it are ignored, disabled if zero
+	LazyQuotes bool   // allow quotes in unquoted fields
+	Country    string // country of records without country column, DefaultCountry if empty
+	// PostalCheck is the mode of the city check against the postal code
+	// directory, PostalCheckOff if empty. Mismatches are reported as errors
+	// and the record is skipped in PostalCheckReject mode.
+	PostalCheck string
+	// Duplicates says what to do with records of the same persons as
+	// existing persons, DuplicatesInsert if empty.
+	Duplicates string
+	// Source is the partner system the file comes from. If it is set,
+	// records with an external ID column replace the person with the same
+	// source and external ID instead of being inserted again.
+	Source string
+}
+
+func (m Models) LoadFromCsv(v *validator.Validator, fileName string, opts CsvOptions) {
 	file, err := os.Open(fileName)
 	if err != nil {
 		v.AddError("csv", err.Error())
@@ -41,8 +128,19 @@ func (m Models) LoadFromCsv(v *validator.Validator, fileName string) {
 	}
 	defer file.Close()
 
+	if opts.Country == "" {
+		opts.Country = DefaultCountry
+	}
+	m.Persons = m.Persons.WithActor(ActorCsvImport)
+
 	r := csv.NewReader(file)
-	r.FieldsPerRecord = 4
+	// The country and external ID columns are optional.
+	r.FieldsPerRecord = -1
+	if opts.Comma != 0 {
+		r.Comma = opts.Comma
+	}
+	r.Comment = opts.Comment
+	r.LazyQuotes = opts.LazyQuotes
 	lineNumber := 0
 	for {
 		record, err := r.Read()
@@ -50,16 +148,24 @@ func (m Models) LoadFromCsv(v *validator.Validator, fileName string) {
 			break
 		}
 		lineNumber++
+		if err == nil && (len(record) < 4 || len(record) > 6) {
+			line, _ := r.FieldPos(0)
+			err = fmt.Errorf("record on line %d: wrong number of fields", line)
+		}
 		if err == nil {
 			val := validator.New()
-			person := parseRecord(record)
+			person := parseRecord(record, opts.Country, opts.Source)
 			ValidatePerson(val, &person)
-			if val.Valid() {
-				err = m.Persons.Insert(&person)
+			if val.Valid() && m.checkCity(v, &person, lineNumber, opts.PostalCheck) {
+				if person.ExternalID != "" {
+					_, err = m.Persons.Upsert(&person)
+				} else {
+					err = m.store(&person, opts.Duplicates)
+				}
 				if err != nil {
 					v.AddError("db", err.Error())
 				}
-			} else {
+			} else if !val.Valid() {
 				v.AddError("csv",
 					fmt.Sprintf("line %d: invalid data record", lineNumber))
 			}
@@ -69,26 +175,65 @@ func (m Models) LoadFromCsv(v *validator.Validator, fileName string) {
 	}
 }
 
-func parseRecord(r []string) Person {
-	// columns: Lastname, Name, Zipcode+City, Color
+// checkCity runs the city check of the mode on an imported person, adds the
+// mismatches to v and reports whether the person should be inserted.
+func (m Models) checkCity(v *validator.Validator, person *Person, lineNumber int, mode string) bool {
+	if mode != PostalCheckFlag && mode != PostalCheckReject {
+		return true
+	}
+	val := validator.New()
+	if err := m.CheckCity(val, person); err != nil {
+		v.AddError("db", err.Error())
+		return false
+	}
+	for key, errs := range val.Errors {
+		for _, e := range errs {
+			v.AddError("csv", fmt.Sprintf("line %d: %s: %s", lineNumber, key, e.Message))
+		}
+	}
+	return val.Valid() || mode == PostalCheckFlag
+}
+
+// store inserts an imported person unless the same person exists and the
+// mode says to skip or update it. Only exact matches count, a fuzzy match
+// could overwrite somebody else.
+func (m Models) store(person *Person, mode string) error {
+	if mode != DuplicatesSkip && mode != DuplicatesUpdate {
+		return m.Persons.Insert(person)
+	}
+	existing, err := m.Persons.GetAllByZipcode(person.Country, person.Zipcode)
+	if err != nil {
+		return err
+	}
+	for _, e := range existing {
+		if !IsSamePerson(e, person) {
+			continue
+		}
+		if mode == DuplicatesSkip {
+			return nil
+		}
+		person.ID = e.ID
+		return m.Persons.Update(person)
+	}
+	return m.Persons.Insert(person)
+}
+
+func parseRecord(r []string, country, source string) Person {
+	// columns: Lastname, Name, Zipcode+City, Color[, Country[, External ID]]
 	var p Person
 
 	p.Lastname = strings.TrimSpace(r[0])
 	p.Name = strings.TrimSpace(r[1])
-	zc := strings.TrimSpace(r[2])
-	for i, r := range zc {
-		if !unicode.IsDigit(r) {
-			if i > 0 {
-				p.Zipcode = zc[:i]
-				p.City = strings.TrimSpace(zc[i:])
-				break
-			}
-		}
-	}
-	if len(p.Zipcode) == 0 {
-		p.City = zc
+	p.Country = country
+	if len(r) > 4 && strings.TrimSpace(r[4]) != "" {
+		p.Country = strings.ToUpper(strings.TrimSpace(r[4]))
 	}
+	p.Zipcode, p.City = validator.SplitPostalCode(p.Country, r[2])
 	v, _ := strconv.ParseInt(strings.TrimSpace(r[3]), 10, 32)
 	p.Color = int(v)
+	if len(r) > 5 && source != "" && strings.TrimSpace(r[5]) != "" {
+		p.Source = source
+		p.ExternalID = strings.TrimSpace(r[5])
+	}
 	return p
 }
@@ -3,9 +3,12 @@ package data
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"regexp"
 	"time"
 
+	"assecor.assessment.test/internal/events"
 	"assecor.assessment.test/internal/validator"
 )
 
@@ -15,21 +18,51 @@ type Person struct {
 	Lastname string `json:"lastname"`
 	Zipcode  string `json:"zipcode"`
 	City     string `json:"city"`
-	Color    int    `json:"color"` // Person's favorite color
+	Country  string `json:"country"` // ISO 3166-1 alpha-2 code, DefaultCountry if empty
+	Color    int    `json:"color"`   // Person's favorite color
+	// Source and ExternalID identify the person in a partner system, they
+	// are unique together and either both set or both empty.
+	Source     string `json:"source,omitempty"`
+	ExternalID string `json:"external_id,omitempty"`
+	// CreatedAt and UpdatedAt are maintained by PersonModel, deleting and
+	// restoring a person updates it too.
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// DeletedAt is set for persons which were deleted but not purged yet.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
+// DefaultCountry is assumed for persons without a country.
+const DefaultCountry = "DE"
+
+// ValidatePerson checks the person; the zipcode is checked against the postal
+// code rule of its country.
 func ValidatePerson(v *validator.Validator, person *Person) {
-	v.Check(person.Name != "", "name", "must be provided")
-	v.Check(len(person.Name) <= 250, "name", "must not be more than 250 bytes long")
-	v.Check(person.Lastname != "", "lastname", "must be provided")
-	v.Check(len(person.Lastname) <= 250, "name", "must not be more than 250 bytes long")
-	v.Check(person.Zipcode != "", "zipcode", "must be provided")
-	v.Check(validator.ZipCodeRX.MatchString(person.Zipcode), "zipcode", "invalid zip code")
-	v.Check(person.City != "", "city", "must be provided")
-	v.Check(len(person.City) <= 250, "city", "must not be more than 250 bytes long")
-	v.Check(person.Color >= 1 && person.Color < int(LastColorIndex), "color", "id out of range")
+	v.CheckError(person.Name != "", "name", validator.Required())
+	v.CheckError(len(person.Name) <= 250, "name", validator.MaxLength(250))
+	v.CheckError(person.Lastname != "", "lastname", validator.Required())
+	v.CheckError(len(person.Lastname) <= 250, "lastname", validator.MaxLength(250))
+	v.CheckError(person.Zipcode != "", "zipcode", validator.Required())
+	v.CheckError(validator.Matches(person.Country, validator.CountryRX),
+		"country", validator.Pattern("must be an ISO 3166-1 alpha-2 country code", validator.CountryRX))
+	zipCodeRX := validator.PostalCodeRX(person.Country)
+	v.CheckError(person.Zipcode == "" || validator.Matches(person.Zipcode, zipCodeRX),
+		"zipcode", validator.Pattern("invalid zip code", zipCodeRX))
+	v.CheckError(person.City != "", "city", validator.Required())
+	v.CheckError(len(person.City) <= 250, "city", validator.MaxLength(250))
+	v.CheckError(person.Color >= 1 && person.Color < int(LastColorIndex),
+		"color", validator.OutOfRange(1, int(LastColorIndex)-1))
+	if person.Source != "" || person.ExternalID != "" {
+		v.CheckError(validator.Matches(person.Source, SourceRX),
+			"source", validator.Pattern("must be 1 to 50 lowercase letters, digits, '-' or '_'", SourceRX))
+		v.CheckError(person.ExternalID != "", "external_id", validator.Required())
+		v.CheckError(len(person.ExternalID) <= 250, "external_id", validator.MaxLength(250))
+	}
 }
 
+// SourceRX matches the names of partner systems.
+var SourceRX = regexp.MustCompile("^[a-z0-9_-]{1,50}$")
+
 type Color int
 
 const (
@@ -58,59 +91,139 @@ func (c Color) String() string {
 }
 
 type PersonModel struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Timeout time.Duration
+	// Events receives the changes of persons, it may be nil.
+	Events *events.Bus
+	// Actor is recorded in the audit log as the author of the changes,
+	// ActorSystem if empty.
+	Actor string
 }
 
-func (m *PersonModel) Insert(p *Person) error {
-	query := `
-		INSERT INTO persons (name, lastname, zipcode, city, color)
-		VALUES ($1, $2, $3, $4, $5)
-		RETURNING id`
-
-	args := []interface{}{p.Name, p.Lastname, p.Zipcode, p.City, p.Color}
+// WithActor returns a copy of the model which records the actor as the
+// author of its changes.
+func (m *PersonModel) WithActor(actor string) PersonStore {
+	c := *m
+	c.Actor = actor
+	return &c
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+func (m *PersonModel) Insert(p *Person) error {
+	return m.inTx(func(tx *personTx) error {
+		return m.insert(tx, p)
+	})
+}
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&p.ID)
+// Upsert inserts the person, or updates the person with the same source and
+// external ID, and reports whether it was inserted. The ID of the person is
+// set in both cases. A deleted person is restored, as the partner system
+// still knows it.
+func (m *PersonModel) Upsert(p *Person) (bool, error) {
+	var created bool
+	err := m.inTx(func(tx *personTx) error {
+		var deleted bool
+		err := tx.QueryRowContext(tx.ctx, `
+			SELECT id, deleted_at IS NOT NULL
+			FROM persons
+			WHERE source = $1 AND external_id = $2`,
+			p.Source, p.ExternalID).Scan(&p.ID, &deleted)
+		if errors.Is(err, sql.ErrNoRows) {
+			created = true
+			return m.insert(tx, p)
+		}
+		if err != nil {
+			return err
+		}
+		if deleted {
+			if err := m.restore(tx, p.ID); err != nil {
+				return err
+			}
+		}
+		return m.update(tx, p)
+	})
+	return created, err
 }
 
 func (m *PersonModel) Get(id int64) (*Person, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	return getPerson(ctx, m.DB, id, false)
+}
+
+func (m *PersonModel) GetAll() ([]*Person, error) {
+	return m.GetAllUpdatedSince(time.Time{}, false)
+}
+
+// GetAllIncludingDeleted returns the persons including the deleted ones which
+// haven't been purged yet.
+func (m *PersonModel) GetAllIncludingDeleted() ([]*Person, error) {
+	return m.GetAllUpdatedSince(time.Time{}, true)
+}
+
+// GetAllUpdatedSince returns the persons changed at or after the given time,
+// if includeDeleted is set also the deleted ones.
+func (m *PersonModel) GetAllUpdatedSince(since time.Time, includeDeleted bool) ([]*Person, error) {
 	query := `
-		SELECT id, name, lastname, zipcode, city, color
+		SELECT id, name, lastname, zipcode, city, country, color,
+			coalesce(source, ''), coalesce(external_id, ''), created_at, updated_at, deleted_at
 		FROM persons
-		WHERE id = $1`
-	var p Person
+		WHERE (deleted_at IS NULL OR $1) AND updated_at >= $2
+		ORDER BY id`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
-		&p.ID, &p.Name, &p.Lastname, &p.Zipcode, &p.City, &p.Color)
+	rows, err := m.DB.QueryContext(ctx, query, includeDeleted, since.UTC())
 	if err != nil {
-		switch {
-		case errors.Is(err, sql.ErrNoRows):
-			return nil, ErrRecordNotFound
-		default:
+		return nil, err
+	}
+	defer rows.Close()
+	// Initialize an empty slice to hold the movie data.
+	persons := []*Person{}
+	for rows.Next() {
+		var person Person
+		err := rows.Scan(
+			&person.ID,
+			&person.Name,
+			&person.Lastname,
+			&person.Zipcode,
+			&person.City,
+			&person.Country,
+			&person.Color,
+			&person.Source,
+			&person.ExternalID,
+			&person.CreatedAt,
+			&person.UpdatedAt,
+			&person.DeletedAt,
+		)
+		if err != nil {
 			return nil, err
 		}
+		persons = append(persons, &person)
 	}
-	return &p, nil
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return persons, nil
 }
 
-func (m *PersonModel) GetAll() ([]*Person, error) {
+func (m *PersonModel) GetAllByColor(color Color) ([]*Person, error) {
 	query := `
-		SELECT id, name, lastname, zipcode, city, color
+		SELECT id, name, lastname, zipcode, city, country, color,
+			coalesce(source, ''), coalesce(external_id, ''), created_at, updated_at
 		FROM persons
+		WHERE color = $1 AND deleted_at IS NULL
 		ORDER BY id`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
 	defer cancel()
 
-	rows, err := m.DB.QueryContext(ctx, query)
+	rows, err := m.DB.QueryContext(ctx, query, int(color))
 	if err != nil {
 		return nil, err
 	}
@@ -125,7 +238,12 @@ func (m *PersonModel) GetAll() ([]*Person, error) {
 			&person.Lastname,
 			&person.Zipcode,
 			&person.City,
+			&person.Country,
 			&person.Color,
+			&person.Source,
+			&person.ExternalID,
+			&person.CreatedAt,
+			&person.UpdatedAt,
 		)
 		if err != nil {
 			return nil, err
@@ -135,25 +253,28 @@ func (m *PersonModel) GetAll() ([]*Person, error) {
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
+	if len(persons) == 0 {
+		return nil, ErrRecordNotFound
+	}
 	return persons, nil
 }
 
-func (m *PersonModel) GetAllByColor(color Color) ([]*Person, error) {
+func (m *PersonModel) GetAllByZipcode(country, zipcode string) ([]*Person, error) {
 	query := `
-		SELECT id, name, lastname, zipcode, city, color
+		SELECT id, name, lastname, zipcode, city, country, color,
+			coalesce(source, ''), coalesce(external_id, ''), created_at, updated_at
 		FROM persons
-		WHERE (color = $1)
+		WHERE country = $1 AND zipcode = $2 AND deleted_at IS NULL
 		ORDER BY id`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
 	defer cancel()
 
-	rows, err := m.DB.QueryContext(ctx, query, int(color))
+	rows, err := m.DB.QueryContext(ctx, query, country, zipcode)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	// Initialize an empty slice to hold the movie data.
 	persons := []*Person{}
 	for rows.Next() {
 		var person Person
@@ -163,7 +284,12 @@ func (m *PersonModel) GetAllByColor(color Color) ([]*Person, error) {
 			&person.Lastname,
 			&person.Zipcode,
 			&person.City,
+			&person.Country,
 			&person.Color,
+			&person.Source,
+			&person.ExternalID,
+			&person.CreatedAt,
+			&person.UpdatedAt,
 		)
 		if err != nil {
 			return nil, err
@@ -173,8 +299,422 @@ func (m *PersonModel) GetAllByColor(color Color) ([]*Person, error) {
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
-	if len(persons) == 0 {
+	return persons, nil
+}
+
+// Update overwrites the stored person with the same ID.
+func (m *PersonModel) Update(p *Person) error {
+	return m.inTx(func(tx *personTx) error {
+		return m.update(tx, p)
+	})
+}
+
+// Merge updates the target person and deletes the source person in one
+// transaction. The source can be restored like any deleted person.
+func (m *PersonModel) Merge(target *Person, sourceID int64) error {
+	return m.inTx(func(tx *personTx) error {
+		if err := m.update(tx, target); err != nil {
+			return err
+		}
+		return m.delete(tx, sourceID)
+	})
+}
+
+// Delete marks the person as deleted. Deleted persons are hidden, they can
+// be restored until they are purged.
+func (m *PersonModel) Delete(id int64) error {
+	return m.inTx(func(tx *personTx) error {
+		return m.delete(tx, id)
+	})
+}
+
+// Restore undoes the deletion of the person.
+func (m *PersonModel) Restore(id int64) error {
+	return m.inTx(func(tx *personTx) error {
+		return m.restore(tx, id)
+	})
+}
+
+// Purge permanently removes the persons deleted before the given time and
+// returns their number.
+func (m *PersonModel) Purge(deletedBefore time.Time) (int64, error) {
+	var n int64
+	err := m.inTx(func(tx *personTx) error {
+		rows, err := tx.QueryContext(tx.ctx, `
+			SELECT id
+			FROM persons
+			WHERE deleted_at < $1
+			ORDER BY id`, deletedBefore.UTC())
+		if err != nil {
+			return err
+		}
+		var ids []int64
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			before, err := getPerson(tx.ctx, tx, id, true)
+			if err != nil {
+				return err
+			}
+			err = execOne(tx.ctx, tx, `DELETE FROM persons WHERE id = $1`, id)
+			if err != nil {
+				return err
+			}
+			if err := redactAudit(tx, id); err != nil {
+				return err
+			}
+			if err := m.audit(tx, AuditPurge, before, nil); err != nil {
+				return err
+			}
+		}
+		n = int64(len(ids))
+		return nil
+	})
+	return n, err
+}
+
+// personTx is a transaction changing persons. The changes are recorded in
+// the audit log right away and published on the event bus after the commit.
+type personTx struct {
+	*sql.Tx
+	ctx     context.Context
+	changes []change
+}
+
+// change is the operation on a person with its states before and after.
+type change struct {
+	operation string
+	before    *Person
+	after     *Person
+}
+
+// inTx runs fn in a transaction which is committed if fn succeeds.
+func (m *PersonModel) inTx(fn func(tx *personTx) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	sqlTx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer sqlTx.Rollback()
+
+	tx := &personTx{Tx: sqlTx, ctx: ctx}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, c := range tx.changes {
+		PublishChange(m.Events, c.operation, c.before, c.after)
+	}
+	return nil
+}
+
+func (m *PersonModel) insert(tx *personTx, p *Person) error {
+	query := `
+		INSERT INTO persons (name, lastname, zipcode, city, country, color, source, external_id,
+			created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, nullif($7, ''), nullif($8, ''), $9, $9)
+		RETURNING id`
+
+	now := timeNow()
+	args := []interface{}{p.Name, p.Lastname, p.Zipcode, p.City, p.Country, p.Color, p.Source, p.ExternalID, now}
+
+	err := tx.QueryRowContext(tx.ctx, query, args...).Scan(&p.ID)
+	if err != nil {
+		return err
+	}
+	p.CreatedAt, p.UpdatedAt = now, now
+	after := *p
+	after.DeletedAt = nil
+	return m.audit(tx, AuditInsert, nil, &after)
+}
+
+func (m *PersonModel) update(tx *personTx, p *Person) error {
+	before, err := getPerson(tx.ctx, tx, p.ID, false)
+	if err != nil {
+		return err
+	}
+	query := `
+		UPDATE persons
+		SET name = $1, lastname = $2, zipcode = $3, city = $4, country = $5, color = $6,
+			updated_at = $7
+		WHERE id = $8 AND deleted_at IS NULL`
+
+	now := timeNow()
+	args := []interface{}{p.Name, p.Lastname, p.Zipcode, p.City, p.Country, p.Color, now, p.ID}
+
+	if err := execOne(tx.ctx, tx, query, args...); err != nil {
+		return err
+	}
+	p.CreatedAt, p.UpdatedAt = before.CreatedAt, now
+	// The external reference isn't changed by an update.
+	after := *p
+	after.Source, after.ExternalID, after.DeletedAt = before.Source, before.ExternalID, nil
+	return m.audit(tx, AuditUpdate, before, &after)
+}
+
+func (m *PersonModel) delete(tx *personTx, id int64) error {
+	before, err := getPerson(tx.ctx, tx, id, false)
+	if err != nil {
+		return err
+	}
+	now := timeNow()
+	query := `
+		UPDATE persons
+		SET deleted_at = $1, updated_at = $1
+		WHERE id = $2 AND deleted_at IS NULL`
+
+	if err := execOne(tx.ctx, tx, query, now, id); err != nil {
+		return err
+	}
+	after := *before
+	after.DeletedAt, after.UpdatedAt = &now, now
+	return m.audit(tx, AuditDelete, before, &after)
+}
+
+func (m *PersonModel) restore(tx *personTx, id int64) error {
+	before, err := getPerson(tx.ctx, tx, id, true)
+	if err != nil {
+		return err
+	}
+	if before.DeletedAt == nil {
+		return ErrRecordNotFound
+	}
+	now := timeNow()
+	query := `
+		UPDATE persons
+		SET deleted_at = NULL, updated_at = $1
+		WHERE id = $2`
+
+	if err := execOne(tx.ctx, tx, query, now, id); err != nil {
+		return err
+	}
+	after := *before
+	after.DeletedAt, after.UpdatedAt = nil, now
+	return m.audit(tx, AuditRestore, before, &after)
+}
+
+// audit records the change of a person in the audit log and remembers it
+// for publishing.
+func (m *PersonModel) audit(tx *personTx, operation string, before, after *Person) error {
+	event := NewAuditEvent(m.Actor, operation, before, after)
+	if event == nil {
+		return nil
+	}
+	changes, err := json.Marshal(event.Changes)
+	if err != nil {
+		return err
+	}
+	query := `
+		INSERT INTO audit_log (person_id, actor, operation, changes, created_at)
+		VALUES ($1, $2, $3, $4, $5)`
+
+	_, err = tx.ExecContext(tx.ctx, query, event.PersonID, event.Actor, event.Operation, string(changes), event.CreatedAt)
+	if err != nil {
+		return err
+	}
+	tx.changes = append(tx.changes, change{operation, before, after})
+	return nil
+}
+
+// redactAudit removes the values of the person's changes from the audit log,
+// the data of purged persons isn't kept there either.
+func redactAudit(tx *personTx, personID int64) error {
+	rows, err := tx.QueryContext(tx.ctx, `
+		SELECT id, changes
+		FROM audit_log
+		WHERE person_id = $1`, personID)
+	if err != nil {
+		return err
+	}
+	redacted := map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var js string
+		if err := rows.Scan(&id, &js); err != nil {
+			rows.Close()
+			return err
+		}
+		var changes map[string]Change
+		if err := json.Unmarshal([]byte(js), &changes); err != nil {
+			rows.Close()
+			return err
+		}
+		b, err := json.Marshal(RedactChanges(changes))
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		redacted[id] = string(b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, changes := range redacted {
+		_, err := tx.ExecContext(tx.ctx, `UPDATE audit_log SET changes = $1 WHERE id = $2`, changes, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// timeNow returns the current time as DuckDB stores it, in UTC with microsecond
+// precision.
+func timeNow() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+// getPerson returns the person, if includeDeleted is set also a deleted one.
+func getPerson(ctx context.Context, db querier, id int64, includeDeleted bool) (*Person, error) {
+	query := `
+		SELECT id, name, lastname, zipcode, city, country, color,
+			coalesce(source, ''), coalesce(external_id, ''), created_at, updated_at, deleted_at
+		FROM persons
+		WHERE id = $1 AND (deleted_at IS NULL OR $2)`
+
+	var p Person
+	err := db.QueryRowContext(ctx, query, id, includeDeleted).Scan(
+		&p.ID, &p.Name, &p.Lastname, &p.Zipcode, &p.City, &p.Country, &p.Color,
+		&p.Source, &p.ExternalID, &p.CreatedAt, &p.UpdatedAt, &p.DeletedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &p, nil
+}
+
+// execOne executes a statement which has to change exactly one row, it
+// returns ErrRecordNotFound if it didn't change any.
+func execOne(ctx context.Context, db execer, query string, args ...interface{}) error {
+	result, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// execer and querier are implemented by *sql.DB and *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// NearbyPerson is a person with the distance of its zipcode to the center of
+// a proximity search.
+type NearbyPerson struct {
+	Person
+	DistanceKm float64 `json:"distance_km"`
+}
+
+// EarthRadiusKm is the mean earth radius used for distances.
+const EarthRadiusKm = 6371.0
+
+// GetAllNearby returns the persons whose zipcode is at most radiusKm away
+// from the zipcode, sorted by distance. Distances are measured between the
+// coordinates of the postal code directory with the haversine formula; the
+// coordinates of a zipcode with several places are averaged. Persons with a
+// zipcode without coordinates are never found. ErrRecordNotFound is returned
+// if the directory has no coordinates of the zipcode.
+func (m *PersonModel) GetAllNearby(country, zipcode string, radiusKm float64) ([]*NearbyPerson, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	var lat, lon sql.NullFloat64
+	err := m.DB.QueryRowContext(ctx, `
+		SELECT avg(latitude), avg(longitude)
+		FROM postal_codes
+		WHERE country = $1 AND zipcode = $2 AND latitude IS NOT NULL AND longitude IS NOT NULL`,
+		country, zipcode).Scan(&lat, &lon)
+	if err != nil {
+		return nil, err
+	}
+	if !lat.Valid || !lon.Valid {
 		return nil, ErrRecordNotFound
 	}
+
+	// Rounding can push the argument of asin slightly above 1 for antipodes.
+	query := `
+		WITH locations AS (
+			SELECT country, zipcode, avg(latitude) AS lat, avg(longitude) AS lon
+			FROM postal_codes
+			WHERE latitude IS NOT NULL AND longitude IS NOT NULL
+			GROUP BY country, zipcode)
+		SELECT id, name, lastname, zipcode, city, country, color, source, external_id,
+			created_at, updated_at, distance
+		FROM (
+			SELECT p.id, p.name, p.lastname, p.zipcode, p.city, p.country, p.color,
+				coalesce(p.source, '') AS source, coalesce(p.external_id, '') AS external_id,
+				p.created_at, p.updated_at,
+				2 * $3 * asin(least(1.0, sqrt(
+					pow(sin(radians(l.lat - $1) / 2), 2) +
+					cos(radians($1)) * cos(radians(l.lat)) *
+					pow(sin(radians(l.lon - $2) / 2), 2)))) AS distance
+			FROM persons p
+			JOIN locations l ON l.country = p.country AND l.zipcode = p.zipcode
+			WHERE p.deleted_at IS NULL)
+		WHERE distance <= $4
+		ORDER BY distance, id`
+
+	rows, err := m.DB.QueryContext(ctx, query, lat.Float64, lon.Float64, EarthRadiusKm, radiusKm)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	persons := []*NearbyPerson{}
+	for rows.Next() {
+		var person NearbyPerson
+		err := rows.Scan(
+			&person.ID,
+			&person.Name,
+			&person.Lastname,
+			&person.Zipcode,
+			&person.City,
+			&person.Country,
+			&person.Color,
+			&person.Source,
+			&person.ExternalID,
+			&person.CreatedAt,
+			&person.UpdatedAt,
+			&person.DistanceKm,
+		)
+		if err != nil {
+			return nil, err
+		}
+		persons = append(persons, &person)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
 	return persons, nil
 }
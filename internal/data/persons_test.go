@@ -0,0 +1,175 @@
+package data
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestPurge(t *testing.T) {
+	m := newTestModels(t)
+
+	var persons []*Person
+	for _, name := range []string{"Hans", "Peter", "Anna"} {
+		p := &Person{Name: name, Lastname: "Müller", Zipcode: "67742", City: "Lauterecken", Country: "DE", Color: 1}
+		if err := m.Persons.Insert(p); err != nil {
+			t.Fatal(err)
+		}
+		persons = append(persons, p)
+	}
+	purged, late, kept := persons[0], persons[1], persons[2]
+	purged.City = "Kaiserslautern"
+	if err := m.Persons.Update(purged); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Persons.Delete(purged.ID); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	cutoff := time.Now()
+	time.Sleep(time.Millisecond)
+	if err := m.Persons.Delete(late.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := m.Persons.Purge(cutoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("want 1 purged person; got %d", n)
+	}
+	all, err := m.Persons.GetAllIncludingDeleted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all[0].ID != late.ID || all[1].ID != kept.ID {
+		t.Errorf("want persons %d and %d left; got %v", late.ID, kept.ID, all)
+	}
+
+	t.Run("Redacted audit", func(t *testing.T) {
+		audit, err := m.Audit.GetAllForPerson(purged.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var operations []string
+		for _, e := range audit {
+			operations = append(operations, e.Operation)
+			if len(e.Changes) == 0 {
+				t.Errorf("%s: want the changed fields", e.Operation)
+			}
+			for field, c := range e.Changes {
+				if c.Before != nil || c.After != nil {
+					t.Errorf("%s: want %s redacted; got %v", e.Operation, field, c)
+				}
+			}
+		}
+		want := []string{AuditInsert, AuditUpdate, AuditDelete, AuditPurge}
+		if len(operations) != len(want) {
+			t.Fatalf("want operations %v; got %v", want, operations)
+		}
+		for i := range want {
+			if operations[i] != want[i] {
+				t.Errorf("want operations %v; got %v", want, operations)
+				break
+			}
+		}
+		if _, ok := audit[1].Changes["city"]; !ok || len(audit[1].Changes) != 1 {
+			t.Errorf("want the city change in the update; got %v", audit[1].Changes)
+		}
+	})
+
+	t.Run("Audit of other persons", func(t *testing.T) {
+		audit, err := m.Audit.GetAllForPerson(late.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(audit) != 2 {
+			t.Fatalf("want 2 changes; got %d", len(audit))
+		}
+		if c := audit[0].Changes["name"]; c.After != "Peter" {
+			t.Errorf("want name %q; got %v", "Peter", c.After)
+		}
+	})
+
+	t.Run("Purge again", func(t *testing.T) {
+		n, err := m.Persons.Purge(cutoff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("want nothing purged; got %d", n)
+		}
+		if _, err := m.Persons.Get(purged.ID); !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("want %v; got %v", ErrRecordNotFound, err)
+		}
+	})
+}
+
+func TestGetAllNearby(t *testing.T) {
+	m := newTestModels(t)
+
+	coordinates := func(lat, lon float64) (*float64, *float64) {
+		return &lat, &lon
+	}
+	var entries []PostalCode
+	for _, e := range []struct {
+		zipcode, city string
+		lat, lon      float64
+	}{
+		{"67742", "Lauterecken", 49.65, 7.6},
+		{"67655", "Kaiserslautern", 49.44, 7.77},
+		{"10115", "Berlin", 52.53, 13.38},
+		// Antipodes of each other whose haversine term is rounded to
+		// slightly more than 1.
+		{"00001", "Süd", -58.84559275878612, 68.64695898849502},
+		{"00002", "Nord", 58.84559275832507, -111.35304101150498},
+	} {
+		lat, lon := coordinates(e.lat, e.lon)
+		entries = append(entries, PostalCode{Zipcode: e.zipcode, City: e.city, Latitude: lat, Longitude: lon})
+	}
+	if err := m.PostalCodes.Replace("DE", entries); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		p := &Person{Name: "Hans", Lastname: "Müller", Zipcode: e.Zipcode, City: e.City, Country: "DE", Color: 1}
+		if err := m.Persons.Insert(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		zipcode  string
+		radiusKm float64
+		want     []string
+	}{
+		{"Same zipcode", "67742", 0, []string{"67742"}},
+		{"Radius", "67742", 50, []string{"67742", "67655"}},
+		{"Whole earth", "00002", math.Pi * EarthRadiusKm, []string{"00002", "10115", "67742", "67655", "00001"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			persons, err := m.Persons.GetAllNearby("DE", tt.zipcode, tt.radiusKm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, p := range persons {
+				got = append(got, p.Zipcode)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("want zipcodes %v; got %v", tt.want, got)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("want zipcodes %v; got %v", tt.want, got)
+				}
+			}
+			if persons[0].DistanceKm != 0 {
+				t.Errorf("want distance 0 to the zipcode itself; got %v", persons[0].DistanceKm)
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"assecor.assessment.test/internal/validator"
+)
+
+// Modes of the city check against the postal code directory.
+const (
+	PostalCheckOff    = "off"    // don't check
+	PostalCheckFlag   = "flag"   // accept the person but report the mismatch
+	PostalCheckReject = "reject" // reject the person
+)
+
+// Error codes of the city check.
+const (
+	CodeUnknownZipcode = "unknown_zipcode"
+	CodeCityMismatch   = "city_mismatch"
+)
+
+// PostalCode is an entry of the postal code directory, the official name of
+// a place with the zipcode. A zipcode may belong to several places.
+type PostalCode struct {
+	Country   string
+	Zipcode   string
+	City      string
+	Latitude  *float64 // nil if the directory has no coordinates
+	Longitude *float64
+}
+
+type PostalCodeModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// Replace replaces the directory of the country with the entries. A whole
+// directory takes longer than the query timeout, so the timeout applies to
+// every statement rather than to the transaction.
+func (m *PostalCodeModel) Replace(country string, entries []PostalCode) error {
+	tx, err := m.DB.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	exec := func(query string, args ...interface{}) error {
+		ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+		defer cancel()
+		_, err := tx.ExecContext(ctx, query, args...)
+		return err
+	}
+	err = exec(`DELETE FROM postal_codes WHERE country = $1`, country)
+	if err != nil {
+		return err
+	}
+	// Single row inserts are slow in DuckDB, insert the entries in batches.
+	const batchSize = 1000
+	for len(entries) > 0 {
+		n := min(len(entries), batchSize)
+		values := make([]string, n)
+		args := make([]interface{}, 0, 5*n)
+		for i, e := range entries[:n] {
+			values[i] = fmt.Sprintf("($%d, $%d, $%d, $%d, $%d)", 5*i+1, 5*i+2, 5*i+3, 5*i+4, 5*i+5)
+			args = append(args, country, e.Zipcode, e.City, e.Latitude, e.Longitude)
+		}
+		query := `
+			INSERT OR IGNORE INTO postal_codes (country, zipcode, city, latitude, longitude)
+			VALUES ` + strings.Join(values, ", ")
+		err = exec(query, args...)
+		if err != nil {
+			return err
+		}
+		entries = entries[n:]
+	}
+	return tx.Commit()
+}
+
+// Cities returns the official names of the places with the zipcode, it is
+// empty if the zipcode is unknown.
+func (m *PostalCodeModel) Cities(country, zipcode string) ([]string, error) {
+	query := `
+		SELECT city
+		FROM postal_codes
+		WHERE country = $1 AND zipcode = $2
+		ORDER BY city`
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, country, zipcode)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cities := []string{}
+	for rows.Next() {
+		var city string
+		if err := rows.Scan(&city); err != nil {
+			return nil, err
+		}
+		cities = append(cities, city)
+	}
+	return cities, rows.Err()
+}
+
+// HasCountry reports whether the directory contains the country.
+func (m *PostalCodeModel) HasCountry(country string) (bool, error) {
+	query := `
+		SELECT count(*) > 0
+		FROM postal_codes
+		WHERE country = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	var ok bool
+	err := m.DB.QueryRowContext(ctx, query, country).Scan(&ok)
+	return ok, err
+}
+
+// LoadPostalCodes replaces the postal code directory with the entries of the
+// file and returns their number. The file is tab separated if its extension
+// is .tab or .tsv (like the OpenGeoDB extracts), comma separated otherwise.
+// The first line names the columns: "plz" or "zipcode", "ort" or "city" and
+// optionally "country", "lat" or "latitude" and "lon" or "longitude"; other
+// columns are ignored. Entries without country column belong to the given
+// country.
+func (m Models) LoadPostalCodes(fileName, country string) (int, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	r := csv.NewReader(file)
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".tab", ".tsv":
+		r.Comma = '\t'
+	}
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+
+	header, err := r.Read()
+	if err != nil {
+		return 0, fmt.Errorf("postal codes %s: %w", fileName, err)
+	}
+	zipCol, cityCol, countryCol, latCol, lonCol := -1, -1, -1, -1, -1
+	for i, name := range header {
+		switch strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "#"))) {
+		case "plz", "zipcode":
+			zipCol = i
+		case "ort", "city":
+			cityCol = i
+		case "country":
+			countryCol = i
+		case "lat", "latitude":
+			latCol = i
+		case "lon", "longitude":
+			lonCol = i
+		}
+	}
+	if zipCol < 0 || cityCol < 0 {
+		return 0, fmt.Errorf("postal codes %s: missing zipcode or city column", fileName)
+	}
+
+	entries := map[string][]PostalCode{}
+	count := 0
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("postal codes %s: %w", fileName, err)
+		}
+		if len(record) <= zipCol || len(record) <= cityCol {
+			line, _ := r.FieldPos(0)
+			return 0, fmt.Errorf("postal codes %s: line %d: missing fields", fileName, line)
+		}
+		e := PostalCode{
+			Country: country,
+			Zipcode: strings.TrimSpace(record[zipCol]),
+			City:    strings.TrimSpace(record[cityCol]),
+		}
+		if field(record, countryCol) != "" {
+			e.Country = strings.ToUpper(field(record, countryCol))
+		}
+		if field(record, latCol) != "" && field(record, lonCol) != "" {
+			lat, err1 := strconv.ParseFloat(field(record, latCol), 64)
+			lon, err2 := strconv.ParseFloat(field(record, lonCol), 64)
+			if err1 != nil || err2 != nil || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+				line, _ := r.FieldPos(0)
+				return 0, fmt.Errorf("postal codes %s: line %d: invalid coordinates", fileName, line)
+			}
+			e.Latitude, e.Longitude = &lat, &lon
+		}
+		if e.Zipcode == "" || e.City == "" {
+			continue
+		}
+		entries[e.Country] = append(entries[e.Country], e)
+		count++
+	}
+
+	for c, e := range entries {
+		if err := m.PostalCodes.Replace(c, e); err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
+
+// field returns the trimmed column of the record, or an empty string if the
+// column doesn't exist.
+func field(record []string, col int) string {
+	if col < 0 || col >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[col])
+}
+
+// CheckCity checks the city of the person against the postal code directory.
+// Persons of countries missing in the directory aren't checked. A city which
+// doesn't match is reported with the official names of the zipcode as
+// suggestions; the comparison ignores case, punctuation and the spelling of
+// umlauts, so "Muenchen" matches "München".
+func (m Models) CheckCity(v *validator.Validator, person *Person) error {
+	ok, err := m.PostalCodes.HasCountry(person.Country)
+	if err != nil || !ok {
+		return err
+	}
+	cities, err := m.PostalCodes.Cities(person.Country, person.Zipcode)
+	if err != nil {
+		return err
+	}
+	if len(cities) == 0 {
+		v.Add("zipcode", validator.Error{
+			Code:    CodeUnknownZipcode,
+			Message: "unknown zip code",
+		})
+		return nil
+	}
+	city := foldName(person.City)
+	for _, c := range cities {
+		if foldName(c) == city {
+			return nil
+		}
+	}
+	v.Add("city", validator.Error{
+		Code:    CodeCityMismatch,
+		Message: fmt.Sprintf("does not match zip code %s, did you mean %s?", person.Zipcode, strings.Join(cities, " or ")),
+		Params:  map[string]interface{}{"suggestions": cities},
+	})
+	return nil
+}
+
+var umlauts = strings.NewReplacer("ä", "ae", "ö", "oe", "ü", "ue", "ß", "ss")
+
+// foldName returns the lower-cased letters and digits of a name with umlauts
+// written as two letters.
+func foldName(s string) string {
+	s = umlauts.Replace(strings.ToLower(s))
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, s)
+}
@@ -0,0 +1,120 @@
+package data
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"slices"
+	"strings"
+	"time"
+)
+
+// StatsFilter restricts the persons counted by the statistics. Empty fields
+// don't filter.
+type StatsFilter struct {
+	Color         Color
+	City          string // compared case-insensitively
+	Country       string
+	ZipcodePrefix string
+	Lastname      string // compared case-insensitively
+}
+
+// Count is the number of persons sharing a key.
+type Count struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+// Stats are the numbers of persons grouped in different ways. Every group is
+// sorted by descending count, then by key. Regions are the zipcodes reduced
+// to their first digit or first two digits.
+type Stats struct {
+	Total      int64   `json:"total"`
+	ByColor    []Count `json:"by_color"`
+	ByCity     []Count `json:"by_city"`
+	ByRegion1  []Count `json:"by_region_1"`
+	ByRegion2  []Count `json:"by_region_2"`
+	ByLastname []Count `json:"by_lastname"`
+}
+
+// NewStats returns stats with empty groups.
+func NewStats() *Stats {
+	return &Stats{
+		ByColor:    []Count{},
+		ByCity:     []Count{},
+		ByRegion1:  []Count{},
+		ByRegion2:  []Count{},
+		ByLastname: []Count{},
+	}
+}
+
+type StatsModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// Get counts the persons matching the filter in a single pass using grouping
+// sets; GROUPING_ID tells the rows of the different groups apart.
+func (m *StatsModel) Get(filter StatsFilter) (*Stats, error) {
+	query := `
+		SELECT GROUPING_ID(color, city, region1, region2, lastname),
+			color, city, region1, region2, lastname, count(*)
+		FROM (
+			SELECT color, city, left(zipcode, 1) AS region1, left(zipcode, 2) AS region2, lastname
+			FROM persons
+			WHERE deleted_at IS NULL
+			AND (color = $1 OR $1 = 0)
+			AND (lower(city) = lower($2) OR $2 = '')
+			AND (country = $3 OR $3 = '')
+			AND starts_with(zipcode, $4)
+			AND (lower(lastname) = lower($5) OR $5 = ''))
+		GROUP BY GROUPING SETS ((color), (city), (region1), (region2), (lastname), ())
+		ORDER BY count(*) DESC, city, region1, region2, lastname`
+
+	args := []interface{}{int(filter.Color), filter.City, filter.Country, filter.ZipcodePrefix, filter.Lastname}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := NewStats()
+	for rows.Next() {
+		var groupingID int
+		var color sql.NullInt64
+		var city, region1, region2, lastname sql.NullString
+		var count int64
+		err := rows.Scan(&groupingID, &color, &city, &region1, &region2, &lastname, &count)
+		if err != nil {
+			return nil, err
+		}
+		// A bit of the grouping id is set for every column which isn't
+		// grouped, the first column is the most significant bit.
+		switch groupingID {
+		case 0b01111:
+			stats.ByColor = append(stats.ByColor, Count{Color(color.Int64).String(), count})
+		case 0b10111:
+			stats.ByCity = append(stats.ByCity, Count{city.String, count})
+		case 0b11011:
+			stats.ByRegion1 = append(stats.ByRegion1, Count{region1.String, count})
+		case 0b11101:
+			stats.ByRegion2 = append(stats.ByRegion2, Count{region2.String, count})
+		case 0b11110:
+			stats.ByLastname = append(stats.ByLastname, Count{lastname.String, count})
+		case 0b11111:
+			stats.Total = count
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	// The database only knows the numbers of the colors, sort them by name.
+	slices.SortStableFunc(stats.ByColor, func(a, b Count) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), strings.Compare(a.Key, b.Key))
+	})
+	return stats, nil
+}
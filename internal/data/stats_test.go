@@ -0,0 +1,88 @@
+package data
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	m := newTestModels(t)
+
+	persons := []*Person{
+		{Name: "Hans", Lastname: "Müller", Zipcode: "67742", City: "Lauterecken", Country: "DE", Color: int(Blue)},
+		{Name: "Peter", Lastname: "Müller", Zipcode: "67655", City: "Kaiserslautern", Country: "DE", Color: int(Blue)},
+		{Name: "Johnny", Lastname: "Schmidt", Zipcode: "10115", City: "Berlin", Country: "DE", Color: int(Yellow)},
+		{Name: "Anna", Lastname: "Meyer", Zipcode: "18439", City: "Stralsund", Country: "DE", Color: int(Green)},
+		{Name: "Klaus", Lastname: "Weber", Zipcode: "99084", City: "Erfurt", Country: "DE", Color: int(Red)},
+	}
+	for _, p := range persons {
+		if err := m.Persons.Insert(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Deleted persons aren't counted.
+	if err := m.Persons.Delete(persons[4].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter StatsFilter
+		want   *Stats
+	}{
+		{
+			// Ties of colors are sorted by name, not by their number.
+			name:   "All",
+			filter: StatsFilter{},
+			want: &Stats{
+				Total:      4,
+				ByColor:    []Count{{"blau", 2}, {"gelb", 1}, {"grün", 1}},
+				ByCity:     []Count{{"Berlin", 1}, {"Kaiserslautern", 1}, {"Lauterecken", 1}, {"Stralsund", 1}},
+				ByRegion1:  []Count{{"1", 2}, {"6", 2}},
+				ByRegion2:  []Count{{"67", 2}, {"10", 1}, {"18", 1}},
+				ByLastname: []Count{{"Müller", 2}, {"Meyer", 1}, {"Schmidt", 1}},
+			},
+		},
+		{
+			name:   "Color",
+			filter: StatsFilter{Color: Blue},
+			want: &Stats{
+				Total:      2,
+				ByColor:    []Count{{"blau", 2}},
+				ByCity:     []Count{{"Kaiserslautern", 1}, {"Lauterecken", 1}},
+				ByRegion1:  []Count{{"6", 2}},
+				ByRegion2:  []Count{{"67", 2}},
+				ByLastname: []Count{{"Müller", 2}},
+			},
+		},
+		{
+			name:   "City and zipcode prefix",
+			filter: StatsFilter{City: "LAUTERECKEN", ZipcodePrefix: "677"},
+			want: &Stats{
+				Total:      1,
+				ByColor:    []Count{{"blau", 1}},
+				ByCity:     []Count{{"Lauterecken", 1}},
+				ByRegion1:  []Count{{"6", 1}},
+				ByRegion2:  []Count{{"67", 1}},
+				ByLastname: []Count{{"Müller", 1}},
+			},
+		},
+		{
+			name:   "No match",
+			filter: StatsFilter{Country: "AT"},
+			want:   NewStats(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats, err := m.Stats.Get(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(stats, tt.want) {
+				t.Errorf("want %+v; got %+v", tt.want, stats)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/duckdb/duckdb-go/v2"
+
+	"assecor.assessment.test/internal/events"
+)
+
+// newTestModels returns the models on an in-memory DuckDB database with the
+// schema of the server.
+func newTestModels(t *testing.T) Models {
+	t.Helper()
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := Migrate(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	return NewModels(db, 5*time.Second, events.NewBus(100))
+}
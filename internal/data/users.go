@@ -0,0 +1,138 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"assecor.assessment.test/internal/validator"
+)
+
+// Scopes name the permissions required by the endpoints. They are granted
+// either through the role of an API key or directly by a bearer token.
+const (
+	ScopePersonsRead   = "persons:read"
+	ScopePersonsWrite  = "persons:write"
+	ScopePersonsAdmin  = "persons:admin"
+	ScopeAPIKeysWrite  = "api-keys:write"
+	ScopeWebhooksWrite = "webhooks:write"
+)
+
+// Role bundles scopes for API keys. A writer may do everything a reader may
+// do and an admin everything a writer may do.
+type Role string
+
+const (
+	RoleReader Role = "reader"
+	RoleWriter Role = "writer"
+	RoleAdmin  Role = "admin"
+)
+
+var roleScopes = map[Role][]string{
+	RoleReader: {ScopePersonsRead},
+	RoleWriter: {ScopePersonsRead, ScopePersonsWrite},
+	RoleAdmin:  {ScopePersonsRead, ScopePersonsWrite, ScopePersonsAdmin, ScopeAPIKeysWrite, ScopeWebhooksWrite},
+}
+
+// Scopes returns the scopes granted by the role.
+func (r Role) Scopes() []string {
+	return roleScopes[r]
+}
+
+// User is the owner of an API key.
+type User struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Role      Role      `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AnonymousUser represents a client which did not present any credentials.
+var AnonymousUser = &User{}
+
+func (u *User) IsAnonymous() bool {
+	return u == AnonymousUser
+}
+
+func ValidateUser(v *validator.Validator, user *User) {
+	v.CheckError(user.Name != "", "name", validator.Required())
+	v.CheckError(len(user.Name) <= 250, "name", validator.MaxLength(250))
+	v.CheckError(validator.PermittedValue(user.Role, RoleReader, RoleWriter, RoleAdmin),
+		"role", validator.OneOf(string(RoleReader), string(RoleWriter), string(RoleAdmin)))
+}
+
+// GenerateAPIKey returns a new random API key. Only its hash is stored, the
+// plaintext key is handed out once to the client.
+func GenerateAPIKey() (string, error) {
+	b := make([]byte, 20)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b), nil
+}
+
+// HashAPIKey returns the hex encoded SHA-256 hash of an API key.
+func HashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+type UserModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// Insert stores a new user together with the hash of its API key.
+func (m *UserModel) Insert(user *User, apiKey string) error {
+	query := `
+		INSERT INTO api_keys (key_hash, name, role)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at`
+
+	args := []interface{}{HashAPIKey(apiKey), user.Name, string(user.Role)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt)
+}
+
+// Count returns the number of API keys.
+func (m *UserModel) Count() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	var n int
+	err := m.DB.QueryRowContext(ctx, `SELECT count(*) FROM api_keys`).Scan(&n)
+	return n, err
+}
+
+// GetForKey looks up the user owning the given plaintext API key.
+func (m *UserModel) GetForKey(apiKey string) (*User, error) {
+	query := `
+		SELECT id, name, role, created_at
+		FROM api_keys
+		WHERE key_hash = $1`
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, HashAPIKey(apiKey)).Scan(
+		&user.ID, &user.Name, &user.Role, &user.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
@@ -0,0 +1,268 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"assecor.assessment.test/internal/validator"
+)
+
+// WebhookEvents are the event types webhooks can subscribe to.
+var WebhookEvents = []string{EventPersonCreated, EventPersonUpdated, EventPersonDeleted, EventImportCompleted}
+
+// States of webhook deliveries. Delivered ones are removed from the queue.
+const (
+	DeliveryPending = "pending"
+	DeliveryDead    = "dead" // given up after the maximum number of attempts
+)
+
+// Webhook is a target URL receiving the events of the subscribed types. The
+// payloads are signed with the secret, which is only handed out once.
+type Webhook struct {
+	ID        int64     `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func ValidateWebhook(v *validator.Validator, h *Webhook) {
+	v.CheckError(h.URL != "", "url", validator.Required())
+	v.CheckError(len(h.URL) <= 2000, "url", validator.MaxLength(2000))
+	u, err := url.Parse(h.URL)
+	v.Check(h.URL == "" || (err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""),
+		"url", "must be an absolute http or https URL")
+	v.CheckError(len(h.Events) > 0, "events", validator.Required())
+	for _, e := range h.Events {
+		v.CheckError(validator.PermittedValue(e, WebhookEvents...), "events", validator.OneOf(WebhookEvents...))
+	}
+}
+
+// GenerateWebhookSecret returns a new random secret for signing payloads.
+func GenerateWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// WebhookDelivery is an event queued for delivery to a webhook.
+type WebhookDelivery struct {
+	ID            int64           `json:"id"`
+	WebhookID     int64           `json:"webhook_id"`
+	EventType     string          `json:"event"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	LastError     string          `json:"last_error,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+	// URL and Secret of the webhook, set by GetDue.
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+type WebhookModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+func (m *WebhookModel) Insert(h *Webhook) error {
+	query := `
+		INSERT INTO webhooks (url, events, secret, created_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id`
+
+	h.CreatedAt = timeNow()
+	args := []interface{}{h.URL, strings.Join(h.Events, ","), h.Secret, h.CreatedAt}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&h.ID)
+}
+
+func (m *WebhookModel) Get(id int64) (*Webhook, error) {
+	query := `
+		SELECT id, url, events, secret, created_at
+		FROM webhooks
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	var h Webhook
+	var events string
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&h.ID, &h.URL, &events, &h.Secret, &h.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	h.Events = strings.Split(events, ",")
+	return &h, nil
+}
+
+func (m *WebhookModel) GetAll() ([]*Webhook, error) {
+	query := `
+		SELECT id, url, events, secret, created_at
+		FROM webhooks
+		ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hooks := []*Webhook{}
+	for rows.Next() {
+		var h Webhook
+		var events string
+		if err := rows.Scan(&h.ID, &h.URL, &events, &h.Secret, &h.CreatedAt); err != nil {
+			return nil, err
+		}
+		h.Events = strings.Split(events, ",")
+		hooks = append(hooks, &h)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+// Delete removes the webhook with its queued and dead deliveries.
+func (m *WebhookModel) Delete(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM webhook_deliveries WHERE webhook_id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if err := execOne(ctx, tx, `DELETE FROM webhooks WHERE id = $1`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Enqueue queues the event for every webhook subscribed to its type and
+// returns the number of deliveries.
+func (m *WebhookModel) Enqueue(eventType string, payload []byte) (int64, error) {
+	query := `
+		INSERT INTO webhook_deliveries (webhook_id, event_type, payload, status, attempts,
+			next_attempt_at, created_at)
+		SELECT id, $1, $2, $3, 0, $4, $4
+		FROM webhooks
+		WHERE list_contains(string_split(events, ','), $1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, eventType, string(payload), DeliveryPending, timeNow())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetDue returns up to limit pending deliveries per webhook whose next
+// attempt is due, oldest first.
+func (m *WebhookModel) GetDue(now time.Time, limit int) ([]*WebhookDelivery, error) {
+	query := `
+		SELECT d.id, d.webhook_id, d.event_type, d.payload, d.status, d.attempts,
+			d.next_attempt_at, coalesce(d.last_error, ''), d.created_at, w.url, w.secret
+		FROM webhook_deliveries d
+		JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.status = $1 AND d.next_attempt_at <= $2
+		QUALIFY row_number() OVER (PARTITION BY d.webhook_id ORDER BY d.id) <= $3
+		ORDER BY d.id`
+
+	return m.queryDeliveries(query, DeliveryPending, now.UTC(), limit)
+}
+
+// GetDeadLetters returns the deliveries to the webhook which were given up.
+func (m *WebhookModel) GetDeadLetters(webhookID int64) ([]*WebhookDelivery, error) {
+	query := `
+		SELECT d.id, d.webhook_id, d.event_type, d.payload, d.status, d.attempts,
+			d.next_attempt_at, coalesce(d.last_error, ''), d.created_at, w.url, w.secret
+		FROM webhook_deliveries d
+		JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.status = $1 AND d.webhook_id = $2
+		ORDER BY d.id`
+
+	return m.queryDeliveries(query, DeliveryDead, webhookID)
+}
+
+func (m *WebhookModel) queryDeliveries(query string, args ...interface{}) ([]*WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := []*WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		var payload string
+		err := rows.Scan(&d.ID, &d.WebhookID, &d.EventType, &payload, &d.Status, &d.Attempts,
+			&d.NextAttemptAt, &d.LastError, &d.CreatedAt, &d.URL, &d.Secret)
+		if err != nil {
+			return nil, err
+		}
+		d.Payload = json.RawMessage(payload)
+		deliveries = append(deliveries, &d)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// Delivered removes the successfully delivered delivery from the queue.
+func (m *WebhookModel) Delivered(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM webhook_deliveries WHERE id = $1`, id)
+	return err
+}
+
+// Failed stores the status, attempts, next attempt and error of a failed
+// delivery.
+func (m *WebhookModel) Failed(d *WebhookDelivery) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET status = $1, attempts = $2, next_attempt_at = $3, last_error = $4
+		WHERE id = $5`
+
+	args := []interface{}{d.Status, d.Attempts, d.NextAttemptAt.UTC(), d.LastError, d.ID}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
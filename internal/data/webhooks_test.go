@@ -0,0 +1,131 @@
+package data
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestWebhookDeliveries(t *testing.T) {
+	m := newTestModels(t)
+
+	all := &Webhook{URL: "http://example.com/all", Events: []string{EventPersonCreated, EventPersonUpdated}, Secret: "a"}
+	created := &Webhook{URL: "http://example.com/created", Events: []string{EventPersonCreated}, Secret: "b"}
+	for _, h := range []*Webhook{all, created} {
+		if err := m.Webhooks.Insert(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	enqueue := func(eventType string, want int64) {
+		t.Helper()
+		n, err := m.Webhooks.Enqueue(eventType, []byte(`{"event":"`+eventType+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Fatalf("%s: want %d deliveries; got %d", eventType, want, n)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		enqueue(EventPersonCreated, 2)
+	}
+	enqueue(EventPersonUpdated, 1)
+	enqueue(EventPersonDeleted, 0)
+
+	// getDue returns the IDs of the due deliveries per webhook.
+	getDue := func(t *testing.T, now time.Time, limit int) map[int64][]int64 {
+		t.Helper()
+		deliveries, err := m.Webhooks.GetDue(now, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		due := map[int64][]int64{}
+		var last int64
+		for _, d := range deliveries {
+			if d.ID <= last {
+				t.Errorf("want deliveries ordered by id; got %d after %d", d.ID, last)
+			}
+			last = d.ID
+			due[d.WebhookID] = append(due[d.WebhookID], d.ID)
+		}
+		return due
+	}
+
+	due := getDue(t, time.Now(), 10)
+	if len(due[all.ID]) != 4 || len(due[created.ID]) != 3 {
+		t.Fatalf("want 4 and 3 due deliveries; got %v", due)
+	}
+	allIDs, createdIDs := due[all.ID], due[created.ID]
+
+	t.Run("Limit per webhook", func(t *testing.T) {
+		due := getDue(t, time.Now(), 2)
+		if !slices.Equal(due[all.ID], allIDs[:2]) || !slices.Equal(due[created.ID], createdIDs[:2]) {
+			t.Errorf("want the oldest 2 deliveries of each webhook; got %v", due)
+		}
+	})
+
+	t.Run("Retry later", func(t *testing.T) {
+		retry := time.Now().Add(time.Hour)
+		d := &WebhookDelivery{ID: allIDs[0], Status: DeliveryPending, Attempts: 1, NextAttemptAt: retry, LastError: "503"}
+		if err := m.Webhooks.Failed(d); err != nil {
+			t.Fatal(err)
+		}
+		due := getDue(t, time.Now(), 1)
+		if !slices.Equal(due[all.ID], allIDs[1:2]) || !slices.Equal(due[created.ID], createdIDs[:1]) {
+			t.Errorf("want the oldest delivery which is due; got %v", due)
+		}
+		due = getDue(t, retry, 1)
+		if !slices.Equal(due[all.ID], allIDs[:1]) {
+			t.Errorf("want the retried delivery once it is due; got %v", due)
+		}
+	})
+
+	t.Run("Dead letters", func(t *testing.T) {
+		d := &WebhookDelivery{ID: createdIDs[0], Status: DeliveryDead, Attempts: 8, NextAttemptAt: time.Now(), LastError: "timeout"}
+		if err := m.Webhooks.Failed(d); err != nil {
+			t.Fatal(err)
+		}
+		dead, err := m.Webhooks.GetDeadLetters(created.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(dead) != 1 {
+			t.Fatalf("want 1 dead letter; got %d", len(dead))
+		}
+		if dead[0].ID != createdIDs[0] || dead[0].Attempts != 8 || dead[0].LastError != "timeout" ||
+			dead[0].EventType != EventPersonCreated || dead[0].URL != created.URL {
+			t.Errorf("want the given up delivery; got %+v", dead[0])
+		}
+		if dead, err := m.Webhooks.GetDeadLetters(all.ID); err != nil || len(dead) != 0 {
+			t.Errorf("want no dead letters of the other webhook; got %v, %v", dead, err)
+		}
+		due := getDue(t, time.Now(), 10)
+		if !slices.Equal(due[created.ID], createdIDs[1:]) {
+			t.Errorf("want dead letters not due; got %v", due)
+		}
+	})
+
+	t.Run("Delivered", func(t *testing.T) {
+		if err := m.Webhooks.Delivered(createdIDs[1]); err != nil {
+			t.Fatal(err)
+		}
+		due := getDue(t, time.Now(), 10)
+		if !slices.Equal(due[created.ID], createdIDs[2:]) {
+			t.Errorf("want delivered deliveries removed; got %v", due)
+		}
+	})
+
+	t.Run("Delete webhook", func(t *testing.T) {
+		if err := m.Webhooks.Delete(created.ID); err != nil {
+			t.Fatal(err)
+		}
+		due := getDue(t, time.Now(), 10)
+		if len(due[created.ID]) != 0 {
+			t.Errorf("want the deliveries of the deleted webhook removed; got %v", due)
+		}
+		if dead, err := m.Webhooks.GetDeadLetters(created.ID); err != nil || len(dead) != 0 {
+			t.Errorf("want the dead letters of the deleted webhook removed; got %v, %v", dead, err)
+		}
+	})
+}
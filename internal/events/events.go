@@ -0,0 +1,114 @@
+// Package events provides an in-process publish/subscribe bus for change
+// notifications. The latest events are kept in a bounded replay buffer so
+// subscribers can resume after a reconnect without missing anything.
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Event is a notification published on the bus. IDs are assigned in
+// publishing order, starting at 1 when the process starts.
+type Event struct {
+	ID   uint64
+	Type string
+	Data interface{}
+	Time time.Time
+}
+
+// subscriberBuffer is the number of events a subscriber may lag behind
+// before it is dropped.
+const subscriberBuffer = 64
+
+// Bus distributes events to its subscribers. It is safe for concurrent use.
+type Bus struct {
+	mu          sync.Mutex
+	lastID      uint64
+	replay      []Event // ring buffer of the latest events
+	next        int     // position of the next event in replay
+	subscribers map[chan Event]struct{}
+}
+
+// NewBus returns a bus which keeps the latest replaySize events for
+// resuming subscribers.
+func NewBus(replaySize int) *Bus {
+	return &Bus{
+		replay:      make([]Event, 0, max(replaySize, 1)),
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+// Publish sends a new event to all subscribers and returns it. Subscribers
+// which can't keep up are dropped: their channel is closed and they have to
+// subscribe again with the ID of the last event they received.
+func (b *Bus) Publish(typ string, data interface{}) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	e := Event{ID: b.lastID, Type: typ, Data: data, Time: time.Now()}
+	if len(b.replay) < cap(b.replay) {
+		b.replay = append(b.replay, e)
+	} else {
+		b.replay[b.next] = e
+	}
+	b.next = (b.next + 1) % cap(b.replay)
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+	return e
+}
+
+// LastID returns the ID of the latest event, or 0 if none was published.
+func (b *Bus) LastID() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.lastID
+}
+
+// Subscribe returns the buffered events published after the event with
+// lastID and a channel receiving the events published from now on. A
+// lastID of 0 replays the events since the start, subscribers interested in
+// new events only pass LastID. complete is false if events after lastID are
+// no longer buffered, or lastID is unknown, e.g. from before a restart; all
+// buffered events are replayed then.
+func (b *Bus) Subscribe(lastID uint64) (replay []Event, ch <-chan Event, complete bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := make(chan Event, subscriberBuffer)
+	b.subscribers[c] = struct{}{}
+	oldest := b.lastID - uint64(len(b.replay)) + 1
+	complete = lastID+1 >= oldest && lastID <= b.lastID
+	if !complete {
+		lastID = 0
+	}
+	for i := range b.replay {
+		e := b.replay[(b.next+i)%len(b.replay)]
+		if e.ID > lastID {
+			replay = append(replay, e)
+		}
+	}
+	return replay, c, complete
+}
+
+// Unsubscribe stops sending events to the channel returned by Subscribe.
+func (b *Bus) Unsubscribe(ch <-chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for c := range b.subscribers {
+		if c == ch {
+			delete(b.subscribers, c)
+			close(c)
+			return
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformed        = errors.New("malformed token")
+	ErrUnsupportedAlg   = errors.New("unsupported signing algorithm")
+	ErrInvalidSignature = errors.New("invalid token signature")
+	ErrExpired          = errors.New("token is expired")
+	ErrNotYetValid      = errors.New("token is not valid yet")
+	ErrInvalidIssuer    = errors.New("invalid token issuer")
+	ErrInvalidAudience  = errors.New("invalid token audience")
+)
+
+// Claims holds the registered claims we evaluate plus the granted scopes.
+type Claims struct {
+	Subject   string
+	Issuer    string
+	Audience  []string
+	ExpiresAt time.Time
+	NotBefore time.Time
+	Scopes    []string
+}
+
+// Verifier checks signatures and claims of RS256 and ES256 signed tokens.
+type Verifier struct {
+	Keys     *KeySet
+	Issuer   string        // required "iss" value, not checked when empty
+	Audience string        // value "aud" must contain, not checked when empty
+	Leeway   time.Duration // allowed clock skew for exp and nbf
+}
+
+func NewVerifier(keys *KeySet, issuer, audience string) *Verifier {
+	return &Verifier{
+		Keys:     keys,
+		Issuer:   issuer,
+		Audience: audience,
+		Leeway:   30 * time.Second,
+	}
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type payload struct {
+	Sub   string          `json:"sub"`
+	Iss   string          `json:"iss"`
+	Aud   json.RawMessage `json:"aud"`
+	Exp   *json.Number    `json:"exp"`
+	Nbf   *json.Number    `json:"nbf"`
+	Scope string          `json:"scope"`
+	Scp   []string        `json:"scp"`
+}
+
+// Verify validates the compact serialized token and returns its claims.
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, ErrMalformed
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	if h.Alg != "RS256" && h.Alg != "ES256" {
+		return nil, ErrUnsupportedAlg
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !v.verifySignature(h, digest[:], sig) {
+		return nil, ErrInvalidSignature
+	}
+
+	var p payload
+	if err := decodeSegment(parts[1], &p); err != nil {
+		return nil, ErrMalformed
+	}
+	return v.checkClaims(p)
+}
+
+func (v *Verifier) verifySignature(h header, digest, sig []byte) bool {
+	for _, key := range v.Keys.lookup(h.Alg, h.Kid) {
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, sig) == nil {
+				return true
+			}
+		case *ecdsa.PublicKey:
+			// JWS encodes ES256 signatures as the fixed size concatenation of
+			// r and s instead of ASN.1.
+			if len(sig) != 64 {
+				return false
+			}
+			r := new(big.Int).SetBytes(sig[:32])
+			s := new(big.Int).SetBytes(sig[32:])
+			if ecdsa.Verify(key, digest, r, s) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (v *Verifier) checkClaims(p payload) (*Claims, error) {
+	c := &Claims{
+		Subject: p.Sub,
+		Issuer:  p.Iss,
+	}
+	// The subject identifies the client for the rate limits and the audit
+	// trail, tokens without one would all share a single identity.
+	if p.Sub == "" || p.Exp == nil {
+		return nil, ErrMalformed
+	}
+	exp, err := numericDate(*p.Exp)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	c.ExpiresAt = exp
+	if p.Nbf != nil {
+		nbf, err := numericDate(*p.Nbf)
+		if err != nil {
+			return nil, ErrMalformed
+		}
+		c.NotBefore = nbf
+	}
+
+	// "aud" may either be a single string or an array of strings.
+	if len(p.Aud) > 0 {
+		var aud string
+		if json.Unmarshal(p.Aud, &aud) == nil {
+			c.Audience = []string{aud}
+		} else if json.Unmarshal(p.Aud, &c.Audience) != nil {
+			return nil, ErrMalformed
+		}
+	}
+	// Scopes are sent either as the space separated OAuth 2.0 "scope" claim
+	// or as a "scp" array.
+	c.Scopes = append(strings.Fields(p.Scope), p.Scp...)
+
+	now := time.Now()
+	if now.After(c.ExpiresAt.Add(v.Leeway)) {
+		return nil, ErrExpired
+	}
+	if !c.NotBefore.IsZero() && now.Add(v.Leeway).Before(c.NotBefore) {
+		return nil, ErrNotYetValid
+	}
+	if v.Issuer != "" && c.Issuer != v.Issuer {
+		return nil, ErrInvalidIssuer
+	}
+	if v.Audience != "" {
+		found := false
+		for _, aud := range c.Audience {
+			if aud == v.Audience {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, ErrInvalidAudience
+		}
+	}
+	return c, nil
+}
+
+func decodeSegment(seg string, dst interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(strings.NewReader(string(b)))
+	dec.UseNumber()
+	return dec.Decode(dst)
+}
+
+func numericDate(n json.Number) (time.Time, error) {
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(int64(f), 0), nil
+}
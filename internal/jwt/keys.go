@@ -0,0 +1,185 @@
+package jwt
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+)
+
+// Key is a public verification key, optionally identified by a key id.
+type Key struct {
+	ID  string
+	Key interface{} // *rsa.PublicKey or *ecdsa.PublicKey
+}
+
+// KeySet holds the keys used to verify token signatures.
+type KeySet struct {
+	Keys []Key
+}
+
+// lookup returns the keys which may have produced a signature with the given
+// algorithm and key id. Keys without an id match every token.
+func (ks *KeySet) lookup(alg, kid string) []interface{} {
+	var keys []interface{}
+	for _, k := range ks.Keys {
+		if kid != "" && k.ID != "" && k.ID != kid {
+			continue
+		}
+		switch key := k.Key.(type) {
+		case *rsa.PublicKey:
+			if alg == "RS256" {
+				keys = append(keys, key)
+			}
+		case *ecdsa.PublicKey:
+			if alg == "ES256" && key.Curve == elliptic.P256() {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// LoadJWKS reads a JSON Web Key Set file. Keys which are not meant for
+// signatures or use an unsupported key type are skipped.
+func LoadJWKS(fileName string) (*KeySet, error) {
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	err = json.Unmarshal(b, &set)
+	if err != nil {
+		return nil, fmt.Errorf("jwks %s: %w", fileName, err)
+	}
+
+	ks := &KeySet{}
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key interface{}
+		switch k.Kty {
+		case "RSA":
+			key, err = parseRSAKey(k)
+		case "EC":
+			key, err = parseECKey(k)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("jwks %s: key %d: %w", fileName, i, err)
+		}
+		ks.Keys = append(ks.Keys, Key{ID: k.Kid, Key: key})
+	}
+	if len(ks.Keys) == 0 {
+		return nil, fmt.Errorf("jwks %s: no usable keys", fileName)
+	}
+	return ks, nil
+}
+
+// LoadPEM reads PEM encoded public keys or certificates.
+func LoadPEM(fileName string) (*KeySet, error) {
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	ks := &KeySet{}
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		var key interface{}
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("pem %s: %w", fileName, err)
+		}
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+			ks.Keys = append(ks.Keys, Key{Key: key})
+		}
+	}
+	if len(ks.Keys) == 0 {
+		return nil, fmt.Errorf("pem %s: no usable keys", fileName)
+	}
+	return ks, nil
+}
+
+func parseRSAKey(k jwk) (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, errors.New("invalid modulus")
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil || len(e) == 0 || len(e) > 4 {
+		return nil, errors.New("invalid exponent")
+	}
+	key := &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}
+	if key.N.BitLen() < 2048 {
+		return nil, errors.New("rsa keys must be at least 2048 bits long")
+	}
+	return key, nil
+}
+
+func parseECKey(k jwk) (*ecdsa.PublicKey, error) {
+	if k.Crv != "P-256" {
+		return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil || len(x) != 32 {
+		return nil, errors.New("invalid x coordinate")
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil || len(y) != 32 {
+		return nil, errors.New("invalid y coordinate")
+	}
+	// Let crypto/ecdh check that the point is on the curve.
+	point := append(append([]byte{4}, x...), y...)
+	if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+		return nil, err
+	}
+	return &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}, nil
+}
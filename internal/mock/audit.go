@@ -0,0 +1,44 @@
+package mock
+
+import (
+	"time"
+
+	"assecor.assessment.test/internal/data"
+)
+
+type MockAuditModel struct {
+	events []*data.AuditEvent
+}
+
+func (m *MockAuditModel) add(e *data.AuditEvent) {
+	e.ID = int64(len(m.events)) + 1
+	m.events = append(m.events, e)
+}
+
+func (m *MockAuditModel) redact(personID int64) {
+	for _, e := range m.events {
+		if e.PersonID == personID {
+			e.Changes = data.RedactChanges(e.Changes)
+		}
+	}
+}
+
+func (m *MockAuditModel) GetAllForPerson(personID int64) ([]*data.AuditEvent, error) {
+	events := []*data.AuditEvent{}
+	for _, e := range m.events {
+		if e.PersonID == personID {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (m *MockAuditModel) GetAllSince(since time.Time) ([]*data.AuditEvent, error) {
+	events := []*data.AuditEvent{}
+	for _, e := range m.events {
+		if !e.CreatedAt.Before(since) {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
@@ -0,0 +1,21 @@
+package mock
+
+type MockHealthModel struct {
+	// PingErr is returned by Ping to simulate a broken database connection.
+	PingErr error
+	// MissingTables lists table names TableExists reports as absent.
+	MissingTables []string
+}
+
+func (m *MockHealthModel) Ping() error {
+	return m.PingErr
+}
+
+func (m *MockHealthModel) TableExists(name string) (bool, error) {
+	for _, t := range m.MissingTables {
+		if t == name {
+			return false, nil
+		}
+	}
+	return true, nil
+}
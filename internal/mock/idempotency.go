@@ -0,0 +1,60 @@
+package mock
+
+import (
+	"time"
+
+	"assecor.assessment.test/internal/data"
+)
+
+type MockIdempotencyModel struct {
+	db map[[2]string]*data.IdempotencyRecord
+}
+
+func (m *MockIdempotencyModel) Insert(rec *data.IdempotencyRecord) error {
+	id := [2]string{rec.Scope, rec.Key}
+	if old, ok := m.db[id]; ok && old.ExpiresAt.After(time.Now()) {
+		return data.ErrDuplicateKey
+	}
+	r := *rec
+	r.Status, r.ContentType, r.Body, r.Stored = 0, "", nil, false
+	m.db[id] = &r
+	return nil
+}
+
+func (m *MockIdempotencyModel) Get(scope, key string) (*data.IdempotencyRecord, error) {
+	rec, ok := m.db[[2]string{scope, key}]
+	if !ok || !rec.ExpiresAt.After(time.Now()) {
+		return nil, data.ErrRecordNotFound
+	}
+	r := *rec
+	return &r, nil
+}
+
+func (m *MockIdempotencyModel) Complete(rec *data.IdempotencyRecord) error {
+	old, ok := m.db[[2]string{rec.Scope, rec.Key}]
+	if !ok {
+		return nil
+	}
+	old.Status, old.ContentType, old.Stored = rec.Status, rec.ContentType, rec.Stored
+	old.Body = nil
+	if rec.Stored {
+		old.Body = append([]byte{}, rec.Body...)
+	}
+	return nil
+}
+
+func (m *MockIdempotencyModel) Delete(scope, key string) error {
+	delete(m.db, [2]string{scope, key})
+	return nil
+}
+
+func (m *MockIdempotencyModel) DeleteExpired() (int64, error) {
+	var n int64
+	for id, rec := range m.db {
+		if !rec.ExpiresAt.After(time.Now()) {
+			delete(m.db, id)
+			n++
+		}
+	}
+	return n, nil
+}
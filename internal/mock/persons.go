@@ -1,40 +1,112 @@
 package mock
 
 import (
+	"math"
 	"sort"
+	"time"
 
 	"assecor.assessment.test/internal/data"
+	"assecor.assessment.test/internal/events"
 )
 
 type MockPersonModel struct {
-	seqID int64
+	// seqID is shared by the copies made by WithActor.
+	seqID *int64
 	db    map[int64]*data.Person
+	// postalCodes provides the coordinates for GetAllNearby.
+	postalCodes *MockPostalCodeModel
+	// audit records the changes made by actor, which are published on
+	// events.
+	audit  *MockAuditModel
+	actor  string
+	events *events.Bus
 }
 
 func NewTestModels() data.Models {
+	postalCodes := &MockPostalCodeModel{
+		db: make(map[string]map[string][]data.PostalCode)}
+	audit := &MockAuditModel{}
+	bus := events.NewBus(100)
+	persons := &MockPersonModel{
+		seqID:       new(int64),
+		db:          make(map[int64]*data.Person),
+		postalCodes: postalCodes,
+		audit:       audit,
+		events:      bus}
 	return data.Models{
-		Persons: &MockPersonModel{
-			seqID: 0,
-			db:    make(map[int64]*data.Person)},
+		Persons: persons,
+		Health:  &MockHealthModel{},
+		Users: &MockUserModel{
+			db: make(map[string]*data.User)},
+		PostalCodes: postalCodes,
+		Stats:       &MockStatsModel{persons: persons},
+		Idempotency: &MockIdempotencyModel{
+			db: make(map[[2]string]*data.IdempotencyRecord)},
+		Audit:    audit,
+		Webhooks: &MockWebhookModel{},
+		Events:   bus,
 	}
 }
 
+func (m *MockPersonModel) WithActor(actor string) data.PersonStore {
+	c := *m
+	c.actor = actor
+	return &c
+}
+
+// record adds the change to the audit log and publishes it.
+func (m *MockPersonModel) record(operation string, before, after *data.Person) {
+	e := data.NewAuditEvent(m.actor, operation, before, after)
+	if e == nil {
+		return
+	}
+	m.audit.add(e)
+	data.PublishChange(m.events, operation, clonePerson(before), clonePerson(after))
+}
+
+// clonePerson returns a copy of the person, or nil, so later changes of the
+// stored persons don't alter published events.
+func clonePerson(p *data.Person) *data.Person {
+	if p == nil {
+		return nil
+	}
+	c := *p
+	return &c
+}
+
 func (m *MockPersonModel) Insert(person *data.Person) error {
-	m.seqID++
-	person.ID = m.seqID
-	m.db[m.seqID] = &data.Person{
-		ID:       m.seqID,
-		Name:     person.Name,
-		Lastname: person.Lastname,
-		Zipcode:  person.Zipcode,
-		City:     person.City,
-		Color:    person.Color,
+	*m.seqID++
+	person.ID = *m.seqID
+	person.CreatedAt = time.Now()
+	person.UpdatedAt = person.CreatedAt
+	m.db[person.ID] = &data.Person{
+		ID:         person.ID,
+		Name:       person.Name,
+		Lastname:   person.Lastname,
+		Zipcode:    person.Zipcode,
+		City:       person.City,
+		Country:    person.Country,
+		Color:      person.Color,
+		Source:     person.Source,
+		ExternalID: person.ExternalID,
+		CreatedAt:  person.CreatedAt,
+		UpdatedAt:  person.UpdatedAt,
 	}
+	m.record(data.AuditInsert, nil, m.db[person.ID])
 	return nil
 }
 
-func (m *MockPersonModel) Get(id int64) (*data.Person, error) {
+// get returns the person unless it is deleted.
+func (m *MockPersonModel) get(id int64) (*data.Person, bool) {
 	p, ok := m.db[id]
+	if !ok || p.DeletedAt != nil {
+		return nil, false
+	}
+	return p, true
+}
+
+func (m *MockPersonModel) Get(id int64) (*data.Person, error) {
+	p, ok := m.get(id)
 	if ok {
 		return p, nil
 	}
@@ -42,11 +114,11 @@ func (m *MockPersonModel) Get(id int64) (*data.Person, error) {
 }
 
 func (m *MockPersonModel) GetAll() ([]*data.Person, error) {
-	persons := make([]*data.Person, len(m.db))
-	i := 0
+	persons := []*data.Person{}
 	for _, p := range m.db {
-		persons[i] = p
-		i++
+		if p.DeletedAt == nil {
+			persons = append(persons, p)
+		}
 	}
 	sort.Slice(persons[:], func(i, j int) bool {
 		return persons[i].ID < persons[j].ID
@@ -54,10 +126,34 @@ func (m *MockPersonModel) GetAll() ([]*data.Person, error) {
 	return persons, nil
 }
 
+func (m *MockPersonModel) GetAllIncludingDeleted() ([]*data.Person, error) {
+	persons := make([]*data.Person, 0, len(m.db))
+	for _, p := range m.db {
+		persons = append(persons, p)
+	}
+	sort.Slice(persons, func(i, j int) bool {
+		return persons[i].ID < persons[j].ID
+	})
+	return persons, nil
+}
+
+func (m *MockPersonModel) GetAllUpdatedSince(since time.Time, includeDeleted bool) ([]*data.Person, error) {
+	persons := []*data.Person{}
+	for _, p := range m.db {
+		if (p.DeletedAt == nil || includeDeleted) && !p.UpdatedAt.Before(since) {
+			persons = append(persons, p)
+		}
+	}
+	sort.Slice(persons, func(i, j int) bool {
+		return persons[i].ID < persons[j].ID
+	})
+	return persons, nil
+}
+
 func (m *MockPersonModel) GetAllByColor(color data.Color) ([]*data.Person, error) {
 	var persons []*data.Person
 	for _, p := range m.db {
-		if p.Color == int(color) {
+		if p.Color == int(color) && p.DeletedAt == nil {
 			persons = append(persons, p)
 		}
 	}
@@ -69,3 +165,125 @@ func (m *MockPersonModel) GetAllByColor(color data.Color) ([]*data.Person, error
 	})
 	return persons, nil
 }
+
+func (m *MockPersonModel) GetAllByZipcode(country, zipcode string) ([]*data.Person, error) {
+	persons := []*data.Person{}
+	for _, p := range m.db {
+		if p.Country == country && p.Zipcode == zipcode && p.DeletedAt == nil {
+			persons = append(persons, p)
+		}
+	}
+	sort.Slice(persons, func(i, j int) bool {
+		return persons[i].ID < persons[j].ID
+	})
+	return persons, nil
+}
+
+func (m *MockPersonModel) Update(person *data.Person) error {
+	old, ok := m.get(person.ID)
+	if !ok {
+		return data.ErrRecordNotFound
+	}
+	// Like the database, Update doesn't change the external reference.
+	person.CreatedAt, person.UpdatedAt = old.CreatedAt, time.Now()
+	p := *person
+	p.Source, p.ExternalID = old.Source, old.ExternalID
+	p.DeletedAt = nil
+	m.db[person.ID] = &p
+	m.record(data.AuditUpdate, old, &p)
+	return nil
+}
+
+func (m *MockPersonModel) Upsert(person *data.Person) (bool, error) {
+	for _, p := range m.db {
+		if p.Source == person.Source && p.ExternalID == person.ExternalID {
+			person.ID = p.ID
+			if p.DeletedAt != nil {
+				m.Restore(p.ID)
+			}
+			return false, m.Update(person)
+		}
+	}
+	return true, m.Insert(person)
+}
+
+func (m *MockPersonModel) Merge(target *data.Person, sourceID int64) error {
+	if _, ok := m.get(sourceID); !ok {
+		return data.ErrRecordNotFound
+	}
+	if err := m.Update(target); err != nil {
+		return err
+	}
+	return m.Delete(sourceID)
+}
+
+func (m *MockPersonModel) Delete(id int64) error {
+	p, ok := m.get(id)
+	if !ok {
+		return data.ErrRecordNotFound
+	}
+	before := *p
+	now := time.Now()
+	p.DeletedAt, p.UpdatedAt = &now, now
+	m.record(data.AuditDelete, &before, p)
+	return nil
+}
+
+func (m *MockPersonModel) Restore(id int64) error {
+	p, ok := m.db[id]
+	if !ok || p.DeletedAt == nil {
+		return data.ErrRecordNotFound
+	}
+	before := *p
+	p.DeletedAt, p.UpdatedAt = nil, time.Now()
+	m.record(data.AuditRestore, &before, p)
+	return nil
+}
+
+func (m *MockPersonModel) Purge(deletedBefore time.Time) (int64, error) {
+	var n int64
+	for id, p := range m.db {
+		if p.DeletedAt != nil && p.DeletedAt.Before(deletedBefore) {
+			delete(m.db, id)
+			m.audit.redact(id)
+			m.record(data.AuditPurge, p, nil)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *MockPersonModel) GetAllNearby(country, zipcode string, radiusKm float64) ([]*data.NearbyPerson, error) {
+	lat, lon, ok := m.postalCodes.location(country, zipcode)
+	if !ok {
+		return nil, data.ErrRecordNotFound
+	}
+	persons := []*data.NearbyPerson{}
+	for _, p := range m.db {
+		plat, plon, ok := m.postalCodes.location(p.Country, p.Zipcode)
+		if !ok || p.DeletedAt != nil {
+			continue
+		}
+		d := haversine(lat, lon, plat, plon)
+		if d <= radiusKm {
+			persons = append(persons, &data.NearbyPerson{Person: *p, DistanceKm: d})
+		}
+	}
+	sort.Slice(persons, func(i, j int) bool {
+		if persons[i].DistanceKm != persons[j].DistanceKm {
+			return persons[i].DistanceKm < persons[j].DistanceKm
+		}
+		return persons[i].ID < persons[j].ID
+	})
+	return persons, nil
+}
+
+// haversine returns the great-circle distance between two points in km.
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Pow(math.Sin(dLat/2), 2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Pow(math.Sin(dLon/2), 2)
+	return 2 * data.EarthRadiusKm * math.Asin(math.Sqrt(a))
+}
@@ -0,0 +1,50 @@
+package mock
+
+import (
+	"sort"
+
+	"assecor.assessment.test/internal/data"
+)
+
+type MockPostalCodeModel struct {
+	// db maps country and zipcode to the directory entries.
+	db map[string]map[string][]data.PostalCode
+}
+
+func (m *MockPostalCodeModel) Replace(country string, entries []data.PostalCode) error {
+	zipcodes := make(map[string][]data.PostalCode)
+	for _, e := range entries {
+		zipcodes[e.Zipcode] = append(zipcodes[e.Zipcode], e)
+	}
+	m.db[country] = zipcodes
+	return nil
+}
+
+func (m *MockPostalCodeModel) Cities(country, zipcode string) ([]string, error) {
+	cities := []string{}
+	for _, e := range m.db[country][zipcode] {
+		cities = append(cities, e.City)
+	}
+	sort.Strings(cities)
+	return cities, nil
+}
+
+func (m *MockPostalCodeModel) HasCountry(country string) (bool, error) {
+	return len(m.db[country]) > 0, nil
+}
+
+// location returns the averaged coordinates of the zipcode.
+func (m *MockPostalCodeModel) location(country, zipcode string) (lat, lon float64, ok bool) {
+	n := 0
+	for _, e := range m.db[country][zipcode] {
+		if e.Latitude != nil && e.Longitude != nil {
+			lat += *e.Latitude
+			lon += *e.Longitude
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, 0, false
+	}
+	return lat / float64(n), lon / float64(n), true
+}
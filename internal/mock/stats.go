@@ -0,0 +1,70 @@
+package mock
+
+import (
+	"sort"
+	"strings"
+
+	"assecor.assessment.test/internal/data"
+)
+
+type MockStatsModel struct {
+	persons *MockPersonModel
+}
+
+func (m *MockStatsModel) Get(filter data.StatsFilter) (*data.Stats, error) {
+	byColor := map[data.Color]int64{}
+	byCity := map[string]int64{}
+	byRegion1 := map[string]int64{}
+	byRegion2 := map[string]int64{}
+	byLastname := map[string]int64{}
+
+	stats := data.NewStats()
+	for _, p := range m.persons.db {
+		if p.DeletedAt != nil ||
+			(filter.Color != 0 && data.Color(p.Color) != filter.Color) ||
+			(filter.City != "" && !strings.EqualFold(p.City, filter.City)) ||
+			(filter.Country != "" && p.Country != filter.Country) ||
+			!strings.HasPrefix(p.Zipcode, filter.ZipcodePrefix) ||
+			(filter.Lastname != "" && !strings.EqualFold(p.Lastname, filter.Lastname)) {
+			continue
+		}
+		stats.Total++
+		byColor[data.Color(p.Color)]++
+		byCity[p.City]++
+		byRegion1[prefix(p.Zipcode, 1)]++
+		byRegion2[prefix(p.Zipcode, 2)]++
+		byLastname[p.Lastname]++
+	}
+	names := map[string]int64{}
+	for c, n := range byColor {
+		names[c.String()] = n
+	}
+	stats.ByColor = counts(names)
+	stats.ByCity = counts(byCity)
+	stats.ByRegion1 = counts(byRegion1)
+	stats.ByRegion2 = counts(byRegion2)
+	stats.ByLastname = counts(byLastname)
+	return stats, nil
+}
+
+func prefix(s string, n int) string {
+	if len(s) < n {
+		return s
+	}
+	return s[:n]
+}
+
+// counts returns the counts sorted like the database does.
+func counts(m map[string]int64) []data.Count {
+	c := []data.Count{}
+	for k, v := range m {
+		c = append(c, data.Count{Key: k, Count: v})
+	}
+	sort.Slice(c, func(i, j int) bool {
+		if c[i].Count != c[j].Count {
+			return c[i].Count > c[j].Count
+		}
+		return c[i].Key < c[j].Key
+	})
+	return c
+}
@@ -0,0 +1,37 @@
+package mock
+
+import (
+	"time"
+
+	"assecor.assessment.test/internal/data"
+)
+
+type MockUserModel struct {
+	seqID int64
+	db    map[string]*data.User
+}
+
+func (m *MockUserModel) Insert(user *data.User, apiKey string) error {
+	m.seqID++
+	user.ID = m.seqID
+	user.CreatedAt = time.Now()
+	m.db[data.HashAPIKey(apiKey)] = &data.User{
+		ID:        user.ID,
+		Name:      user.Name,
+		Role:      user.Role,
+		CreatedAt: user.CreatedAt,
+	}
+	return nil
+}
+
+func (m *MockUserModel) GetForKey(apiKey string) (*data.User, error) {
+	u, ok := m.db[data.HashAPIKey(apiKey)]
+	if ok {
+		return u, nil
+	}
+	return nil, data.ErrRecordNotFound
+}
+
+func (m *MockUserModel) Count() (int, error) {
+	return len(m.db), nil
+}
@@ -0,0 +1,145 @@
+package mock
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"assecor.assessment.test/internal/data"
+)
+
+// MockWebhookModel is used by the delivery goroutines concurrently to the
+// handlers, unlike the other mocks it is safe for concurrent use.
+type MockWebhookModel struct {
+	mu         sync.Mutex
+	webhooks   []*data.Webhook
+	deliveries []*data.WebhookDelivery
+	seqID      int64
+}
+
+func (m *MockWebhookModel) Insert(h *data.Webhook) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.seqID++
+	h.ID = m.seqID
+	h.CreatedAt = time.Now().UTC()
+	c := *h
+	m.webhooks = append(m.webhooks, &c)
+	return nil
+}
+
+func (m *MockWebhookModel) Get(id int64) (*data.Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, h := range m.webhooks {
+		if h.ID == id {
+			c := *h
+			return &c, nil
+		}
+	}
+	return nil, data.ErrRecordNotFound
+}
+
+func (m *MockWebhookModel) GetAll() ([]*data.Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hooks := []*data.Webhook{}
+	for _, h := range m.webhooks {
+		c := *h
+		hooks = append(hooks, &c)
+	}
+	return hooks, nil
+}
+
+func (m *MockWebhookModel) Delete(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := len(m.webhooks)
+	m.webhooks = slices.DeleteFunc(m.webhooks, func(h *data.Webhook) bool { return h.ID == id })
+	if len(m.webhooks) == n {
+		return data.ErrRecordNotFound
+	}
+	m.deliveries = slices.DeleteFunc(m.deliveries, func(d *data.WebhookDelivery) bool { return d.WebhookID == id })
+	return nil
+}
+
+func (m *MockWebhookModel) Enqueue(eventType string, payload []byte) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int64
+	now := time.Now().UTC()
+	for _, h := range m.webhooks {
+		if !slices.Contains(h.Events, eventType) {
+			continue
+		}
+		m.seqID++
+		m.deliveries = append(m.deliveries, &data.WebhookDelivery{
+			ID:            m.seqID,
+			WebhookID:     h.ID,
+			EventType:     eventType,
+			Payload:       payload,
+			Status:        data.DeliveryPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+			URL:           h.URL,
+			Secret:        h.Secret,
+		})
+		n++
+	}
+	return n, nil
+}
+
+func (m *MockWebhookModel) GetDue(now time.Time, limit int) ([]*data.WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deliveries := []*data.WebhookDelivery{}
+	perWebhook := map[int64]int{}
+	for _, d := range m.deliveries {
+		if perWebhook[d.WebhookID] < limit && d.Status == data.DeliveryPending && !d.NextAttemptAt.After(now) {
+			perWebhook[d.WebhookID]++
+			c := *d
+			deliveries = append(deliveries, &c)
+		}
+	}
+	return deliveries, nil
+}
+
+func (m *MockWebhookModel) GetDeadLetters(webhookID int64) ([]*data.WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deliveries := []*data.WebhookDelivery{}
+	for _, d := range m.deliveries {
+		if d.WebhookID == webhookID && d.Status == data.DeliveryDead {
+			c := *d
+			deliveries = append(deliveries, &c)
+		}
+	}
+	return deliveries, nil
+}
+
+func (m *MockWebhookModel) Delivered(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deliveries = slices.DeleteFunc(m.deliveries, func(d *data.WebhookDelivery) bool { return d.ID == id })
+	return nil
+}
+
+func (m *MockWebhookModel) Failed(d *data.WebhookDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, old := range m.deliveries {
+		if old.ID == d.ID {
+			old.Status, old.Attempts, old.NextAttemptAt, old.LastError = d.Status, d.Attempts, d.NextAttemptAt, d.LastError
+		}
+	}
+	return nil
+}
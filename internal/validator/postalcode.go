@@ -0,0 +1,90 @@
+package validator
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// CountryRX matches ISO 3166-1 alpha-2 country codes.
+	CountryRX = regexp.MustCompile("^[A-Z]{2}$")
+	// GenericPostalCodeRX is used for countries without a registered rule.
+	GenericPostalCodeRX = regexp.MustCompile("^[A-Za-z0-9][A-Za-z0-9 -]{1,9}$")
+)
+
+type postalCodeRule struct {
+	rx     *regexp.Regexp // matches the whole postal code
+	prefix *regexp.Regexp // matches a postal code and the whitespace after it
+}
+
+var postalCodeRules = map[string]postalCodeRule{}
+
+func init() {
+	RegisterPostalCode("DE", `[0-9]{5}`)
+	RegisterPostalCode("AT", `[0-9]{4}`)
+	RegisterPostalCode("CH", `[0-9]{4}`)
+	RegisterPostalCode("LI", `94[89][0-9]`)
+	RegisterPostalCode("BE", `[0-9]{4}`)
+	RegisterPostalCode("LU", `(?:L-)?[0-9]{4}`)
+	RegisterPostalCode("DK", `[0-9]{4}`)
+	RegisterPostalCode("NL", `[1-9][0-9]{3} ?[A-Za-z]{2}`)
+	RegisterPostalCode("FR", `[0-9]{5}`)
+	RegisterPostalCode("IT", `[0-9]{5}`)
+	RegisterPostalCode("ES", `[0-9]{5}`)
+	RegisterPostalCode("PL", `[0-9]{2}-[0-9]{3}`)
+	RegisterPostalCode("GB", `(?:GIR ?0AA|[A-Za-z]{1,2}[0-9][A-Za-z0-9]? ?[0-9][A-Za-z]{2})`)
+	RegisterPostalCode("US", `[0-9]{5}(?:-[0-9]{4})?`)
+}
+
+// RegisterPostalCode sets the postal code pattern of a country. The pattern
+// must not be anchored.
+func RegisterPostalCode(country, pattern string) {
+	postalCodeRules[country] = postalCodeRule{
+		rx:     regexp.MustCompile("^(?:" + pattern + ")$"),
+		prefix: regexp.MustCompile(`^(` + pattern + `)(\s*)`),
+	}
+}
+
+// PostalCodeRX returns the postal code pattern of the country, or the
+// generic pattern if there is no rule for it.
+func PostalCodeRX(country string) *regexp.Regexp {
+	if rule, ok := postalCodeRules[country]; ok {
+		return rule.rx
+	}
+	return GenericPostalCodeRX
+}
+
+// SplitPostalCode splits a "<postal code> <city>" string using the rule of
+// the country. For countries without a rule the leading digits are taken as
+// postal code. A numeric postal code may be directly followed by the city,
+// e.g. "67742Lauterecken", other postal codes must be separated by
+// whitespace. If no postal code is found, code is empty and the whole string
+// is returned as rest.
+func SplitPostalCode(country, s string) (code, rest string) {
+	s = strings.TrimSpace(s)
+	if rule, ok := postalCodeRules[country]; ok {
+		m := rule.prefix.FindStringSubmatch(s)
+		if m == nil {
+			return "", s
+		}
+		code, rest = m[1], s[len(m[0]):]
+		if m[2] == "" && rest != "" && (!isDigits(code) || isDigits(rest[:1])) {
+			return "", s
+		}
+		return code, rest
+	}
+
+	i := strings.IndexFunc(s, notDigit)
+	if i <= 0 {
+		return "", s
+	}
+	return s[:i], strings.TrimSpace(s[i:])
+}
+
+func notDigit(r rune) bool {
+	return r < '0' || r > '9'
+}
+
+func isDigits(s string) bool {
+	return strings.IndexFunc(s, notDigit) < 0
+}
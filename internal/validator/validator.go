@@ -1,20 +1,78 @@
 package validator
 
 import (
+	"fmt"
 	"regexp"
+	"strings"
 )
 
-var (
-	ZipCodeRX = regexp.MustCompile("^[0-9]{5}(?:-[0-9]{4})?$")
+// Stable error codes clients can map to UI fields and translations.
+const (
+	CodeInvalid    = "invalid"
+	CodeRequired   = "required"
+	CodeMaxLength  = "max_length"
+	CodePattern    = "pattern"
+	CodeOutOfRange = "out_of_range"
+	CodeOneOf      = "one_of"
 )
 
-// Define a new Validator type which contains a map of validation errors.
+// Error is a single failed check of a field. Params holds the values of the
+// rule, e.g. the maximum length, so clients can build their own messages.
+type Error struct {
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Params  map[string]interface{} `json:"params,omitempty"`
+}
+
+// Required is the error of an empty mandatory field.
+func Required() Error {
+	return Error{Code: CodeRequired, Message: "must be provided"}
+}
+
+// MaxLength is the error of a value longer than max bytes.
+func MaxLength(max int) Error {
+	return Error{
+		Code:    CodeMaxLength,
+		Message: fmt.Sprintf("must not be more than %d bytes long", max),
+		Params:  map[string]interface{}{"max": max},
+	}
+}
+
+// Pattern is the error of a value not matching the regular expression.
+func Pattern(message string, rx *regexp.Regexp) Error {
+	return Error{
+		Code:    CodePattern,
+		Message: message,
+		Params:  map[string]interface{}{"pattern": rx.String()},
+	}
+}
+
+// OutOfRange is the error of a number outside of [min, max].
+func OutOfRange(min, max int) Error {
+	return Error{
+		Code:    CodeOutOfRange,
+		Message: fmt.Sprintf("must be between %d and %d", min, max),
+		Params:  map[string]interface{}{"min": min, "max": max},
+	}
+}
+
+// OneOf is the error of a value which is not in the list of permitted values.
+func OneOf(values ...string) Error {
+	return Error{
+		Code:    CodeOneOf,
+		Message: "must be one of " + strings.Join(values, ", "),
+		Params:  map[string]interface{}{"values": values},
+	}
+}
+
+// Define a new Validator type which contains a map of validation errors,
+// there may be several errors per field.
 type Validator struct {
-	Errors map[string]string
+	Errors map[string][]Error
 }
 
 func New() *Validator {
-	return &Validator{Errors: make(map[string]string)}
+	return &Validator{Errors: make(map[string][]Error)}
 }
 
 // Valid returns true if the errors map doesn't contain any entries.
@@ -22,22 +80,53 @@ func (v *Validator) Valid() bool {
 	return len(v.Errors) == 0
 }
 
-// AddError adds an error message to the map (so long as no entry already exists for
-// the given key).
+// Add appends an error to the errors of the given key.
+func (v *Validator) Add(key string, e Error) {
+	v.Errors[key] = append(v.Errors[key], e)
+}
+
+// AddError adds an error message with the generic "invalid" code.
 func (v *Validator) AddError(key, message string) {
-	if _, exists := v.Errors[key]; !exists {
-		v.Errors[key] = message
-	}
+	v.Add(key, Error{Code: CodeInvalid, Message: message})
 }
 
-// Check adds an error message to the map only if a validation check is not 'ok'.
+// Check adds an error message only if a validation check is not 'ok'.
 func (v *Validator) Check(ok bool, key, message string) {
 	if !ok {
 		v.AddError(key, message)
 	}
 }
 
+// CheckError adds the error only if a validation check is not 'ok'.
+func (v *Validator) CheckError(ok bool, key string, e Error) {
+	if !ok {
+		v.Add(key, e)
+	}
+}
+
+// Messages returns the first error message of every key.
+func (v *Validator) Messages() map[string]string {
+	messages := make(map[string]string, len(v.Errors))
+	for key, errs := range v.Errors {
+		if len(errs) > 0 {
+			messages[key] = errs[0].Message
+		}
+	}
+	return messages
+}
+
 // Matches returns true if a string value matches a specific regexp pattern.
 func Matches(value string, rx *regexp.Regexp) bool {
 	return rx.MatchString(value)
 }
+
+// PermittedValue returns true if a specific value is in a list of permitted
+// values.
+func PermittedValue[T comparable](value T, permittedValues ...T) bool {
+	for i := range permittedValues {
+		if value == permittedValues[i] {
+			return true
+		}
+	}
+	return false
+}